@@ -0,0 +1,41 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command kubectl-clustercidr is a kubectl plugin inspecting the ClusterCIDRs
+// of a cluster and validating ClusterCIDR manifests.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"k8s.io/klog/v2"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/cli"
+)
+
+func main() {
+	// The allocator logs while it rebuilds the state of the cluster, the
+	// plugin only prints the results.
+	klog.LogToStderr(false)
+	klog.SetOutput(io.Discard)
+
+	if err := cli.RunPlugin(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
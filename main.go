@@ -19,14 +19,21 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1/validation"
+	"github.com/mneverov/cluster-cidr-controller/pkg/cli"
 	clientset "github.com/mneverov/cluster-cidr-controller/pkg/client/clientset/versioned"
 	informers "github.com/mneverov/cluster-cidr-controller/pkg/client/informers/externalversions"
 	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
 	"github.com/mneverov/cluster-cidr-controller/pkg/signals"
+	"github.com/mneverov/cluster-cidr-controller/pkg/util/auth"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
@@ -38,16 +45,48 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// subcommands maps the name of a subcommand to its implementation.
+var subcommands = map[string]func(args []string) error{
+	"explain": cli.RunExplain,
+	"whois":   cli.RunWhois,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var (
-		apiServerURL    string
-		kubeconfig      string
-		healthProbeAddr string
+		apiServerURL       string
+		kubeconfig         string
+		healthProbeAddr    string
+		quarantineDuration time.Duration
+		primaryIPFamily    string
+		sizeByPodCapacity  bool
+		allocationGate     ipam.AllocationGate
+		startupTaintKey    string
+		dryRun             bool
 	)
 
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&apiServerURL, "apiserver", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&healthProbeAddr, "health-probe-address", ":8081", "Specifies the TCP address for the health server to listen on.")
+	flag.DurationVar(&quarantineDuration, "cidr-quarantine-duration", 0, "The time a released node CIDR is not allocated to other nodes. 0 disables the quarantine.")
+	flag.StringVar(&primaryIPFamily, "primary-ip-family", string(corev1.IPv4Protocol), "The ip family of the first PodCIDR of dual-stack nodes for ClusterCIDRs that do not specify one, IPv4 or IPv6.")
+	flag.BoolVar(&sizeByPodCapacity, "size-node-cidrs-by-pod-capacity", false, "Size the CIDRs of nodes without the networking.x-k8s.io/max-pods annotation by their pod capacity.")
+
+	flag.StringVar(&allocationGate.Label, "allocation-gate-label", "", "Key of the node label new nodes wait for before they are allocated PodCIDRs.")
+	flag.StringVar(&allocationGate.Annotation, "allocation-gate-annotation", "", "Key of the node annotation new nodes wait for before they are allocated PodCIDRs.")
+	flag.StringVar(&allocationGate.TaintKey, "allocation-gate-taint", "", "Key of the node taint new nodes wait for before they are allocated PodCIDRs.")
+	flag.DurationVar(&allocationGate.Timeout, "allocation-gate-timeout", 0, "The time after the node creation PodCIDRs are allocated regardless of the allocation gate. 0 waits indefinitely.")
+	flag.StringVar(&startupTaintKey, "startup-taint-key", "", "Key of the node taint removed once the node is allocated PodCIDRs, e.g. registered by the kubelet with --register-with-taints.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Compute the allocations without patching nodes and ClusterCIDRs. The skipped writes are logged, recorded as events and counted in metrics.")
 
 	klog.InitFlags(nil)
 	flag.Parse()
@@ -55,6 +94,15 @@ func main() {
 	ctx := signals.SetupSignalHandler()
 	logger := klog.FromContext(ctx)
 
+	if errs := validation.ValidateIPFamily(corev1.IPFamily(primaryIPFamily), field.NewPath("primary-ip-family")); len(errs) > 0 {
+		logger.Error(errs.ToAggregate(), "invalid flag")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+	if allocationGate.Timeout < 0 {
+		logger.Error(errors.New("must be non-negative"), "invalid flag", "flag", "allocation-gate-timeout")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+
 	cfg, err := clientcmd.BuildConfigFromFlags(apiServerURL, kubeconfig)
 	if err != nil {
 		logger.Error(err, "failed to build kubeconfig")
@@ -89,7 +137,14 @@ func main() {
 		cidrClient.NetworkingV1().ClusterCIDRs(),
 		kubeInformerFactory.Core().V1().Nodes(),
 		sharedInformerFactory.Networking().V1().ClusterCIDRs(),
-		ipam.CIDRAllocatorParams{},
+		ipam.CIDRAllocatorParams{
+			QuarantineDuration: quarantineDuration,
+			PrimaryIPFamily:    corev1.IPFamily(primaryIPFamily),
+			SizeByPodCapacity:  sizeByPodCapacity,
+			AllocationGate:     allocationGate,
+			StartupTaintKey:    startupTaintKey,
+			DryRun:             dryRun,
+		},
 		nodes,
 		nil,
 	)
@@ -101,7 +156,7 @@ func main() {
 	kubeInformerFactory.Start(ctx.Done())
 	sharedInformerFactory.Start(ctx.Done())
 
-	server := startHealthProbeServer(healthProbeAddr, logger)
+	server := startHealthProbeServer(healthProbeAddr, logger, kubeClient, cidrController)
 	cidrController.Run(ctx)
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Error(err, "failed to shut down health server")
@@ -109,8 +164,8 @@ func main() {
 }
 
 // startHealthProbeServer starts a web server that has two endpoints `/readyz` and `/healthz` and always responds
-// 200 OK.
-func startHealthProbeServer(addr string, logger klog.Logger) *http.Server {
+// 200 OK. The server also serves the debug endpoints of the allocator under `/debug/` to authorized users.
+func startHealthProbeServer(addr string, logger klog.Logger, kubeClient kubernetes.Interface, allocator ipam.CIDRAllocator) *http.Server {
 	const defaultTimeout = 30 * time.Second
 	mux := http.NewServeMux()
 	server := &http.Server{
@@ -124,6 +179,12 @@ func startHealthProbeServer(addr string, logger klog.Logger) *http.Server {
 	mux.Handle("/readyz", makeHealthHandler())
 	mux.Handle("/healthz", makeHealthHandler())
 
+	debugMux := http.NewServeMux()
+	debugMux.Handle(cli.ExplainPath, ipam.NewExplainHandler(allocator))
+	debugMux.Handle(cli.StatePath, ipam.NewStateHandler(allocator))
+	debugMux.Handle(cli.WhoisPath, ipam.NewWhoisHandler(allocator))
+	mux.Handle("/debug/", auth.WithDelegatedAuth(kubeClient, logger, debugMux))
+
 	go func() {
 		err := server.ListenAndServe()
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
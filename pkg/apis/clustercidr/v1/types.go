@@ -32,15 +32,16 @@ import (
 // selector matches the Node may be used.
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
 // +genclient
-// +genclient:noStatus
 // +genclient:nonNamespaced
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type ClusterCIDR struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec ClusterCIDRSpec `json:"spec,omitempty"`
+	Spec   ClusterCIDRSpec   `json:"spec,omitempty"`
+	Status ClusterCIDRStatus `json:"status,omitempty"`
 }
 
 // Default implements webhook.Defaulter so a webhook will be registered for the type.
@@ -65,6 +66,24 @@ type ClusterCIDRSpec struct {
 	// +required
 	PerNodeHostBits int32 `json:"perNodeHostBits"`
 
+	// maxPerNodeHostBits is the number of host bits of the largest node CIDR
+	// allocated from the ClusterCIDR. If set, `perNodeHostBits` is the
+	// number of host bits of the smallest node CIDR and nodes requesting a
+	// larger CIDR with the networking.x-k8s.io/max-pods annotation, or their
+	// pod capacity, are allocated a block of up to `maxPerNodeHostBits`.
+	// Blocks are carved out of the range buddy style to limit fragmentation.
+	// This field is optional and immutable.
+	// +optional
+	MaxPerNodeHostBits int32 `json:"maxPerNodeHostBits,omitempty"`
+
+	// reservations pins the PodCIDRs of nodes. The reserved CIDRs are not
+	// allocated to any other node and stay reserved when the node is deleted.
+	// This field is optional and immutable.
+	// +listType=map
+	// +listMapKey=nodeName
+	// +optional
+	Reservations []PinnedReservation `json:"reservations,omitempty"`
+
 	// ipv4 defines an IPv4 IP block in CIDR notation(e.g. "10.0.0.0/8").
 	// At least one of ipv4 and ipv6 must be specified.
 	// This field is optional and immutable.
@@ -76,6 +95,211 @@ type ClusterCIDRSpec struct {
 	// This field is optional and immutable.
 	// +optional
 	IPv6 string `json:"ipv6,omitempty"`
+
+	// allocationStrategy defines how the next free per node CIDR is picked.
+	// RoundRobin walks forward from the last allocated CIDR, Sequential picks
+	// the free CIDR with the lowest address, Random picks a free CIDR at a
+	// random position and BestFit packs the CIDRs into the most used aligned
+	// supernet to keep large blocks free. NodeIndex allocates the CIDR at the
+	// index derived from the node, see nodeIndex.
+	// Defaults to RoundRobin.
+	// This field is optional and immutable.
+	// +kubebuilder:validation:Enum=RoundRobin;Sequential;Random;BestFit;NodeIndex
+	// +optional
+	AllocationStrategy AllocationStrategy `json:"allocationStrategy,omitempty"`
+
+	// aggregation groups the per node CIDRs of nodes sharing a topology label
+	// value into a single aligned supernet, so that each group can be
+	// advertised as one aggregated route. A supernet is reserved for a group
+	// when the first node of the group is allocated a CIDR.
+	// Nodes without the topology label get CIDRs outside of the supernets.
+	// This field is optional and immutable.
+	// +optional
+	Aggregation *Aggregation `json:"aggregation,omitempty"`
+
+	// stickyGracePeriod is the time the CIDRs of a deleted node stay reserved
+	// for a node with the same name, e.g. a node re-created on reimage.
+	// A node registered with the same name during the grace period gets the
+	// same CIDRs back, afterwards the CIDRs are released.
+	// This field is optional and immutable, unset or 0 disables the reservation.
+	// +optional
+	StickyGracePeriod *metav1.Duration `json:"stickyGracePeriod,omitempty"`
+
+	// nodeIndex maps a node to the index of its per node CIDR when
+	// allocationStrategy is NodeIndex, e.g. the node rack3-node17 with the
+	// nameRegex `node(\d+)$` gets the CIDR with index 17 of the ClusterCIDR.
+	// A node whose CIDR is taken or out of range does not get a CIDR.
+	// Must be set if and only if allocationStrategy is NodeIndex.
+	// This field is optional and immutable.
+	// +optional
+	NodeIndex *NodeIndex `json:"nodeIndex,omitempty"`
+
+	// correlatedIndices allocates the IPv4 and IPv6 CIDRs of a node at the
+	// same index of the ipv4 and ipv6 ranges, e.g. the node with the 5th IPv4
+	// CIDR gets the 5th IPv6 CIDR. Only valid for dual-stack ClusterCIDRs.
+	// This field is optional and immutable.
+	// +optional
+	CorrelatedIndices bool `json:"correlatedIndices,omitempty"`
+
+	// primaryIPFamily is the ip family of the first CIDR in the podCIDRs of
+	// dual-stack nodes, which kubelet and kube-proxy treat as the primary ip
+	// family of the node. Defaults to the primary ip family of the controller.
+	// For single-stack ClusterCIDRs it must match the ip family of the range.
+	// This field is optional and immutable.
+	// +kubebuilder:validation:Enum=IPv4;IPv6
+	// +optional
+	PrimaryIPFamily api.IPFamily `json:"primaryIPFamily,omitempty"`
+
+	// singleStackFallback allows the allocation of a single ip family to
+	// dual-stack nodes when the other ip family has no free CIDRs left in any
+	// matching ClusterCIDR. Requires both `ipv4` and `ipv6`.
+	// This field is optional and immutable.
+	// +optional
+	SingleStackFallback bool `json:"singleStackFallback,omitempty"`
+
+	// allocationPaused stops the allocation of CIDRs from the ClusterCIDR to
+	// new nodes. Nodes already allocated CIDRs from the ClusterCIDR keep them
+	// and the CIDRs of deleted nodes are released as usual.
+	// This field is optional and mutable.
+	// +optional
+	AllocationPaused bool `json:"allocationPaused,omitempty"`
+}
+
+// NodeIndex defines how the index of the per node CIDR is derived from a node.
+// Exactly one of nameRegex and label must be specified.
+type NodeIndex struct {
+	// nameRegex is a regular expression matched against the node name, the
+	// first capture group is the decimal index.
+	// +optional
+	NameRegex string `json:"nameRegex,omitempty"`
+
+	// label is the node label whose value is the decimal index, e.g.
+	// "example.com/node-index".
+	// +optional
+	Label string `json:"label,omitempty"`
+}
+
+// Aggregation defines how per node CIDRs are grouped into supernets.
+type Aggregation struct {
+	// topologyKey is the node label whose value groups the nodes,
+	// e.g. "topology.kubernetes.io/zone".
+	// +kubebuilder:validation:Required
+	// +required
+	TopologyKey string `json:"topologyKey"`
+
+	// supernetHostBits defines the number of host bits of the supernet
+	// reserved for each group. It must be greater than perNodeHostBits, e.g.
+	// perNodeHostBits 8 and supernetHostBits 12 reserve a /20 IPv4 supernet
+	// with room for 16 nodes per group.
+	// +kubebuilder:validation:Required
+	// +required
+	SupernetHostBits int32 `json:"supernetHostBits"`
+}
+
+// AllocationStrategy defines how the next free per node CIDR is picked.
+type AllocationStrategy string
+
+const (
+	// RoundRobinAllocationStrategy walks forward from the last allocated CIDR.
+	RoundRobinAllocationStrategy AllocationStrategy = "RoundRobin"
+	// SequentialAllocationStrategy picks the free CIDR with the lowest address.
+	SequentialAllocationStrategy AllocationStrategy = "Sequential"
+	// RandomAllocationStrategy picks a free CIDR at a random position.
+	RandomAllocationStrategy AllocationStrategy = "Random"
+	// BestFitAllocationStrategy packs the CIDRs into the most used aligned supernet.
+	BestFitAllocationStrategy AllocationStrategy = "BestFit"
+	// NodeIndexAllocationStrategy picks the CIDR at the index derived from the node.
+	NodeIndexAllocationStrategy AllocationStrategy = "NodeIndex"
+)
+
+// ClusterCIDRStatus defines the observed state of ClusterCIDR.
+type ClusterCIDRStatus struct {
+	// supernets lists the supernets reserved for groups of nodes when
+	// spec.aggregation is set.
+	// +optional
+	Supernets []Supernet `json:"supernets,omitempty"`
+
+	// quarantine lists the released per node CIDRs that are not allocated to
+	// other nodes until the quarantine of the controller expires. It is used to
+	// restore the quarantine after a controller restart.
+	// +optional
+	Quarantine []QuarantinedCIDR `json:"quarantine,omitempty"`
+
+	// stickyReservations lists the CIDRs of deleted nodes reserved for nodes
+	// with the same name when spec.stickyGracePeriod is set.
+	// +optional
+	StickyReservations []StickyReservation `json:"stickyReservations,omitempty"`
+
+	// drainingNodes lists the nodes still allocated PodCIDRs from the
+	// ClusterCIDR while it is draining.
+	// +listType=set
+	// +optional
+	DrainingNodes []string `json:"drainingNodes,omitempty"`
+
+	// allocationPaused is true while the controller does not allocate CIDRs
+	// from the ClusterCIDR to new nodes.
+	// +optional
+	AllocationPaused bool `json:"allocationPaused,omitempty"`
+
+	// observedGeneration is the latest generation of the ClusterCIDR the
+	// controller allocates from. Only changes of mutable spec fields are
+	// observed, a ClusterCIDR with modified immutable fields is not used for
+	// allocation after a controller restart.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// specHash is the hash of the immutable spec fields of the ClusterCIDR
+	// the controller allocates from. A ClusterCIDR whose immutable fields no
+	// longer match the hash is not used for allocation after a controller
+	// restart.
+	// +optional
+	SpecHash string `json:"specHash,omitempty"`
+}
+
+// PinnedReservation reserves PodCIDRs for a node.
+type PinnedReservation struct {
+	// nodeName is the name of the node the PodCIDRs are reserved for.
+	NodeName string `json:"nodeName"`
+
+	// podCIDRs are the reserved PodCIDRs, one for each ip family of the
+	// ClusterCIDR. Each must be a per node CIDR of the range.
+	PodCIDRs []string `json:"podCIDRs"`
+}
+
+// StickyReservation holds the CIDRs of a deleted node for a node with the
+// same name.
+type StickyReservation struct {
+	// nodeName is the name of the deleted node.
+	NodeName string `json:"nodeName"`
+
+	// podCIDRs are the CIDRs of the deleted node.
+	PodCIDRs []string `json:"podCIDRs"`
+
+	// expirationTime is the time the CIDRs are released.
+	ExpirationTime metav1.Time `json:"expirationTime"`
+}
+
+// QuarantinedCIDR is a released per node CIDR in quarantine.
+type QuarantinedCIDR struct {
+	// cidr is the released per node CIDR.
+	CIDR string `json:"cidr"`
+
+	// releaseTime is the time the CIDR was released.
+	ReleaseTime metav1.Time `json:"releaseTime"`
+}
+
+// Supernet is an aligned block of per node CIDRs reserved for a group of nodes.
+type Supernet struct {
+	// group is the value of the topology label shared by the nodes.
+	Group string `json:"group"`
+
+	// ipv4 is the IPv4 supernet in CIDR notation.
+	// +optional
+	IPv4 string `json:"ipv4,omitempty"`
+
+	// ipv6 is the IPv6 supernet in CIDR notation.
+	// +optional
+	IPv6 string `json:"ipv6,omitempty"`
 }
 
 // ClusterCIDRList contains a list of ClusterCIDRs.
@@ -15,6 +15,8 @@ package validation
 
 import (
 	"fmt"
+	"net"
+	"regexp"
 
 	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
 
@@ -22,6 +24,7 @@ import (
 	apimachineryvalidation "k8s.io/apimachinery/pkg/api/validation"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	unversionedvalidation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	netutils "k8s.io/utils/net"
 )
@@ -67,6 +70,149 @@ func ValidateClusterCIDRSpec(spec *v1.ClusterCIDRSpec, fldPath *field.Path) fiel
 		allErrs = append(allErrs, validateCIDRConfig(spec.IPv6, spec.PerNodeHostBits, 128, corev1.IPv6Protocol, fldPath)...)
 	}
 
+	allErrs = append(allErrs, validateMaxPerNodeHostBits(spec, fldPath.Child("maxPerNodeHostBits"))...)
+	allErrs = append(allErrs, validateReservations(spec, fldPath.Child("reservations"))...)
+	allErrs = append(allErrs, validateAllocationStrategy(spec.AllocationStrategy, fldPath.Child("allocationStrategy"))...)
+
+	if spec.Aggregation != nil {
+		allErrs = append(allErrs, validateAggregation(spec, fldPath.Child("aggregation"))...)
+	}
+
+	allErrs = append(allErrs, validateNodeIndex(spec, fldPath)...)
+	allErrs = append(allErrs, validatePrimaryIPFamily(spec, fldPath.Child("primaryIPFamily"))...)
+
+	if spec.CorrelatedIndices {
+		if spec.IPv4 == "" || spec.IPv6 == "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("correlatedIndices"), spec.CorrelatedIndices, "requires both `ipv4` and `ipv6` to be specified"))
+		}
+		if spec.Aggregation != nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("aggregation"), "may not be specified together with `correlatedIndices`"))
+		}
+	}
+
+	if spec.SingleStackFallback {
+		if spec.IPv4 == "" || spec.IPv6 == "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("singleStackFallback"), spec.SingleStackFallback, "requires both `ipv4` and `ipv6` to be specified"))
+		}
+		if spec.AllocationStrategy == v1.NodeIndexAllocationStrategy {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("singleStackFallback"), "may not be specified when `allocationStrategy` is 'NodeIndex'"))
+		}
+	}
+
+	if spec.StickyGracePeriod != nil && spec.StickyGracePeriod.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("stickyGracePeriod"), spec.StickyGracePeriod.Duration.String(), "must be greater than or equal to 0"))
+	}
+
+	return allErrs
+}
+
+var supportedAllocationStrategies = sets.New(
+	string(v1.RoundRobinAllocationStrategy),
+	string(v1.SequentialAllocationStrategy),
+	string(v1.RandomAllocationStrategy),
+	string(v1.BestFitAllocationStrategy),
+	string(v1.NodeIndexAllocationStrategy),
+)
+
+func validateAllocationStrategy(strategy v1.AllocationStrategy, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if strategy != "" && !supportedAllocationStrategies.Has(string(strategy)) {
+		allErrs = append(allErrs, field.NotSupported(fldPath, strategy, sets.List(supportedAllocationStrategies)))
+	}
+	return allErrs
+}
+
+// ValidateIPFamily tests that the ip family is one that kubelet and
+// kube-proxy accept as the primary ip family of a node.
+func ValidateIPFamily(family corev1.IPFamily, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if family != corev1.IPv4Protocol && family != corev1.IPv6Protocol {
+		allErrs = append(allErrs, field.NotSupported(fldPath, family, []string{string(corev1.IPv4Protocol), string(corev1.IPv6Protocol)}))
+	}
+	return allErrs
+}
+
+func validatePrimaryIPFamily(spec *v1.ClusterCIDRSpec, fldPath *field.Path) field.ErrorList {
+	family := spec.PrimaryIPFamily
+	if family == "" {
+		return nil
+	}
+
+	allErrs := ValidateIPFamily(family, fldPath)
+	if len(allErrs) > 0 {
+		return allErrs
+	}
+	if (family == corev1.IPv4Protocol && spec.IPv4 == "") || (family == corev1.IPv6Protocol && spec.IPv6 == "") {
+		allErrs = append(allErrs, field.Invalid(fldPath, family, "must match an ip family of the ClusterCIDR"))
+	}
+	return allErrs
+}
+
+func validateNodeIndex(spec *v1.ClusterCIDRSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	nodeIndexPath := fldPath.Child("nodeIndex")
+
+	if spec.AllocationStrategy != v1.NodeIndexAllocationStrategy {
+		if spec.NodeIndex != nil {
+			allErrs = append(allErrs, field.Forbidden(nodeIndexPath, "may only be specified when `allocationStrategy` is 'NodeIndex'"))
+		}
+		return allErrs
+	}
+
+	if spec.NodeIndex == nil {
+		return append(allErrs, field.Required(nodeIndexPath, "must be specified when `allocationStrategy` is 'NodeIndex'"))
+	}
+	if spec.Aggregation != nil {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("aggregation"), "may not be specified when `allocationStrategy` is 'NodeIndex'"))
+	}
+
+	nodeIndex := spec.NodeIndex
+	switch {
+	case nodeIndex.NameRegex != "" && nodeIndex.Label != "":
+		allErrs = append(allErrs, field.Invalid(nodeIndexPath, nodeIndex, "only one of `nameRegex` and `label` may be specified"))
+	case nodeIndex.NameRegex != "":
+		re, err := regexp.Compile(nodeIndex.NameRegex)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(nodeIndexPath.Child("nameRegex"), nodeIndex.NameRegex, fmt.Sprintf("must be a valid regular expression: %v", err)))
+		} else if re.NumSubexp() == 0 {
+			allErrs = append(allErrs, field.Invalid(nodeIndexPath.Child("nameRegex"), nodeIndex.NameRegex, "must have a capture group"))
+		}
+	case nodeIndex.Label != "":
+		allErrs = append(allErrs, unversionedvalidation.ValidateLabelName(nodeIndex.Label, nodeIndexPath.Child("label"))...)
+	default:
+		allErrs = append(allErrs, field.Required(nodeIndexPath, "one of `nameRegex` and `label` must be specified"))
+	}
+	return allErrs
+}
+
+func validateAggregation(spec *v1.ClusterCIDRSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	aggregation := spec.Aggregation
+
+	allErrs = append(allErrs, unversionedvalidation.ValidateLabelName(aggregation.TopologyKey, fldPath.Child("topologyKey"))...)
+
+	if aggregation.SupernetHostBits <= spec.PerNodeHostBits {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("supernetHostBits"), aggregation.SupernetHostBits, "must be greater than perNodeHostBits"))
+		return allErrs
+	}
+
+	for _, config := range []struct {
+		cidr        string
+		maxMaskSize int32
+	}{{spec.IPv4, 32}, {spec.IPv6, 128}} {
+		if config.cidr == "" {
+			continue
+		}
+		_, ipNet, err := netutils.ParseCIDRSloppy(config.cidr)
+		if err != nil {
+			// Reported by validateCIDRConfig.
+			continue
+		}
+		maskSize, _ := ipNet.Mask.Size()
+		if maxSupernetHostBits := config.maxMaskSize - int32(maskSize); aggregation.SupernetHostBits > maxSupernetHostBits {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("supernetHostBits"), aggregation.SupernetHostBits, fmt.Sprintf("must be less than or equal to %d for %s", maxSupernetHostBits, config.cidr)))
+		}
+	}
 	return allErrs
 }
 
@@ -100,6 +246,119 @@ func validateCIDRConfig(configCIDR string, perNodeHostBits, maxMaskSize int32, i
 	return allErrs
 }
 
+func validateMaxPerNodeHostBits(spec *v1.ClusterCIDRSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if spec.MaxPerNodeHostBits == 0 {
+		return allErrs
+	}
+
+	if spec.MaxPerNodeHostBits < spec.PerNodeHostBits {
+		allErrs = append(allErrs, field.Invalid(fldPath, spec.MaxPerNodeHostBits, "must be greater than or equal to `perNodeHostBits`"))
+	}
+	for _, cidr := range []struct {
+		config      string
+		maxMaskSize int32
+	}{{spec.IPv4, 32}, {spec.IPv6, 128}} {
+		if cidr.config == "" {
+			continue
+		}
+		_, ipNet, err := netutils.ParseCIDRSloppy(cidr.config)
+		if err != nil {
+			// Reported by validateCIDRConfig.
+			continue
+		}
+		maskSize, _ := ipNet.Mask.Size()
+		if maxHostBits := cidr.maxMaskSize - int32(maskSize); spec.MaxPerNodeHostBits > maxHostBits {
+			allErrs = append(allErrs, field.Invalid(fldPath, spec.MaxPerNodeHostBits, fmt.Sprintf("must be less than or equal to %d", maxHostBits)))
+		}
+	}
+	if spec.AllocationStrategy == v1.NodeIndexAllocationStrategy {
+		allErrs = append(allErrs, field.Forbidden(fldPath, "may not be specified when `allocationStrategy` is 'NodeIndex'"))
+	}
+	if spec.CorrelatedIndices {
+		allErrs = append(allErrs, field.Forbidden(fldPath, "may not be specified together with `correlatedIndices`"))
+	}
+	return allErrs
+}
+
+func validateReservations(spec *v1.ClusterCIDRSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if len(spec.Reservations) == 0 {
+		return allErrs
+	}
+	if spec.AllocationStrategy == v1.NodeIndexAllocationStrategy {
+		return append(allErrs, field.Forbidden(fldPath, "may not be specified when `allocationStrategy` is 'NodeIndex'"))
+	}
+
+	ranges := make(map[corev1.IPFamily]*net.IPNet)
+	for family, config := range map[corev1.IPFamily]string{corev1.IPv4Protocol: spec.IPv4, corev1.IPv6Protocol: spec.IPv6} {
+		if config == "" {
+			continue
+		}
+		_, ipNet, err := netutils.ParseCIDRSloppy(config)
+		if err != nil {
+			// Reported by validateCIDRConfig.
+			return allErrs
+		}
+		ranges[family] = ipNet
+	}
+
+	maxHostBits := spec.MaxPerNodeHostBits
+	if maxHostBits == 0 {
+		maxHostBits = spec.PerNodeHostBits
+	}
+	nodeNames := sets.New[string]()
+	var reserved []*net.IPNet
+	for i, reservation := range spec.Reservations {
+		idxPath := fldPath.Index(i)
+		for _, msg := range apimachineryvalidation.NameIsDNSSubdomain(reservation.NodeName, false) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("nodeName"), reservation.NodeName, msg))
+		}
+		if nodeNames.Has(reservation.NodeName) {
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("nodeName"), reservation.NodeName))
+		}
+		nodeNames.Insert(reservation.NodeName)
+
+		if len(reservation.PodCIDRs) != len(ranges) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("podCIDRs"), reservation.PodCIDRs, "must have one CIDR for each ip family of the ClusterCIDR"))
+			continue
+		}
+		families := sets.New[corev1.IPFamily]()
+		for j, podCIDR := range reservation.PodCIDRs {
+			cidrPath := idxPath.Child("podCIDRs").Index(j)
+			_, cidr, err := netutils.ParseCIDRSloppy(podCIDR)
+			if err != nil {
+				allErrs = append(allErrs, field.Invalid(cidrPath, podCIDR, "must be a valid CIDR"))
+				continue
+			}
+			family := corev1.IPv4Protocol
+			if netutils.IsIPv6CIDR(cidr) {
+				family = corev1.IPv6Protocol
+			}
+			if families.Has(family) {
+				allErrs = append(allErrs, field.Invalid(cidrPath, podCIDR, "must have one CIDR for each ip family of the ClusterCIDR"))
+				continue
+			}
+			families.Insert(family)
+
+			ipRange, ok := ranges[family]
+			maskSize, ipBits := cidr.Mask.Size()
+			if hostBits := int32(ipBits - maskSize); !ok || !ipRange.Contains(cidr.IP) || hostBits < spec.PerNodeHostBits || hostBits > maxHostBits {
+				allErrs = append(allErrs, field.Invalid(cidrPath, podCIDR, "must be a per node CIDR of the ClusterCIDR range"))
+				continue
+			}
+			for _, other := range reserved {
+				if other.Contains(cidr.IP) || cidr.Contains(other.IP) {
+					allErrs = append(allErrs, field.Invalid(cidrPath, podCIDR, fmt.Sprintf("must not overlap reserved CIDR %s", other)))
+					break
+				}
+			}
+			reserved = append(reserved, cidr)
+		}
+	}
+	return allErrs
+}
+
 // ValidateClusterCIDRUpdate tests if an update to a ClusterCIDR is valid.
 func ValidateClusterCIDRUpdate(update, old *v1.ClusterCIDR) field.ErrorList {
 	var allErrs field.ErrorList
@@ -115,6 +374,15 @@ func validateClusterCIDRUpdateSpec(update, old *v1.ClusterCIDRSpec, fldPath *fie
 	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.PerNodeHostBits, old.PerNodeHostBits, fldPath.Child("perNodeHostBits"))...)
 	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.IPv4, old.IPv4, fldPath.Child("ipv4"))...)
 	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.IPv6, old.IPv6, fldPath.Child("ipv6"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.AllocationStrategy, old.AllocationStrategy, fldPath.Child("allocationStrategy"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.Aggregation, old.Aggregation, fldPath.Child("aggregation"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.StickyGracePeriod, old.StickyGracePeriod, fldPath.Child("stickyGracePeriod"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.NodeIndex, old.NodeIndex, fldPath.Child("nodeIndex"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.CorrelatedIndices, old.CorrelatedIndices, fldPath.Child("correlatedIndices"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.PrimaryIPFamily, old.PrimaryIPFamily, fldPath.Child("primaryIPFamily"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.SingleStackFallback, old.SingleStackFallback, fldPath.Child("singleStackFallback"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.MaxPerNodeHostBits, old.MaxPerNodeHostBits, fldPath.Child("maxPerNodeHostBits"))...)
+	allErrs = append(allErrs, apimachineryvalidation.ValidateImmutableField(update.Reservations, old.Reservations, fldPath.Child("reservations"))...)
 
 	return allErrs
 }
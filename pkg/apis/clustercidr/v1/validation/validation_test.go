@@ -18,6 +18,7 @@ package validation
 
 import (
 	"testing"
+	"time"
 
 	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
 
@@ -52,6 +53,12 @@ func makeClusterCIDR(perNodeHostBits int32, ipv4, ipv6 string, nodeSelector *cor
 	}
 }
 
+// withSpec returns the ClusterCIDR after applying mutate to its spec.
+func withSpec(cc *v1.ClusterCIDR, mutate func(spec *v1.ClusterCIDRSpec)) *v1.ClusterCIDR {
+	mutate(&cc.Spec)
+	return cc
+}
+
 func TestValidateClusterCIDR(t *testing.T) {
 	testCases := []struct {
 		name      string
@@ -172,6 +179,263 @@ func TestValidateClusterCIDR(t *testing.T) {
 			cc:        makeClusterCIDR(8, "fd00::/120", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})),
 			expectErr: true,
 		},
+		// allocation strategy.
+		{
+			name: "valid ClusterCIDR, BestFit allocationStrategy",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = v1.BestFitAllocationStrategy
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid ClusterCIDR, unknown allocationStrategy",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = "FirstFit"
+			}),
+			expectErr: true,
+		},
+		// aggregation.
+		{
+			name: "valid DualStack ClusterCIDR, aggregation",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Aggregation = &v1.Aggregation{TopologyKey: "topology.kubernetes.io/zone", SupernetHostBits: 12}
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid ClusterCIDR, aggregation with invalid topologyKey",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Aggregation = &v1.Aggregation{TopologyKey: "", SupernetHostBits: 12}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, aggregation supernetHostBits <= perNodeHostBits",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Aggregation = &v1.Aggregation{TopologyKey: "topology.kubernetes.io/zone", SupernetHostBits: 8}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid DualStack ClusterCIDR, aggregation supernet larger than IPv6 CIDR",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/118", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Aggregation = &v1.Aggregation{TopologyKey: "topology.kubernetes.io/zone", SupernetHostBits: 12}
+			}),
+			expectErr: true,
+		},
+		// node index.
+		{
+			name: "valid ClusterCIDR, NodeIndex with nameRegex",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+				spec.NodeIndex = &v1.NodeIndex{NameRegex: `node(\d+)$`}
+			}),
+			expectErr: false,
+		},
+		{
+			name: "valid ClusterCIDR, NodeIndex with label",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+				spec.NodeIndex = &v1.NodeIndex{Label: "example.com/node-index"}
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid ClusterCIDR, NodeIndex without nodeIndex",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, nodeIndex without NodeIndex allocationStrategy",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.NodeIndex = &v1.NodeIndex{Label: "example.com/node-index"}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, nodeIndex with both nameRegex and label",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+				spec.NodeIndex = &v1.NodeIndex{NameRegex: `node(\d+)$`, Label: "example.com/node-index"}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, nodeIndex nameRegex without capture group",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+				spec.NodeIndex = &v1.NodeIndex{NameRegex: `node\d+$`}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, nodeIndex with aggregation",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+				spec.NodeIndex = &v1.NodeIndex{Label: "example.com/node-index"}
+				spec.Aggregation = &v1.Aggregation{TopologyKey: "topology.kubernetes.io/zone", SupernetHostBits: 12}
+			}),
+			expectErr: true,
+		},
+		// correlated indices.
+		{
+			name: "valid DualStack ClusterCIDR, correlatedIndices",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.CorrelatedIndices = true
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid IPv4 ClusterCIDR, correlatedIndices",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.CorrelatedIndices = true
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid DualStack ClusterCIDR, correlatedIndices with aggregation",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.CorrelatedIndices = true
+				spec.Aggregation = &v1.Aggregation{TopologyKey: "topology.kubernetes.io/zone", SupernetHostBits: 12}
+			}),
+			expectErr: true,
+		},
+		// pinned reservations.
+		{
+			name: "valid DualStack ClusterCIDR, reservations",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Reservations = []v1.PinnedReservation{
+					{NodeName: "gateway-0", PodCIDRs: []string{"10.1.1.0/24", "fd00:1:1::100/120"}},
+					{NodeName: "gateway-1", PodCIDRs: []string{"fd00:1:1::200/120", "10.1.2.0/24"}},
+				}
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid ClusterCIDR, reservation missing an ip family",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Reservations = []v1.PinnedReservation{{NodeName: "gateway-0", PodCIDRs: []string{"10.1.1.0/24"}}}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, reservation out of range",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Reservations = []v1.PinnedReservation{{NodeName: "gateway-0", PodCIDRs: []string{"10.2.1.0/24"}}}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, reservation with the wrong size",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Reservations = []v1.PinnedReservation{{NodeName: "gateway-0", PodCIDRs: []string{"10.1.0.0/23"}}}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, overlapping reservations",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Reservations = []v1.PinnedReservation{
+					{NodeName: "gateway-0", PodCIDRs: []string{"10.1.1.0/24"}},
+					{NodeName: "gateway-1", PodCIDRs: []string{"10.1.1.0/24"}},
+				}
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, duplicate reservation node name",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.Reservations = []v1.PinnedReservation{
+					{NodeName: "gateway-0", PodCIDRs: []string{"10.1.1.0/24"}},
+					{NodeName: "gateway-0", PodCIDRs: []string{"10.1.2.0/24"}},
+				}
+			}),
+			expectErr: true,
+		},
+		// max per node host bits.
+		{
+			name: "valid DualStack ClusterCIDR, maxPerNodeHostBits",
+			cc: withSpec(makeClusterCIDR(6, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.MaxPerNodeHostBits = 10
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid ClusterCIDR, maxPerNodeHostBits smaller than perNodeHostBits",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.MaxPerNodeHostBits = 6
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, maxPerNodeHostBits larger than the IPv6 range",
+			cc: withSpec(makeClusterCIDR(6, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.MaxPerNodeHostBits = 17
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid ClusterCIDR, maxPerNodeHostBits with correlatedIndices",
+			cc: withSpec(makeClusterCIDR(6, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.MaxPerNodeHostBits = 8
+				spec.CorrelatedIndices = true
+			}),
+			expectErr: true,
+		},
+		// single-stack fallback.
+		{
+			name: "valid DualStack ClusterCIDR, singleStackFallback",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.SingleStackFallback = true
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid IPv4 ClusterCIDR, singleStackFallback",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.SingleStackFallback = true
+			}),
+			expectErr: true,
+		},
+		// primary ip family.
+		{
+			name: "valid DualStack ClusterCIDR, IPv6 primaryIPFamily",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.PrimaryIPFamily = corev1.IPv6Protocol
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid ClusterCIDR, unknown primaryIPFamily",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/112", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.PrimaryIPFamily = "IPv5"
+			}),
+			expectErr: true,
+		},
+		{
+			name: "invalid IPv4 ClusterCIDR, IPv6 primaryIPFamily",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.PrimaryIPFamily = corev1.IPv6Protocol
+			}),
+			expectErr: true,
+		},
+		// sticky grace period.
+		{
+			name: "valid ClusterCIDR, stickyGracePeriod",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.StickyGracePeriod = &metav1.Duration{Duration: time.Hour}
+			}),
+			expectErr: false,
+		},
+		{
+			name: "invalid ClusterCIDR, negative stickyGracePeriod",
+			cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "", nil), func(spec *v1.ClusterCIDRSpec) {
+				spec.StickyGracePeriod = &metav1.Duration{Duration: -time.Hour}
+			}),
+			expectErr: true,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -198,6 +462,12 @@ func TestValidateClusterConfigUpdate(t *testing.T) {
 		name:      "Successful update, no changes to ClusterCIDR.Spec",
 		cc:        makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})),
 		expectErr: false,
+	}, {
+		name: "Successful update, update spec.AllocationPaused",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.AllocationPaused = true
+		}),
+		expectErr: false,
 	}, {
 		name:      "Failed update, update spec.PerNodeHostBits",
 		cc:        makeClusterCIDR(12, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})),
@@ -214,6 +484,54 @@ func TestValidateClusterConfigUpdate(t *testing.T) {
 		name:      "Failed update, update spec.NodeSelector",
 		cc:        makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar2"})),
 		expectErr: true,
+	}, {
+		name: "Failed update, update spec.AllocationStrategy",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.AllocationStrategy = v1.SequentialAllocationStrategy
+		}),
+		expectErr: true,
+	}, {
+		name: "Failed update, update spec.Aggregation",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.Aggregation = &v1.Aggregation{TopologyKey: "topology.kubernetes.io/zone", SupernetHostBits: 12}
+		}),
+		expectErr: true,
+	}, {
+		name: "Failed update, update spec.CorrelatedIndices",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.CorrelatedIndices = true
+		}),
+		expectErr: true,
+	}, {
+		name: "Failed update, update spec.Reservations",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.Reservations = []v1.PinnedReservation{{NodeName: "gateway-0", PodCIDRs: []string{"10.1.1.0/24", "fd00:1:1::100/120"}}}
+		}),
+		expectErr: true,
+	}, {
+		name: "Failed update, update spec.MaxPerNodeHostBits",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.MaxPerNodeHostBits = 10
+		}),
+		expectErr: true,
+	}, {
+		name: "Failed update, update spec.SingleStackFallback",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.SingleStackFallback = true
+		}),
+		expectErr: true,
+	}, {
+		name: "Failed update, update spec.PrimaryIPFamily",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.PrimaryIPFamily = corev1.IPv6Protocol
+		}),
+		expectErr: true,
+	}, {
+		name: "Failed update, update spec.StickyGracePeriod",
+		cc: withSpec(makeClusterCIDR(8, "10.1.0.0/16", "fd00:1:1::/64", makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})), func(spec *v1.ClusterCIDRSpec) {
+			spec.StickyGracePeriod = &metav1.Duration{Duration: time.Hour}
+		}),
+		expectErr: true,
 	}}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -0,0 +1,70 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+const (
+	// LabelIPFamilies is the node label requesting the ip families of the
+	// node PodCIDRs. The AnnotationIPFamilies annotation takes precedence
+	// over the label.
+	LabelIPFamilies = "networking.x-k8s.io/ip-families"
+	// AnnotationIPFamilies is the node annotation requesting the ip families
+	// of the node PodCIDRs.
+	AnnotationIPFamilies = "networking.x-k8s.io/ip-families"
+
+	// AnnotationMaxPods is the node annotation requesting a node CIDR sized
+	// for the given number of pods. Only ClusterCIDRs with a large enough and
+	// not unnecessarily large `perNodeHostBits` are used for the node.
+	AnnotationMaxPods = "networking.x-k8s.io/max-pods"
+
+	// AnnotationAdditionalPodCIDRsCount is the node annotation requesting the
+	// number of pod CIDR blocks allocated to the node in addition to its
+	// PodCIDRs. A block has a CIDR of each ip family of the node PodCIDRs. At
+	// most 16 blocks can be requested.
+	AnnotationAdditionalPodCIDRsCount = "networking.x-k8s.io/additional-pod-cidrs-count"
+	// AnnotationAdditionalPodCIDRs is the node annotation the controller
+	// publishes the additional pod CIDRs of the node in, as a JSON list of
+	// CIDRs. The additional pod CIDRs are released when the node is deleted.
+	AnnotationAdditionalPodCIDRs = "networking.x-k8s.io/additional-pod-cidrs"
+
+	// AnnotationRequestedPodCIDRs is the node annotation requesting exact
+	// PodCIDRs, as a comma separated list with one CIDR for each ip family of
+	// the matching ClusterCIDR.
+	AnnotationRequestedPodCIDRs = "networking.x-k8s.io/requested-pod-cidrs"
+
+	// AnnotationDrain is the ClusterCIDR annotation marking the ClusterCIDR
+	// as draining. Draining ClusterCIDRs do not allocate PodCIDRs to new
+	// nodes and list the nodes still allocated from them in the status. The
+	// value is a comma separated list of the actions applied to these nodes,
+	// DrainActionCordon and DrainActionTaint, or empty.
+	AnnotationDrain = "networking.x-k8s.io/drain"
+	// DrainActionCordon marks the nodes of a draining ClusterCIDR as
+	// unschedulable.
+	DrainActionCordon = "Cordon"
+	// DrainActionTaint adds the TaintClusterCIDRDraining taint to the nodes of
+	// a draining ClusterCIDR.
+	DrainActionTaint = "Taint"
+	// TaintClusterCIDRDraining is the NoSchedule taint of the nodes of a
+	// draining ClusterCIDR. The value is the name of the ClusterCIDR.
+	TaintClusterCIDRDraining = "networking.x-k8s.io/clustercidr-draining"
+
+	// IPFamiliesIPv4 requests an IPv4 PodCIDR only.
+	IPFamiliesIPv4 = "IPv4"
+	// IPFamiliesIPv6 requests an IPv6 PodCIDR only.
+	IPFamiliesIPv6 = "IPv6"
+	// IPFamiliesDualStack requests both an IPv4 and an IPv6 PodCIDR.
+	IPFamiliesDualStack = "DualStack"
+)
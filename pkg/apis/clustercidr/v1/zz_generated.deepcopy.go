@@ -7,15 +7,33 @@ package v1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Aggregation) DeepCopyInto(out *Aggregation) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Aggregation.
+func (in *Aggregation) DeepCopy() *Aggregation {
+	if in == nil {
+		return nil
+	}
+	out := new(Aggregation)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClusterCIDR) DeepCopyInto(out *ClusterCIDR) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -78,6 +96,28 @@ func (in *ClusterCIDRSpec) DeepCopyInto(out *ClusterCIDRSpec) {
 		*out = new(corev1.NodeSelector)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Reservations != nil {
+		in, out := &in.Reservations, &out.Reservations
+		*out = make([]PinnedReservation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Aggregation != nil {
+		in, out := &in.Aggregation, &out.Aggregation
+		*out = new(Aggregation)
+		**out = **in
+	}
+	if in.StickyGracePeriod != nil {
+		in, out := &in.StickyGracePeriod, &out.StickyGracePeriod
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.NodeIndex != nil {
+		in, out := &in.NodeIndex, &out.NodeIndex
+		*out = new(NodeIndex)
+		**out = **in
+	}
 	return
 }
 
@@ -90,3 +130,135 @@ func (in *ClusterCIDRSpec) DeepCopy() *ClusterCIDRSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterCIDRStatus) DeepCopyInto(out *ClusterCIDRStatus) {
+	*out = *in
+	if in.Supernets != nil {
+		in, out := &in.Supernets, &out.Supernets
+		*out = make([]Supernet, len(*in))
+		copy(*out, *in)
+	}
+	if in.Quarantine != nil {
+		in, out := &in.Quarantine, &out.Quarantine
+		*out = make([]QuarantinedCIDR, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.StickyReservations != nil {
+		in, out := &in.StickyReservations, &out.StickyReservations
+		*out = make([]StickyReservation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DrainingNodes != nil {
+		in, out := &in.DrainingNodes, &out.DrainingNodes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterCIDRStatus.
+func (in *ClusterCIDRStatus) DeepCopy() *ClusterCIDRStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterCIDRStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeIndex) DeepCopyInto(out *NodeIndex) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeIndex.
+func (in *NodeIndex) DeepCopy() *NodeIndex {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeIndex)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PinnedReservation) DeepCopyInto(out *PinnedReservation) {
+	*out = *in
+	if in.PodCIDRs != nil {
+		in, out := &in.PodCIDRs, &out.PodCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PinnedReservation.
+func (in *PinnedReservation) DeepCopy() *PinnedReservation {
+	if in == nil {
+		return nil
+	}
+	out := new(PinnedReservation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuarantinedCIDR) DeepCopyInto(out *QuarantinedCIDR) {
+	*out = *in
+	in.ReleaseTime.DeepCopyInto(&out.ReleaseTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuarantinedCIDR.
+func (in *QuarantinedCIDR) DeepCopy() *QuarantinedCIDR {
+	if in == nil {
+		return nil
+	}
+	out := new(QuarantinedCIDR)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StickyReservation) DeepCopyInto(out *StickyReservation) {
+	*out = *in
+	if in.PodCIDRs != nil {
+		in, out := &in.PodCIDRs, &out.PodCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.ExpirationTime.DeepCopyInto(&out.ExpirationTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StickyReservation.
+func (in *StickyReservation) DeepCopy() *StickyReservation {
+	if in == nil {
+		return nil
+	}
+	out := new(StickyReservation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Supernet) DeepCopyInto(out *Supernet) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Supernet.
+func (in *Supernet) DeepCopy() *Supernet {
+	if in == nil {
+		return nil
+	}
+	out := new(Supernet)
+	in.DeepCopyInto(out)
+	return out
+}
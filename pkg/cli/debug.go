@@ -0,0 +1,67 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cli implements the command line tools querying and printing the
+// state of the ClusterCIDR allocator.
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Paths of the debug endpoints of the controller.
+const (
+	// ExplainPath is the path of the explain debug endpoint.
+	ExplainPath = "/debug/explain"
+	// StatePath is the path of the state debug endpoint.
+	StatePath = "/debug/state"
+	// WhoisPath is the path of the whois debug endpoint.
+	WhoisPath = "/debug/whois"
+)
+
+// GetDebugEndpoint returns the body of the response of the debug endpoint of
+// the controller at server.
+func GetDebugEndpoint(server, token, path string, query url.Values) ([]byte, error) {
+	const timeout = 30 * time.Second
+	endpoint := strings.TrimSuffix(server, "/") + path + "?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, endpoint, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
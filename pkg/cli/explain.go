@@ -0,0 +1,126 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
+)
+
+// RunExplain implements the explain subcommand. It queries the explain
+// endpoint of a running controller and prints the ranking of the ClusterCIDRs
+// for a node.
+func RunExplain(args []string) error {
+	var (
+		server    string
+		token     string
+		nodeName  string
+		nodeLabel string
+		output    string
+	)
+
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.StringVar(&server, "server", "http://localhost:8081", "The address of the health server of the controller.")
+	flags.StringVar(&token, "token", "", "The bearer token used to authenticate to the debug endpoints.")
+	flags.StringVar(&nodeName, "node", "", "The name of the node to explain.")
+	flags.StringVar(&nodeLabel, "labels", "", "The labels of the node to explain, e.g. zone=a,pool=gpu.")
+	flags.StringVar(&output, "output", "table", "The output format, table or json.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (nodeName == "") == (nodeLabel == "") {
+		return errors.New("exactly one of --node and --labels must be specified")
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("invalid output format %q, must be table or json", output)
+	}
+
+	query := url.Values{}
+	if nodeName != "" {
+		query.Set("node", nodeName)
+	} else {
+		query.Set("labels", nodeLabel)
+	}
+	body, err := GetDebugEndpoint(server, token, ExplainPath, query)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		_, err := os.Stdout.Write(body)
+		return err
+	}
+
+	explanation := &ipam.Explanation{}
+	if err := json.Unmarshal(body, explanation); err != nil {
+		return fmt.Errorf("unable to decode explanation: %w", err)
+	}
+	return PrintExplanation(os.Stdout, explanation)
+}
+
+// PrintExplanation prints the ranking of the ClusterCIDRs as a table.
+func PrintExplanation(out io.Writer, explanation *ipam.Explanation) error {
+	if len(explanation.CurrentClusterCIDRs) > 0 {
+		fmt.Fprintf(out, "Node %s has PodCIDRs %s from ClusterCIDR %s\n", explanation.Node, strings.Join(explanation.PodCIDRs, ","), strings.Join(explanation.CurrentClusterCIDRs, ","))
+	}
+	if explanation.Message != "" {
+		fmt.Fprintf(out, "A new node is not allocated PodCIDRs: %s\n", explanation.Message)
+	} else {
+		fmt.Fprintln(out, "A new node is allocated PodCIDRs from the first ranked ClusterCIDR able to allocate them")
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tNAME\tMATCHED\tMATCHES (P0)\tMAX CIDRS (P1)\tNODE MASK (P2)\tSELECTOR (P3)\tCIDR (P4)\tFREE\tSTATE")
+	for _, clusterCIDR := range explanation.ClusterCIDRs {
+		rank := "-"
+		if clusterCIDR.Rank > 0 {
+			rank = strconv.Itoa(clusterCIDR.Rank)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%d\t%d\t%s\t%s\t%d\t%s\n", rank, clusterCIDR.Name, clusterCIDR.Matched, clusterCIDR.MatchCount,
+			clusterCIDR.MaxAllocatable, clusterCIDR.NodeMaskSize, clusterCIDR.NodeSelector, clusterCIDR.CIDR, clusterCIDR.Free, clusterCIDRState(clusterCIDR))
+	}
+	return w.Flush()
+}
+
+// clusterCIDRState returns the states excluding the ClusterCIDR from the
+// ranking.
+func clusterCIDRState(clusterCIDR ipam.ClusterCIDRExplanation) string {
+	var states []string
+	if clusterCIDR.Terminating {
+		states = append(states, "Terminating")
+	}
+	if clusterCIDR.Draining {
+		states = append(states, "Draining")
+	}
+	if clusterCIDR.AllocationPaused {
+		states = append(states, "AllocationPaused")
+	}
+	if len(states) == 0 {
+		return "-"
+	}
+	return strings.Join(states, ",")
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	netutil "k8s.io/utils/net"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/client/clientset/versioned"
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/offline"
+)
+
+// defaultFreeBlocks is the default number of free blocks printed per ip family.
+const defaultFreeBlocks = 10
+
+// pluginCommands are the subcommands of the kubectl-clustercidr plugin.
+var pluginCommands = map[string]struct {
+	usage string
+	run   func(args []string) error
+}{
+	"usage":    {"Print the utilisation of the ClusterCIDRs.", runUsage},
+	"nodes":    {"Print the nodes allocated PodCIDRs from a ClusterCIDR.", runNodes},
+	"free":     {"Print the largest free blocks of a ClusterCIDR.", runFree},
+	"whois":    {"Print the owner of an IP address or CIDR.", runPluginWhois},
+	"explain":  {"Print the ranking of the ClusterCIDRs for a node.", runPluginExplain},
+	"validate": {"Validate ClusterCIDRs in a file without a cluster.", runValidate},
+	"simulate": {"Simulate the allocation of PodCIDRs to nodes without a cluster.", runSimulate},
+}
+
+// RunPlugin implements the kubectl-clustercidr plugin. The state of the
+// allocator is rebuilt from the ClusterCIDRs and nodes of the cluster, the
+// controller does not have to be reachable.
+func RunPlugin(args []string) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		printPluginUsage(os.Stderr)
+		return nil
+	}
+	command, ok := pluginCommands[args[0]]
+	if !ok {
+		printPluginUsage(os.Stderr)
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	return command.run(args[1:])
+}
+
+func printPluginUsage(out io.Writer) {
+	names := make([]string, 0, len(pluginCommands))
+	for name := range pluginCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "Usage: kubectl clustercidr <subcommand> [flags]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Subcommands:")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", name, pluginCommands[name].usage)
+	}
+	w.Flush()
+}
+
+// clusterFlags are the flags of the subcommands reading the state of a
+// cluster.
+type clusterFlags struct {
+	kubeconfig   string
+	context      string
+	serviceCIDRs string
+}
+
+func (f *clusterFlags) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&f.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file, defaults to the kubectl configuration.")
+	flags.StringVar(&f.context, "context", "", "The name of the kubeconfig context to use.")
+	flags.StringVar(&f.serviceCIDRs, "service-cidr", "", "The comma separated service CIDRs of the cluster, at most one per ip family.")
+}
+
+// newFlagSet returns the flag set of a subcommand taking the arguments
+// described by usage.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kubectl clustercidr %s [flags] %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// allocator returns an allocator holding the ClusterCIDRs and nodes of the
+// cluster.
+func (f *clusterFlags) allocator(ctx context.Context) (ipam.CIDRAllocator, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = f.kubeconfig
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: f.context}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kubeconfig: %w", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cidrClient, err := versioned.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := allocatorParams(f.serviceCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterCIDRs, err := cidrClient.NetworkingV1().ClusterCIDRs().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ClusterCIDRs: %w", err)
+	}
+	nodes, err := kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes: %w", err)
+	}
+	return offline.NewAllocator(ctx, clusterCIDRs.Items, nodes.Items, params)
+}
+
+// allocatorParams returns the parameters of an allocator filtering out the
+// comma separated service CIDRs.
+func allocatorParams(serviceCIDRs string) (ipam.CIDRAllocatorParams, error) {
+	params := ipam.CIDRAllocatorParams{}
+	if serviceCIDRs == "" {
+		return params, nil
+	}
+	cidrs, err := netutil.ParseCIDRs(strings.Split(serviceCIDRs, ","))
+	if err != nil {
+		return params, fmt.Errorf("invalid service CIDRs: %w", err)
+	}
+	if len(cidrs) > 2 {
+		return params, errors.New("at most two service CIDRs can be specified")
+	}
+	params.ServiceCIDR = cidrs[0]
+	if len(cidrs) > 1 {
+		params.SecondaryServiceCIDR = cidrs[1]
+	}
+	return params, nil
+}
+
+func runUsage(args []string) error {
+	var cluster clusterFlags
+	flags := newFlagSet("usage", "")
+	cluster.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage does not take arguments")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	allocator, err := cluster.allocator(ctx)
+	if err != nil {
+		return err
+	}
+	state, err := allocator.State(0, 0)
+	if err != nil {
+		return err
+	}
+	return PrintUsage(os.Stdout, state)
+}
+
+// PrintUsage prints the utilisation of the cidrSets of the ClusterCIDRs as a
+// table.
+func PrintUsage(out io.Writer, state *ipam.AllocatorState) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCIDR\tNODE MASK\tALLOCATED\tMAX CIDRS\tUSAGE\tNODES\tSTATE")
+	for _, clusterCIDR := range sortedClusterCIDRs(state) {
+		for _, cidrSet := range []*ipam.CIDRSetState{clusterCIDR.IPv4, clusterCIDR.IPv6} {
+			if cidrSet == nil {
+				continue
+			}
+			usage := 0.0
+			if cidrSet.MaxCIDRs > 0 {
+				usage = 100 * float64(cidrSet.Allocated) / float64(cidrSet.MaxCIDRs)
+			}
+			fmt.Fprintf(w, "%s\t%s\t/%d\t%d\t%d\t%.1f%%\t%d\t%s\n", clusterCIDR.Name, cidrSet.CIDR, cidrSet.NodeMaskSize, cidrSet.Allocated,
+				cidrSet.MaxCIDRs, usage, len(clusterCIDR.AssociatedNodes), clusterCIDRState(ipam.ClusterCIDRExplanation{
+					Terminating:      clusterCIDR.Terminating,
+					Draining:         clusterCIDR.Draining,
+					AllocationPaused: clusterCIDR.AllocationPaused,
+				}))
+		}
+	}
+	return w.Flush()
+}
+
+// sortedClusterCIDRs returns the ClusterCIDRs of the state ordered by name.
+func sortedClusterCIDRs(state *ipam.AllocatorState) []ipam.ClusterCIDRState {
+	var clusterCIDRs []ipam.ClusterCIDRState
+	for _, selectorState := range state.NodeSelectors {
+		clusterCIDRs = append(clusterCIDRs, selectorState.ClusterCIDRs...)
+	}
+	sort.Slice(clusterCIDRs, func(i, j int) bool { return clusterCIDRs[i].Name < clusterCIDRs[j].Name })
+	return clusterCIDRs
+}
+
+func runNodes(args []string) error {
+	var cluster clusterFlags
+	flags := newFlagSet("nodes", "<clustercidr>")
+	cluster.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("exactly one ClusterCIDR must be specified")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	allocator, err := cluster.allocator(ctx)
+	if err != nil {
+		return err
+	}
+	state, err := allocator.State(0, 0)
+	if err != nil {
+		return err
+	}
+	for _, clusterCIDR := range sortedClusterCIDRs(state) {
+		if clusterCIDR.Name == flags.Arg(0) {
+			for _, nodeName := range clusterCIDR.AssociatedNodes {
+				fmt.Fprintln(os.Stdout, nodeName)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("ClusterCIDR %s not found", flags.Arg(0))
+}
+
+func runFree(args []string) error {
+	var (
+		cluster clusterFlags
+		limit   int
+	)
+	flags := newFlagSet("free", "<clustercidr>")
+	cluster.addFlags(flags)
+	flags.IntVar(&limit, "limit", defaultFreeBlocks, "The maximum number of free blocks printed per ip family, a negative limit prints all blocks.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("exactly one ClusterCIDR must be specified")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	allocator, err := cluster.allocator(ctx)
+	if err != nil {
+		return err
+	}
+	blocks, err := allocator.FreeBlocks(flags.Arg(0), limit)
+	if err != nil {
+		return err
+	}
+	return PrintFreeBlocks(os.Stdout, blocks)
+}
+
+// PrintFreeBlocks prints the free blocks and the number of addresses they
+// hold as a table.
+func PrintFreeBlocks(out io.Writer, blocks []*net.IPNet) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOCK\tADDRESSES")
+	for _, block := range blocks {
+		ones, bits := block.Mask.Size()
+		addresses := "2^" + fmt.Sprint(bits-ones)
+		if bits-ones < 63 {
+			addresses = fmt.Sprint(uint64(1) << (bits - ones))
+		}
+		fmt.Fprintf(w, "%s\t%s\n", block, addresses)
+	}
+	return w.Flush()
+}
+
+func runPluginWhois(args []string) error {
+	var cluster clusterFlags
+	flags := newFlagSet("whois", "<ip-or-cidr>")
+	cluster.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("exactly one IP address or CIDR must be specified")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	allocator, err := cluster.allocator(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := allocator.Whois(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return PrintWhoisResult(os.Stdout, result)
+}
+
+func runPluginExplain(args []string) error {
+	var cluster clusterFlags
+	flags := newFlagSet("explain", "<node>")
+	cluster.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("exactly one node must be specified")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	allocator, err := cluster.allocator(ctx)
+	if err != nil {
+		return err
+	}
+	explanation, err := allocator.Explain(flags.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	return PrintExplanation(os.Stdout, explanation)
+}
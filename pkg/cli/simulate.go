@@ -0,0 +1,227 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/offline"
+)
+
+// nodeGroup is a number of generated nodes with the same labels.
+type nodeGroup struct {
+	count  int
+	labels labels.Set
+}
+
+// nodeGroups implements flag.Value for the groups of generated nodes.
+type nodeGroups []nodeGroup
+
+func (g *nodeGroups) String() string {
+	groups := make([]string, 0, len(*g))
+	for _, group := range *g {
+		groups = append(groups, fmt.Sprintf("%d:%s", group.count, group.labels))
+	}
+	return strings.Join(groups, " ")
+}
+
+// Set parses a group in the count:labels format, e.g. 10:zone=a,pool=gpu.
+func (g *nodeGroups) Set(value string) error {
+	countValue, labelsValue, _ := strings.Cut(value, ":")
+	count, err := strconv.Atoi(countValue)
+	if err != nil || count <= 0 {
+		return fmt.Errorf("invalid node count %q, must be a positive integer", countValue)
+	}
+	nodeLabels, err := labels.ConvertSelectorToLabelsMap(labelsValue)
+	if err != nil {
+		return fmt.Errorf("invalid node labels %q: %w", labelsValue, err)
+	}
+	*g = append(*g, nodeGroup{count: count, labels: nodeLabels})
+	return nil
+}
+
+// nodes returns the nodes of the groups in the order of the groups.
+func (g *nodeGroups) nodes() []corev1.Node {
+	var nodes []corev1.Node
+	for _, group := range *g {
+		for i := 0; i < group.count; i++ {
+			nodes = append(nodes, corev1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name:   fmt.Sprintf("simulated-node-%d", len(nodes)),
+				Labels: group.labels,
+			}})
+		}
+	}
+	return nodes
+}
+
+func runSimulate(args []string) error {
+	var (
+		clusterCIDRFile string
+		nodeFile        string
+		serviceCIDRs    string
+		output          string
+		generated       nodeGroups
+	)
+	flags := newFlagSet("simulate", "")
+	flags.StringVar(&clusterCIDRFile, "f", "", "The YAML or JSON file holding the ClusterCIDRs, - reads the standard input.")
+	flags.StringVar(&nodeFile, "nodes", "", "The YAML or JSON file holding the nodes, e.g. the output of kubectl get nodes -o yaml. Nodes with PodCIDRs are occupied before the other nodes are allocated PodCIDRs.")
+	flags.Var(&generated, "generate", "Generate nodes in the count:labels format, e.g. 10:zone=a,pool=gpu. The generated nodes are allocated PodCIDRs after the nodes of the --nodes file. Can be repeated.")
+	flags.StringVar(&serviceCIDRs, "service-cidr", "", "The comma separated service CIDRs of the cluster, at most one per ip family.")
+	flags.StringVar(&output, "output", "table", "The output format, table or json.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if clusterCIDRFile == "" {
+		return errors.New("a ClusterCIDR file must be specified with -f")
+	}
+	if nodeFile == "" && len(generated) == 0 {
+		return errors.New("nodes must be specified with --nodes or --generate")
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("invalid output format %q, must be table or json", output)
+	}
+
+	params, err := allocatorParams(serviceCIDRs)
+	if err != nil {
+		return err
+	}
+	clusterCIDRs, err := ReadClusterCIDRs(clusterCIDRFile)
+	if err != nil {
+		return err
+	}
+	var nodes []corev1.Node
+	if nodeFile != "" {
+		if nodes, err = ReadNodes(nodeFile); err != nil {
+			return err
+		}
+	}
+	nodes = append(nodes, generated.nodes()...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result, err := offline.Simulate(ctx, clusterCIDRs, nodes, params)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	return PrintSimulation(os.Stdout, result)
+}
+
+// ReadNodes decodes the nodes of a file holding YAML documents or JSON
+// objects of nodes or lists of nodes, - reads the standard input.
+func ReadNodes(filename string) ([]corev1.Node, error) {
+	in := io.Reader(os.Stdin)
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var nodes []corev1.Node
+	decoder := utilyaml.NewYAMLOrJSONDecoder(in, 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nodes, nil
+			}
+			return nil, fmt.Errorf("unable to decode %s: %w", filename, err)
+		}
+		typeMeta := metav1.TypeMeta{}
+		if err := json.Unmarshal(raw, &typeMeta); err != nil {
+			return nil, fmt.Errorf("unable to decode %s: %w", filename, err)
+		}
+		switch typeMeta.Kind {
+		case "":
+			// Skip empty documents.
+			continue
+		case "Node":
+			node := corev1.Node{}
+			if err := json.Unmarshal(raw, &node); err != nil {
+				return nil, fmt.Errorf("unable to decode %s: %w", filename, err)
+			}
+			nodes = append(nodes, node)
+		case "List", "NodeList":
+			nodeList := corev1.NodeList{}
+			if err := json.Unmarshal(raw, &nodeList); err != nil {
+				return nil, fmt.Errorf("unable to decode %s: %w", filename, err)
+			}
+			nodes = append(nodes, nodeList.Items...)
+		default:
+			return nil, fmt.Errorf("unexpected kind %q in %s, expected Node or NodeList", typeMeta.Kind, filename)
+		}
+	}
+}
+
+// PrintSimulation prints the PodCIDRs of the nodes, the exhaustion points and
+// the utilisation of the ClusterCIDRs as tables.
+func PrintSimulation(out io.Writer, result *offline.SimulationResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tCLUSTERCIDR\tPODCIDRS\tERROR")
+	for _, nodeAllocation := range result.Nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", nodeAllocation.Node, orNone(nodeAllocation.ClusterCIDR),
+			orNone(strings.Join(nodeAllocation.PodCIDRs, ",")), orNone(nodeAllocation.Error))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out)
+	if len(result.ExhaustionPoints) == 0 {
+		fmt.Fprintln(out, "All nodes are allocated PodCIDRs")
+	} else {
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "EXHAUSTED LABELS\tFIRST FAILED NODE\tALLOCATED BEFORE\tERROR")
+		for _, point := range result.ExhaustionPoints {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", orNone(point.Labels), point.Node, point.Allocated, point.Error)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(out)
+	return PrintUsage(out, result.State)
+}
+
+// orNone returns - for empty values of table cells.
+func orNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
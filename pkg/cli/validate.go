@@ -0,0 +1,97 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	v1 "github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1/validation"
+)
+
+func runValidate(args []string) error {
+	var filename string
+	flags := newFlagSet("validate", "")
+	flags.StringVar(&filename, "f", "", "The YAML or JSON file holding the ClusterCIDRs, - reads the standard input.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if filename == "" {
+		return errors.New("a file must be specified with -f")
+	}
+
+	clusterCIDRs, err := ReadClusterCIDRs(filename)
+	if err != nil {
+		return err
+	}
+	invalid := 0
+	for i := range clusterCIDRs {
+		errs := validation.ValidateClusterCIDR(&clusterCIDRs[i])
+		if len(errs) == 0 {
+			fmt.Fprintf(os.Stdout, "ClusterCIDR %s is valid\n", clusterCIDRs[i].Name)
+			continue
+		}
+		invalid++
+		fmt.Fprintf(os.Stdout, "ClusterCIDR %s is invalid:\n", clusterCIDRs[i].Name)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stdout, "  %s\n", err)
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d ClusterCIDRs are invalid", invalid, len(clusterCIDRs))
+	}
+	return nil
+}
+
+// ReadClusterCIDRs decodes the ClusterCIDRs of a file holding YAML documents
+// or JSON objects, - reads the standard input.
+func ReadClusterCIDRs(filename string) ([]v1.ClusterCIDR, error) {
+	in := io.Reader(os.Stdin)
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var clusterCIDRs []v1.ClusterCIDR
+	decoder := utilyaml.NewYAMLOrJSONDecoder(in, 4096)
+	for {
+		clusterCIDR := v1.ClusterCIDR{}
+		if err := decoder.Decode(&clusterCIDR); err != nil {
+			if errors.Is(err, io.EOF) {
+				return clusterCIDRs, nil
+			}
+			return nil, fmt.Errorf("unable to decode %s: %w", filename, err)
+		}
+		// Skip empty documents.
+		if clusterCIDR.Kind == "" && clusterCIDR.Name == "" {
+			continue
+		}
+		if clusterCIDR.Kind != "ClusterCIDR" {
+			return nil, fmt.Errorf("unexpected kind %q in %s, expected ClusterCIDR", clusterCIDR.Kind, filename)
+		}
+		clusterCIDRs = append(clusterCIDRs, clusterCIDR)
+	}
+}
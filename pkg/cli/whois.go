@@ -0,0 +1,93 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
+)
+
+// RunWhois implements the whois subcommand. It queries the whois endpoint of
+// a running controller and prints the owner of an IP address or CIDR.
+func RunWhois(args []string) error {
+	var (
+		server string
+		token  string
+		output string
+	)
+
+	flags := flag.NewFlagSet("whois", flag.ContinueOnError)
+	flags.StringVar(&server, "server", "http://localhost:8081", "The address of the health server of the controller.")
+	flags.StringVar(&token, "token", "", "The bearer token used to authenticate to the debug endpoints.")
+	flags.StringVar(&output, "output", "table", "The output format, table or json.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s whois [flags] <ip-or-cidr>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("exactly one IP address or CIDR must be specified")
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("invalid output format %q, must be table or json", output)
+	}
+
+	body, err := GetDebugEndpoint(server, token, WhoisPath, url.Values{"address": {flags.Arg(0)}})
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		_, err := os.Stdout.Write(body)
+		return err
+	}
+
+	result := &ipam.WhoisResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("unable to decode whois result: %w", err)
+	}
+	return PrintWhoisResult(os.Stdout, result)
+}
+
+// PrintWhoisResult prints the owner of the address as a list of fields.
+func PrintWhoisResult(out io.Writer, result *ipam.WhoisResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, field := range []struct{ name, value string }{
+		{"Address", result.Address},
+		{"Status", string(result.Status)},
+		{"ClusterCIDR", result.ClusterCIDR},
+		{"Range", result.Range},
+		{"Block", result.Block},
+		{"Node", result.Node},
+		{"ServiceCIDR", result.ServiceCIDR},
+		{"Message", result.Message},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", field.name, field.value)
+		}
+	}
+	return w.Flush()
+}
@@ -24,6 +24,7 @@ type ClusterCIDRsGetter interface {
 type ClusterCIDRInterface interface {
 	Create(ctx context.Context, clusterCIDR *v1.ClusterCIDR, opts metav1.CreateOptions) (*v1.ClusterCIDR, error)
 	Update(ctx context.Context, clusterCIDR *v1.ClusterCIDR, opts metav1.UpdateOptions) (*v1.ClusterCIDR, error)
+	UpdateStatus(ctx context.Context, clusterCIDR *v1.ClusterCIDR, opts metav1.UpdateOptions) (*v1.ClusterCIDR, error)
 	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
 	DeleteCollection(ctx context.Context, opts metav1.DeleteOptions, listOpts metav1.ListOptions) error
 	Get(ctx context.Context, name string, opts metav1.GetOptions) (*v1.ClusterCIDR, error)
@@ -112,6 +113,21 @@ func (c *clusterCIDRs) Update(ctx context.Context, clusterCIDR *v1.ClusterCIDR,
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *clusterCIDRs) UpdateStatus(ctx context.Context, clusterCIDR *v1.ClusterCIDR, opts metav1.UpdateOptions) (result *v1.ClusterCIDR, err error) {
+	result = &v1.ClusterCIDR{}
+	err = c.client.Put().
+		Resource("clustercidrs").
+		Name(clusterCIDR.Name).
+		SubResource("status").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(clusterCIDR).
+		Do(ctx).
+		Into(result)
+	return
+}
+
 // Delete takes name of the clusterCIDR and deletes it. Returns an error if one occurs.
 func (c *clusterCIDRs) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
 	return c.client.Delete().
@@ -79,6 +79,17 @@ func (c *FakeClusterCIDRs) Update(ctx context.Context, clusterCIDR *v1.ClusterCI
 	return obj.(*v1.ClusterCIDR), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeClusterCIDRs) UpdateStatus(ctx context.Context, clusterCIDR *v1.ClusterCIDR, opts metav1.UpdateOptions) (*v1.ClusterCIDR, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewRootUpdateSubresourceAction(clustercidrsResource, "status", clusterCIDR), &v1.ClusterCIDR{})
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1.ClusterCIDR), err
+}
+
 // Delete takes name of the clusterCIDR and deletes it. Returns an error if one occurs.
 func (c *FakeClusterCIDRs) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
 	_, err := c.Fake.
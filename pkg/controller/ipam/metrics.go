@@ -0,0 +1,65 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const nodeIpamSubsystem = "node_ipam_controller"
+
+var (
+	nodesHeldAtGate = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      nodeIpamSubsystem,
+			Name:           "multicidr_nodes_held_at_gate",
+			Help:           "Gauge measuring the number of nodes waiting for the allocation gate.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	nodesDrifted = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      nodeIpamSubsystem,
+			Name:           "multicidr_nodes_drifted",
+			Help:           "Gauge measuring the number of nodes that would be allocated PodCIDRs from a different ClusterCIDR.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	dryRunWrites = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      nodeIpamSubsystem,
+			Name:           "multicidr_dry_run_writes_total",
+			Help:           "Counter of the writes to the API server skipped in dry-run mode by operation.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+)
+
+var registerMetrics sync.Once
+
+// registerAllocatorMetrics registers the metrics of the allocator.
+func registerAllocatorMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(nodesHeldAtGate)
+		legacyregistry.MustRegister(nodesDrifted)
+		legacyregistry.MustRegister(dryRunWrites)
+	})
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+const (
+	// invalidAdditionalPodCIDRsReason is the event reason for nodes with an
+	// invalid additional pod CIDRs annotation.
+	invalidAdditionalPodCIDRsReason = "InvalidAdditionalPodCIDRs"
+	// additionalPodCIDRsNotAvailableReason is the event reason for nodes whose
+	// requested additional pod CIDRs could not be allocated.
+	additionalPodCIDRsNotAvailableReason = "AdditionalPodCIDRsNotAvailable"
+
+	// maxAdditionalPodCIDRs is the maximum number of additional pod CIDR
+	// blocks a node can request.
+	maxAdditionalPodCIDRs = 16
+)
+
+// additionalPodCIDRs returns the additional pod CIDRs published on the node.
+func additionalPodCIDRs(node *corev1.Node) ([]*net.IPNet, error) {
+	value, ok := node.Annotations[v1.AnnotationAdditionalPodCIDRs]
+	if !ok {
+		return nil, nil
+	}
+
+	var cidrsString []string
+	if err := json.Unmarshal([]byte(value), &cidrsString); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on node %s: %w", v1.AnnotationAdditionalPodCIDRs, node.Name, err)
+	}
+	cidrs := make([]*net.IPNet, 0, len(cidrsString))
+	for _, cidr := range cidrsString {
+		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q in %s annotation on node %s: %w", cidr, v1.AnnotationAdditionalPodCIDRs, node.Name, err)
+		}
+		cidrs = append(cidrs, podCIDR)
+	}
+	return cidrs, nil
+}
+
+// requestedAdditionalPodCIDRs returns the number of additional pod CIDR
+// blocks requested by the node.
+func requestedAdditionalPodCIDRs(node *corev1.Node) (int, error) {
+	value, ok := node.Annotations[v1.AnnotationAdditionalPodCIDRsCount]
+	if !ok {
+		return 0, nil
+	}
+	count, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || count < 0 || count > maxAdditionalPodCIDRs {
+		return 0, fmt.Errorf("invalid %s annotation %q on node %s, must be an integer between 0 and %d", v1.AnnotationAdditionalPodCIDRsCount, value, node.Name, maxAdditionalPodCIDRs)
+	}
+	return int(count), nil
+}
+
+// syncAdditionalPodCIDRs occupies the additional pod CIDRs published on the
+// node and allocates the missing blocks requested by the node from the
+// ClusterCIDRs of its PodCIDRs. Published CIDRs owned by other nodes or
+// overlapping allocated CIDRs are rejected with a warning event. Additional
+// pod CIDRs are kept until the node is deleted, even if the requested count is
+// lowered.
+func (r *multiCIDRRangeAllocator) syncAdditionalPodCIDRs(logger klog.Logger, node *corev1.Node) error {
+	existing, err := additionalPodCIDRs(node)
+	if err != nil {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, invalidAdditionalPodCIDRsReason, err.Error())
+		return nil
+	}
+	requested, err := requestedAdditionalPodCIDRs(node)
+	if err != nil {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, invalidAdditionalPodCIDRsReason, err.Error())
+		return nil
+	}
+	if len(existing) == 0 && requested == 0 {
+		return nil
+	}
+
+	allocated, err := r.allocatedClusterCIDRs(node)
+	if err != nil {
+		return err
+	}
+	if len(existing) > maxAdditionalPodCIDRs*len(allocated.allocatedCIDRs) {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, invalidAdditionalPodCIDRsReason,
+			fmt.Sprintf("%s annotation lists %d CIDRs, at most %d additional pod CIDR blocks are allowed", v1.AnnotationAdditionalPodCIDRs, len(existing), maxAdditionalPodCIDRs))
+		return nil
+	}
+	existing = r.occupyAdditionalPodCIDRs(logger, node, allocated, existing)
+
+	missing := requested - len(existing)/len(allocated.allocatedCIDRs)
+	if missing <= 0 {
+		return nil
+	}
+
+	var added []*net.IPNet
+	for i := 0; i < missing; i++ {
+		for _, podCIDR := range allocated.allocatedCIDRs {
+			clusterCIDR := allocated.clusterCIDRFor(podCIDR)
+			cidrSet, err := r.associatedCIDRSet(clusterCIDR, podCIDR)
+			if err != nil {
+				return err
+			}
+			hostBits := r.blockHostBits(clusterCIDR, node)
+			cidr, err := r.allocateCIDR(clusterCIDR, cidrSet, nodeGroup(clusterCIDR, node), hostBits)
+			if err != nil {
+				r.rollbackAdditionalPodCIDRs(logger, allocated, added)
+				controllerutil.RecordNodeWarning(logger, r.recorder, node, additionalPodCIDRsNotAvailableReason,
+					fmt.Sprintf("Unable to allocate %d additional pod CIDR blocks from ClusterCIDR %s: %v", missing, clusterCIDR.Name, err))
+				return nil
+			}
+			added = append(added, cidr)
+		}
+	}
+
+	cidrs := ipnetToStringList(append(existing, added...))
+	if err := r.patchAdditionalPodCIDRs(logger, node, cidrs); err != nil {
+		r.rollbackAdditionalPodCIDRs(logger, allocated, added)
+		return err
+	}
+	r.indexPodCIDRs(node.Name, cidrs)
+	logger.Info("Set node additional pod CIDRs", "node", klog.KObj(node), "additionalPodCIDRs", cidrs)
+	return nil
+}
+
+// occupyAdditionalPodCIDRs occupies the additional pod CIDRs published on the
+// node that are not occupied yet and returns the CIDRs owned by the node. A
+// CIDR that is a PodCIDR of the node, is owned by another node, overlaps
+// allocated CIDRs or is outside of the ClusterCIDRs of the node is rejected
+// with a warning event.
+func (r *multiCIDRRangeAllocator) occupyAdditionalPodCIDRs(logger klog.Logger, node *corev1.Node, allocated multiCIDRNodeReservedCIDRs, cidrs []*net.IPNet) []*net.IPNet {
+	podCIDRs := make(map[string]bool, len(allocated.allocatedCIDRs))
+	for _, podCIDR := range allocated.allocatedCIDRs {
+		podCIDRs[podCIDR.String()] = true
+	}
+
+	owned := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		var err error
+		owner, indexed := r.podCIDROwners[cidr.String()]
+		switch {
+		case podCIDRs[cidr.String()]:
+			err = fmt.Errorf("additional pod CIDR %v is a PodCIDR of the node", cidr)
+		case indexed && owner == node.Name:
+			// Occupied by a previous sync.
+			owned = append(owned, cidr)
+			continue
+		case indexed:
+			err = fmt.Errorf("additional pod CIDR %v is allocated to node %s", cidr, owner)
+		case r.cidrInAllocatedList(cidr) || r.cidrOverlapWithAllocatedList(cidr):
+			err = fmt.Errorf("additional pod CIDR %v overlaps allocated CIDRs", cidr)
+		default:
+			err = r.Occupy(allocated.clusterCIDRFor(cidr), cidr)
+		}
+		if err != nil {
+			controllerutil.RecordNodeWarning(logger, r.recorder, node, invalidAdditionalPodCIDRsReason, err.Error())
+			continue
+		}
+		owned = append(owned, cidr)
+	}
+	r.indexPodCIDRs(node.Name, ipnetToStringList(owned))
+	return owned
+}
+
+// restoreAdditionalPodCIDRs occupies and indexes the additional pod CIDRs
+// published on a node with PodCIDRs on startup.
+func (r *multiCIDRRangeAllocator) restoreAdditionalPodCIDRs(logger klog.Logger, node *corev1.Node) {
+	if len(node.Spec.PodCIDRs) == 0 {
+		return
+	}
+	cidrs, err := additionalPodCIDRs(node)
+	if err != nil {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, invalidAdditionalPodCIDRsReason, err.Error())
+		return
+	}
+	if len(cidrs) == 0 {
+		return
+	}
+	allocated, err := r.allocatedClusterCIDRs(node)
+	if err != nil {
+		logger.Error(err, "Failed to restore additional pod CIDRs", "node", klog.KObj(node))
+		return
+	}
+	owned := r.occupyAdditionalPodCIDRs(logger, node, allocated, cidrs)
+	logger.Info("Node has additional pod CIDRs, occupying them in CIDR map", "node", klog.KObj(node), "additionalPodCIDRs", ipnetToStringList(owned))
+}
+
+// ownedAdditionalPodCIDRs returns the additional pod CIDRs published on the
+// node that are owned by the node.
+func (r *multiCIDRRangeAllocator) ownedAdditionalPodCIDRs(node *corev1.Node) ([]*net.IPNet, error) {
+	cidrs, err := additionalPodCIDRs(node)
+	if err != nil {
+		return nil, err
+	}
+	podCIDRs := make(map[string]bool, len(node.Spec.PodCIDRs))
+	for _, podCIDR := range node.Spec.PodCIDRs {
+		podCIDRs[podCIDR] = true
+	}
+
+	owned := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if r.podCIDROwners[cidr.String()] == node.Name && !podCIDRs[cidr.String()] {
+			owned = append(owned, cidr)
+		}
+	}
+	return owned, nil
+}
+
+// releaseAdditionalPodCIDRs releases the additional pod CIDRs to the
+// ClusterCIDRs of the node PodCIDRs.
+func (r *multiCIDRRangeAllocator) releaseAdditionalPodCIDRs(logger klog.Logger, allocated multiCIDRNodeReservedCIDRs, cidrs []*net.IPNet) {
+	for _, cidr := range cidrs {
+		if err := r.Release(logger, allocated.clusterCIDRFor(cidr), cidr); err != nil {
+			logger.Error(err, "Failed to release additional pod CIDR", "node", klog.KRef("", allocated.nodeName), "CIDR", cidr)
+		}
+	}
+}
+
+// rollbackAdditionalPodCIDRs releases the additional pod CIDRs allocated to
+// the node that were not published on the node, without quarantine.
+func (r *multiCIDRRangeAllocator) rollbackAdditionalPodCIDRs(logger klog.Logger, allocated multiCIDRNodeReservedCIDRs, cidrs []*net.IPNet) {
+	for _, cidr := range cidrs {
+		if err := r.rollback(logger, allocated.clusterCIDRFor(cidr), cidr); err != nil {
+			logger.Error(err, "Failed to roll back additional pod CIDR", "node", klog.KRef("", allocated.nodeName), "CIDR", cidr)
+		}
+	}
+}
+
+func (r *multiCIDRRangeAllocator) patchAdditionalPodCIDRs(logger klog.Logger, node *corev1.Node, cidrs []string) error {
+	value, err := json.Marshal(cidrs)
+	if err != nil {
+		return err
+	}
+	if r.skipWrite(logger, nodeRef(node), dryRunPatchAdditionalPodCIDRs, fmt.Sprintf("would set additional pod CIDRs %v of node %s", cidrs, node.Name)) {
+		r.dryRunAdditional[node.Name] = string(value)
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{v1.AnnotationAdditionalPodCIDRs: string(value)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < cidrUpdateRetries; i++ {
+		if _, err = r.client.CoreV1().Nodes().Patch(context.TODO(), node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to patch additional pod CIDRs of node %s: %w", node.Name, err)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+// enableAggregation enables supernet aggregation in the cidrSets of the
+// ClusterCIDR and restores the supernets published in the ClusterCIDR status.
+func enableAggregation(clusterCIDRSet *cidrset.ClusterCIDR, clusterCIDR *v1.ClusterCIDR) error {
+	aggregation := clusterCIDR.Spec.Aggregation
+	clusterCIDRSet.TopologyKey = aggregation.TopologyKey
+
+	for _, cidrSet := range []*cidrset.MultiCIDRSet{clusterCIDRSet.IPv4CIDRSet, clusterCIDRSet.IPv6CIDRSet} {
+		if cidrSet == nil {
+			continue
+		}
+		if err := cidrSet.EnableAggregation(int(aggregation.SupernetHostBits)); err != nil {
+			return fmt.Errorf("unable to enable aggregation: %w", err)
+		}
+	}
+
+	for _, supernet := range clusterCIDR.Status.Supernets {
+		for _, cidr := range []string{supernet.IPv4, supernet.IPv6} {
+			if cidr == "" {
+				continue
+			}
+			_, supernetCIDR, err := netutil.ParseCIDRSloppy(cidr)
+			if err != nil {
+				return fmt.Errorf("unable to parse supernet %s of group %q: %w", cidr, supernet.Group, err)
+			}
+			cidrSet := clusterCIDRSet.IPv6CIDRSet
+			if netutil.IsIPv4CIDR(supernetCIDR) {
+				cidrSet = clusterCIDRSet.IPv4CIDRSet
+			}
+			if cidrSet == nil {
+				return fmt.Errorf("supernet %s of group %q does not match the ClusterCIDR ip families", cidr, supernet.Group)
+			}
+			if err := cidrSet.ReserveSupernet(supernet.Group, supernetCIDR); err != nil {
+				return fmt.Errorf("unable to restore supernet %s of group %q: %w", cidr, supernet.Group, err)
+			}
+		}
+	}
+	return nil
+}
+
+// nodeGroup returns the group of the node in the ClusterCIDR, empty if the
+// ClusterCIDR does not aggregate CIDRs or the node does not have the topology
+// label.
+func nodeGroup(clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node) string {
+	if clusterCIDR.TopologyKey == "" {
+		return ""
+	}
+	return node.Labels[clusterCIDR.TopologyKey]
+}
+
+// occupyGroup reserves the supernets containing the node CIDRs for the group
+// of the node. Nodes whose CIDRs are outside of the supernet of their group,
+// e.g. because the topology label was changed, are only logged.
+func (r *multiCIDRRangeAllocator) occupyGroup(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node) {
+	group := nodeGroup(clusterCIDR, node)
+	if group == "" {
+		return
+	}
+
+	for _, cidr := range node.Spec.PodCIDRs {
+		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+		if err != nil {
+			continue
+		}
+		cidrSet, err := r.associatedCIDRSet(clusterCIDR, podCIDR)
+		if err != nil || cidrSet == nil {
+			continue
+		}
+		if err := cidrSet.OccupyGroup(group, podCIDR); err != nil {
+			logger.Info("Node CIDR is not aggregated into the supernet of its group", "node", klog.KObj(node), "group", group, "CIDR", cidr, "err", err)
+		}
+	}
+	r.cidrQueue.Add(clusterCIDR.Name)
+}
+
+// supernets returns the supernets reserved in the cidrSets of the ClusterCIDR
+// sorted by group.
+func supernets(clusterCIDRSet *cidrset.ClusterCIDR) []v1.Supernet {
+	if clusterCIDRSet.TopologyKey == "" {
+		return nil
+	}
+
+	byGroup := make(map[string]*v1.Supernet)
+	if clusterCIDRSet.IPv4CIDRSet != nil {
+		for group, supernet := range clusterCIDRSet.IPv4CIDRSet.Supernets() {
+			byGroup[group] = &v1.Supernet{Group: group, IPv4: supernet.String()}
+		}
+	}
+	if clusterCIDRSet.IPv6CIDRSet != nil {
+		for group, supernet := range clusterCIDRSet.IPv6CIDRSet.Supernets() {
+			if _, ok := byGroup[group]; !ok {
+				byGroup[group] = &v1.Supernet{Group: group}
+			}
+			byGroup[group].IPv6 = supernet.String()
+		}
+	}
+
+	var result []v1.Supernet
+	for _, supernet := range byGroup {
+		result = append(result, *supernet)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Group < result[j].Group
+	})
+	return result
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"net"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+// combineIPFamilies allocates the IPv4 CIDR from the best ranked ClusterCIDR
+// with free IPv4 CIDRs and the IPv6 CIDR from the best ranked ClusterCIDR with
+// free IPv6 CIDRs. It returns false, with no CIDRs allocated, if either ip
+// family is exhausted.
+func (r *multiCIDRRangeAllocator) combineIPFamilies(logger klog.Logger, clusterCIDRList []*cidrset.ClusterCIDR, node *corev1.Node) (multiCIDRNodeReservedCIDRs, bool) {
+	reserved := multiCIDRNodeReservedCIDRs{nodeReservedCIDRs: nodeReservedCIDRs{nodeName: node.Name}}
+	for _, families := range []ipFamilies{{ipv4: true}, {ipv6: true}} {
+		for _, clusterCIDR := range clusterCIDRList {
+			if clusterCIDR.NodeIndex != nil || len(families.cidrSets(clusterCIDR)) == 0 {
+				continue
+			}
+			cidrs, err := r.allocateIPFamilies(logger, clusterCIDR, node, families)
+			if err != nil {
+				logger.V(3).Info("Unable to allocate CIDR, trying next range", "clusterCIDR", clusterCIDR.Name, "ipFamilies", families, "err", err)
+				continue
+			}
+			reserved.add(clusterCIDR, cidrs)
+			break
+		}
+	}
+
+	if len(reserved.allocatedCIDRs) < 2 {
+		for _, cidr := range reserved.allocatedCIDRs {
+			if err := r.rollback(logger, reserved.clusterCIDRFor(cidr), cidr); err != nil {
+				logger.Error(err, "Failed to release CIDR", "CIDR", cidr)
+			}
+		}
+		return reserved, false
+	}
+
+	logger.Info("Combined CIDRs of different ClusterCIDRs", "node", klog.KObj(node), "CIDRs", reserved.allocatedCIDRs,
+		"ipv4ClusterCIDR", reserved.clusterCIDR.Name, "ipv6ClusterCIDR", reserved.clusterCIDRFor(reserved.allocatedCIDRs[1]).Name)
+	return reserved, true
+}
+
+// occupyCombinedCIDRs occupies each CIDR of the node in the first ClusterCIDR
+// of its ip family that contains it, associating the node with every
+// ClusterCIDR. It returns false if any CIDR could not be occupied.
+func (r *multiCIDRRangeAllocator) occupyCombinedCIDRs(logger klog.Logger, clusterCIDRList []*cidrset.ClusterCIDR, node *corev1.Node) bool {
+	occupied := multiCIDRNodeReservedCIDRs{nodeReservedCIDRs: nodeReservedCIDRs{nodeName: node.Name}}
+	for _, cidr := range node.Spec.PodCIDRs {
+		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+		if err != nil {
+			return false
+		}
+
+		var clusterCIDR *cidrset.ClusterCIDR
+		for _, candidate := range clusterCIDRList {
+			cidrSet, err := r.associatedCIDRSet(candidate, podCIDR)
+			if err != nil || cidrSet == nil || !cidrSet.ClusterCIDR.Contains(podCIDR.IP) {
+				continue
+			}
+			if err := r.Occupy(candidate, podCIDR); err == nil {
+				clusterCIDR = candidate
+				break
+			}
+		}
+		if clusterCIDR == nil {
+			logger.V(3).Info("Could not occupy cidr in any range", "CIDR", cidr, "node", klog.KObj(node))
+			// Release the CIDRs of the other ip family.
+			for _, occupiedCIDR := range occupied.allocatedCIDRs {
+				if err := r.rollback(logger, occupied.clusterCIDRFor(occupiedCIDR), occupiedCIDR); err != nil {
+					logger.Error(err, "Failed to release CIDR", "CIDR", occupiedCIDR)
+				}
+			}
+			return false
+		}
+		occupied.add(clusterCIDR, []*net.IPNet{podCIDR})
+	}
+
+	for _, clusterCIDR := range occupied.clusterCIDRs() {
+		clusterCIDR.AssociatedNodes[node.Name] = true
+	}
+	r.indexPodCIDRs(node.Name, node.Spec.PodCIDRs)
+	return true
+}
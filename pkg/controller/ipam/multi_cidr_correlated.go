@@ -0,0 +1,120 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+// cidrIndexMismatchReason is the event reason for nodes whose IPv4 and IPv6
+// CIDRs are not at the same index of a ClusterCIDR with correlated indices.
+const cidrIndexMismatchReason = "CIDRIndexMismatch"
+
+// allocateCorrelatedCIDRs allocates an IPv4 and an IPv6 CIDR at the same
+// index of the dual-stack ClusterCIDR. The index is picked by the IPv4
+// cidrSet, candidates whose IPv6 counterpart is not free are skipped.
+func (r *multiCIDRRangeAllocator) allocateCorrelatedCIDRs(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR) ([]*net.IPNet, error) {
+	ipv4Set, ipv6Set := clusterCIDR.IPv4CIDRSet, clusterCIDR.IPv6CIDRSet
+	for evaluated := 0; evaluated < ipv4Set.MaxCIDRs; evaluated++ {
+		ipv4Candidate, lastEvaluated, err := ipv4Set.NextCandidate()
+		if err != nil {
+			return nil, err
+		}
+
+		evaluated += lastEvaluated
+
+		if r.cidrInAllocatedList(ipv4Candidate) || r.cidrOverlapWithAllocatedList(ipv4Candidate) {
+			continue
+		}
+
+		index, err := ipv4Set.Index(ipv4Candidate)
+		if err != nil {
+			return nil, err
+		}
+		if !ipv6Set.IsFree(index) {
+			continue
+		}
+		ipv6Candidate, err := ipv6Set.CIDRBlock(index)
+		if err != nil {
+			return nil, err
+		}
+		if r.cidrInAllocatedList(ipv6Candidate) || r.cidrOverlapWithAllocatedList(ipv6Candidate) {
+			continue
+		}
+
+		// Mark the CIDRs as occupied in the map.
+		if err := r.Occupy(clusterCIDR, ipv4Candidate); err != nil {
+			return nil, err
+		}
+		if err := r.Occupy(clusterCIDR, ipv6Candidate); err != nil {
+			if releaseErr := r.rollback(logger, clusterCIDR, ipv4Candidate); releaseErr != nil {
+				logger.Error(releaseErr, "Failed to release correlated CIDR", "CIDR", ipv4Candidate)
+			}
+			return nil, err
+		}
+		// Increment the evaluated count metric.
+		ipv4Set.UpdateEvaluatedCount(evaluated)
+		return []*net.IPNet{ipv4Candidate, ipv6Candidate}, nil
+	}
+	return nil, &cidrset.CIDRRangeNoCIDRsRemainingErr{
+		CIDR: ipv4Set.Label,
+	}
+}
+
+// checkCorrelatedIndices records a warning event for a node whose IPv4 and
+// IPv6 CIDRs are not at the same index of a ClusterCIDR with correlated
+// indices, e.g. because they were allocated before the indices were
+// correlated.
+func (r *multiCIDRRangeAllocator) checkCorrelatedIndices(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node) {
+	if !clusterCIDR.CorrelatedIndices || clusterCIDR.IPv4CIDRSet == nil || clusterCIDR.IPv6CIDRSet == nil {
+		return
+	}
+
+	index := -1
+	for _, cidr := range node.Spec.PodCIDRs {
+		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+		if err != nil {
+			return
+		}
+		cidrSet, err := r.associatedCIDRSet(clusterCIDR, podCIDR)
+		if err != nil {
+			return
+		}
+		cidrIndex, err := cidrSet.Index(podCIDR)
+		if err != nil {
+			return
+		}
+
+		if index == -1 {
+			index = cidrIndex
+			continue
+		}
+		if cidrIndex != index {
+			logger.Info("Node CIDRs are not at the same index", "node", klog.KObj(node), "podCIDRs", node.Spec.PodCIDRs, "clusterCIDR", clusterCIDR.Name)
+			controllerutil.RecordNodeWarning(logger, r.recorder, node, cidrIndexMismatchReason,
+				fmt.Sprintf("PodCIDRs %v are not at the same index of ClusterCIDR %s with correlated indices", node.Spec.PodCIDRs, clusterCIDR.Name))
+			return
+		}
+	}
+}
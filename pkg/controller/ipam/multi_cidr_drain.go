@@ -0,0 +1,173 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+// invalidDrainAnnotationReason is the event reason for ClusterCIDRs with an
+// invalid drain annotation.
+const invalidDrainAnnotationReason = "InvalidDrainAnnotation"
+
+// drainPolicy holds the actions applied to the nodes of a draining
+// ClusterCIDR.
+type drainPolicy struct {
+	cordon bool
+	taint  bool
+}
+
+// isDraining returns true if the ClusterCIDR has the drain annotation.
+func isDraining(clusterCIDR *v1.ClusterCIDR) bool {
+	_, ok := clusterCIDR.Annotations[v1.AnnotationDrain]
+	return ok
+}
+
+// clusterCIDRDrainPolicy returns the drain policy of the ClusterCIDR, nil if
+// the ClusterCIDR is not draining.
+func clusterCIDRDrainPolicy(clusterCIDR *v1.ClusterCIDR) (*drainPolicy, error) {
+	value, ok := clusterCIDR.Annotations[v1.AnnotationDrain]
+	if !ok {
+		return nil, nil
+	}
+
+	policy := &drainPolicy{}
+	for _, action := range strings.Split(value, ",") {
+		switch strings.TrimSpace(action) {
+		case "":
+		case v1.DrainActionCordon:
+			policy.cordon = true
+		case v1.DrainActionTaint:
+			policy.taint = true
+		default:
+			return policy, fmt.Errorf("invalid action %q in %s annotation, supported actions: %q, %q", action, v1.AnnotationDrain, v1.DrainActionCordon, v1.DrainActionTaint)
+		}
+	}
+	return policy, nil
+}
+
+// withoutDraining returns the ClusterCIDRs of the list which are not draining.
+func withoutDraining(clusterCIDRList []*cidrset.ClusterCIDR) []*cidrset.ClusterCIDR {
+	result := make([]*cidrset.ClusterCIDR, 0, len(clusterCIDRList))
+	for _, clusterCIDR := range clusterCIDRList {
+		if !clusterCIDR.Draining {
+			result = append(result, clusterCIDR)
+		}
+	}
+	return result
+}
+
+// drainingNodes returns the sorted names of the nodes allocated from the
+// draining ClusterCIDR, nil if the ClusterCIDR is not draining.
+func drainingNodes(clusterCIDRSet *cidrset.ClusterCIDR) []string {
+	if !clusterCIDRSet.Draining {
+		return nil
+	}
+	var result []string
+	for nodeName := range clusterCIDRSet.AssociatedNodes {
+		result = append(result, nodeName)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// reconcileDrain updates the draining state of the tracked ClusterCIDR and
+// applies the drain policy to its nodes. The drain taint is removed from the
+// nodes once the ClusterCIDR is no longer draining, cordoned nodes stay
+// unschedulable. The ClusterCIDR stays draining until the taint is removed
+// from all its nodes.
+func (r *multiCIDRRangeAllocator) reconcileDrain(ctx context.Context, clusterCIDR *v1.ClusterCIDR, clusterCIDRSet *cidrset.ClusterCIDR) error {
+	logger := klog.FromContext(ctx)
+	policy, err := clusterCIDRDrainPolicy(clusterCIDR)
+	if err != nil {
+		r.recorder.Event(clusterCIDR, corev1.EventTypeWarning, invalidDrainAnnotationReason, err.Error())
+	}
+	draining := policy != nil
+	if !draining && !clusterCIDRSet.Draining {
+		return nil
+	}
+	if clusterCIDRSet.Draining != draining {
+		logger.Info("Updating ClusterCIDR draining state", "clusterCIDR", clusterCIDR.Name, "draining", draining)
+	}
+	if draining {
+		clusterCIDRSet.Draining = true
+	}
+
+	var errs []error
+	for nodeName := range clusterCIDRSet.AssociatedNodes {
+		node, err := r.nodeLister.Get(nodeName)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := r.applyDrainPolicy(logger, clusterCIDR.Name, node, policy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	clusterCIDRSet.Draining = draining
+	return nil
+}
+
+// applyDrainPolicy cordons and taints the node of the draining ClusterCIDR as
+// requested by the policy, or removes the drain taint if policy is nil.
+func (r *multiCIDRRangeAllocator) applyDrainPolicy(logger klog.Logger, clusterCIDRName string, node *corev1.Node, policy *drainPolicy) error {
+	unschedulable := node.Spec.Unschedulable || (policy != nil && policy.cordon)
+
+	var taints []corev1.Taint
+	tainted := false
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1.TaintClusterCIDRDraining {
+			tainted = true
+			continue
+		}
+		taints = append(taints, taint)
+	}
+	taint := policy != nil && policy.taint
+	if taint {
+		taints = append(taints, corev1.Taint{
+			Key:    v1.TaintClusterCIDRDraining,
+			Value:  clusterCIDRName,
+			Effect: corev1.TaintEffectNoSchedule,
+		})
+	}
+
+	if unschedulable == node.Spec.Unschedulable && taint == tainted {
+		return nil
+	}
+	logger.Info("Applying drain policy to node", "node", klog.KObj(node), "clusterCIDR", clusterCIDRName, "unschedulable", unschedulable, "tainted", taint)
+	if r.skipWrite(logger, nodeRef(node), dryRunPatchNodeScheduling, fmt.Sprintf("would set unschedulable %t and drain taint %t of node %s", unschedulable, taint, node.Name)) {
+		return nil
+	}
+	return controllerutil.PatchNodeScheduling(r.client, node, unschedulable, taints)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"strings"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+// clusterCIDRDriftCondition is the node condition reporting whether the
+// labels of the node changed so that its PodCIDRs would be allocated from a
+// different ClusterCIDR.
+const clusterCIDRDriftCondition corev1.NodeConditionType = "ClusterCIDRDrift"
+
+const (
+	// clusterCIDRDriftReason is the event reason for nodes whose PodCIDRs
+	// would be allocated from a different ClusterCIDR.
+	clusterCIDRDriftReason = "ClusterCIDRDrift"
+	// ownerNoLongerMatchesReason is the condition reason of nodes that no
+	// longer match the ClusterCIDR of their PodCIDRs.
+	ownerNoLongerMatchesReason = "OwnerNoLongerMatches"
+	// higherPriorityMatchReason is the condition reason of nodes that match a
+	// ClusterCIDR with more matching labels than the ClusterCIDR of their
+	// PodCIDRs.
+	higherPriorityMatchReason = "HigherPriorityMatch"
+	// noDriftReason is the condition reason of nodes matching the ClusterCIDR
+	// of their PodCIDRs best.
+	noDriftReason = "NoDrift"
+)
+
+// ownerClusterCIDRs returns the ClusterCIDRs the node is associated with. If
+// the node is not associated with any ClusterCIDR, e.g. because it does not
+// match the ClusterCIDR of its PodCIDRs after a restart, the ClusterCIDRs
+// containing its PodCIDRs are returned.
+func (r *multiCIDRRangeAllocator) ownerClusterCIDRs(node *corev1.Node) []*cidrset.ClusterCIDR {
+	var associated, containing []*cidrset.ClusterCIDR
+	for _, clusterCIDRList := range r.cidrMap {
+		for _, clusterCIDR := range clusterCIDRList {
+			if clusterCIDR.AssociatedNodes[node.Name] {
+				associated = append(associated, clusterCIDR)
+				continue
+			}
+			for _, cidr := range node.Spec.PodCIDRs {
+				_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+				if err != nil {
+					continue
+				}
+				cidrSet, _ := r.associatedCIDRSet(clusterCIDR, podCIDR)
+				if cidrSet != nil && cidrSet.ClusterCIDR.Contains(podCIDR.IP) {
+					containing = append(containing, clusterCIDR)
+					break
+				}
+			}
+		}
+	}
+	if len(associated) > 0 {
+		return associated
+	}
+	return containing
+}
+
+// matchCounts returns the number of node selector requirements of each
+// ClusterCIDR matching the node. ClusterCIDRs without a node selector match
+// every node with a count of 0. ClusterCIDRs not matching the node are
+// omitted.
+func (r *multiCIDRRangeAllocator) matchCounts(node *corev1.Node) (map[*cidrset.ClusterCIDR]int, error) {
+	defaultSelector, err := nodeSelectorAsSelector(defaultNodeSelector())
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[*cidrset.ClusterCIDR]int)
+	for label, clusterCIDRList := range r.cidrMap {
+		labelsMatch, matchCnt, err := r.matchCIDRLabels(node, label)
+		if err != nil {
+			return nil, err
+		}
+		if label == defaultSelector.String() {
+			labelsMatch, matchCnt = true, 0
+		}
+		if !labelsMatch {
+			continue
+		}
+		for _, clusterCIDR := range clusterCIDRList {
+			counts[clusterCIDR] = matchCnt
+		}
+	}
+	return counts, nil
+}
+
+// checkDrift compares the ClusterCIDRs of the PodCIDRs of the node with the
+// best matching ClusterCIDR. A node drifted if it no longer matches the
+// ClusterCIDR of its PodCIDRs or if the best match has more matching labels.
+// PodCIDRs are immutable, the drift is reported so that the node can be
+// drained and re-created.
+func (r *multiCIDRRangeAllocator) checkDrift(logger klog.Logger, node *corev1.Node) {
+	owners := r.ownerClusterCIDRs(node)
+	if len(owners) == 0 {
+		return
+	}
+	counts, err := r.matchCounts(node)
+	if err != nil {
+		logger.Error(err, "Unable to check ClusterCIDR drift", "node", klog.KObj(node))
+		return
+	}
+	clusterCIDRList, err := r.orderedMatchingClusterCIDRs(node, true)
+	if err != nil {
+		logger.Error(err, "Unable to check ClusterCIDR drift", "node", klog.KObj(node))
+		return
+	}
+
+	ownerCount := -1
+	names := make([]string, 0, len(owners))
+	for _, owner := range owners {
+		names = append(names, owner.Name)
+		if count, ok := counts[owner]; ok && count > ownerCount {
+			ownerCount = count
+		}
+	}
+	ownerNames := strings.Join(names, ", ")
+
+	switch {
+	case ownerCount == -1:
+		r.recordDrift(logger, node, ownerNoLongerMatchesReason,
+			fmt.Sprintf("Node no longer matches ClusterCIDR %s of its PodCIDRs", ownerNames))
+	case len(clusterCIDRList) > 0 && counts[clusterCIDRList[0]] > ownerCount:
+		r.recordDrift(logger, node, higherPriorityMatchReason,
+			fmt.Sprintf("Node matches ClusterCIDR %s with a higher priority than ClusterCIDR %s of its PodCIDRs", clusterCIDRList[0].Name, ownerNames))
+	default:
+		r.clearDrift(logger, node)
+	}
+}
+
+// recordDrift reports the drift of the node. The event is recorded when the
+// drift is detected first.
+func (r *multiCIDRRangeAllocator) recordDrift(logger klog.Logger, node *corev1.Node, reason, message string) {
+	if !r.driftedNodes[node.Name] {
+		r.driftedNodes[node.Name] = true
+		nodesDrifted.Set(float64(len(r.driftedNodes)))
+		logger.Info("Node drifted from the ClusterCIDR of its PodCIDRs", "node", klog.KObj(node), "reason", reason)
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, clusterCIDRDriftReason, message)
+	}
+	r.setNodeCondition(logger, node, clusterCIDRDriftCondition, corev1.ConditionTrue, reason, message)
+}
+
+// clearDrift resolves the drift of the node.
+func (r *multiCIDRRangeAllocator) clearDrift(logger klog.Logger, node *corev1.Node) {
+	r.forgetDrift(node.Name)
+	if hasNodeCondition(node, clusterCIDRDriftCondition) {
+		r.setNodeCondition(logger, node, clusterCIDRDriftCondition, corev1.ConditionFalse, noDriftReason, "Node matches the ClusterCIDR of its PodCIDRs best")
+	}
+}
+
+// forgetDrift removes the node from the drifted nodes.
+func (r *multiCIDRRangeAllocator) forgetDrift(nodeName string) {
+	if !r.driftedNodes[nodeName] {
+		return
+	}
+	delete(r.driftedNodes, nodeName)
+	nodesDrifted.Set(float64(len(r.driftedNodes)))
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+
+	v1 "github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// dryRunReason is the event reason of the writes skipped in dry-run mode.
+const dryRunReason = "DryRun"
+
+// Operations of the writes skipped in dry-run mode.
+const (
+	dryRunPatchNodeCIDRs          = "PatchNodeCIDRs"
+	dryRunPatchAdditionalPodCIDRs = "PatchAdditionalPodCIDRs"
+	dryRunPatchNodeScheduling     = "PatchNodeScheduling"
+	dryRunSetNodeCondition        = "SetNodeCondition"
+	dryRunAddFinalizer            = "AddFinalizer"
+	dryRunRemoveFinalizer         = "RemoveFinalizer"
+	dryRunUpdateStatus            = "UpdateStatus"
+)
+
+// skipWrite returns true in dry-run mode. The write is then logged, recorded
+// as an event of the object and counted instead of being sent to the API
+// server.
+func (r *multiCIDRRangeAllocator) skipWrite(logger klog.Logger, ref *corev1.ObjectReference, operation, message string) bool {
+	if !r.dryRun {
+		return false
+	}
+	logger.Info("Dry run, skipping write", "operation", operation, "kind", ref.Kind, "name", ref.Name, "message", message)
+	r.recorder.Event(ref, corev1.EventTypeNormal, dryRunReason, fmt.Sprintf("Dry run: %s", message))
+	dryRunWrites.WithLabelValues(operation).Inc()
+	return true
+}
+
+// nodeRef returns the reference of the node used in events.
+func nodeRef(node *corev1.Node) *corev1.ObjectReference {
+	return &corev1.ObjectReference{APIVersion: "v1", Kind: "Node", Name: node.Name, UID: node.UID}
+}
+
+// clusterCIDRRef returns the reference of the ClusterCIDR used in events.
+func clusterCIDRRef(clusterCIDR *v1.ClusterCIDR) *corev1.ObjectReference {
+	return &corev1.ObjectReference{APIVersion: v1.SchemeGroupVersion.String(), Kind: "ClusterCIDR", Name: clusterCIDR.Name, UID: clusterCIDR.UID}
+}
+
+// withDryRunPodCIDRs returns the node with the PodCIDRs and additional pod
+// CIDRs that would have been patched in dry-run mode, so the node is not
+// allocated PodCIDRs again on the next sync.
+func (r *multiCIDRRangeAllocator) withDryRunPodCIDRs(node *corev1.Node) *corev1.Node {
+	if !r.dryRun {
+		return node
+	}
+	podCIDRs, hasPodCIDRs := r.dryRunPodCIDRs[node.Name]
+	additional, hasAdditional := r.dryRunAdditional[node.Name]
+	if (!hasPodCIDRs || len(node.Spec.PodCIDRs) > 0) && !hasAdditional {
+		return node
+	}
+
+	node = node.DeepCopy()
+	if hasPodCIDRs && len(node.Spec.PodCIDRs) == 0 {
+		node.Spec.PodCIDRs = podCIDRs
+	}
+	if hasAdditional {
+		if node.Annotations == nil {
+			node.Annotations = make(map[string]string)
+		}
+		node.Annotations[v1.AnnotationAdditionalPodCIDRs] = additional
+	}
+	return node
+}
+
+// forgetDryRunPodCIDRs drops the PodCIDRs of the deleted node that would have
+// been patched in dry-run mode.
+func (r *multiCIDRRangeAllocator) forgetDryRunPodCIDRs(nodeName string) {
+	delete(r.dryRunPodCIDRs, nodeName)
+	delete(r.dryRunAdditional, nodeName)
+}
+
+// releaseDeletedClusterCIDR releases the ClusterCIDR deleted from the API
+// server. In dry-run mode the ClusterCIDRs have no finalizer and are gone
+// from the informer cache by the time they are synced.
+func (r *multiCIDRRangeAllocator) releaseDeletedClusterCIDR(logger klog.Logger, name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	spec, ok := r.clusterCIDRSpecs[name]
+	if !ok {
+		return nil
+	}
+	logger.V(2).Info("Releasing deleted ClusterCIDR", "clusterCIDR", name)
+	return r.deleteClusterCIDR(logger, &v1.ClusterCIDR{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: *spec})
+}
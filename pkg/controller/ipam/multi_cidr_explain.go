@@ -0,0 +1,208 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Explanation describes the ranking of the ClusterCIDRs a new node is
+// allocated PodCIDRs from. Allocation tries the ranked ClusterCIDRs in order.
+type Explanation struct {
+	// Node is the name of the explained node, empty if the node is given by
+	// its labels.
+	Node string `json:"node,omitempty"`
+	// Labels are the labels of the explained node.
+	Labels map[string]string `json:"labels,omitempty"`
+	// PodCIDRs are the PodCIDRs of the explained node.
+	PodCIDRs []string `json:"podCIDRs,omitempty"`
+	// CurrentClusterCIDRs are the ClusterCIDRs of the PodCIDRs of the node.
+	CurrentClusterCIDRs []string `json:"currentClusterCIDRs,omitempty"`
+	// Message explains why no ClusterCIDR is ranked.
+	Message string `json:"message,omitempty"`
+	// ClusterCIDRs lists all ClusterCIDRs, ranked ClusterCIDRs first.
+	ClusterCIDRs []ClusterCIDRExplanation `json:"clusterCIDRs"`
+}
+
+// ClusterCIDRExplanation holds the values the ClusterCIDRs are ranked by, see
+// orderedMatchingClusterCIDRs.
+type ClusterCIDRExplanation struct {
+	// Name is the name of the ClusterCIDR.
+	Name string `json:"name"`
+	// Matched is true if the node selector of the ClusterCIDR matches the
+	// node. The default ClusterCIDR matches every node.
+	Matched bool `json:"matched"`
+	// MatchCount is the number of matching node selector requirements (P0).
+	MatchCount int `json:"matchCount"`
+	// MaxAllocatable is the number of per node CIDRs of the ClusterCIDR (P1).
+	MaxAllocatable int `json:"maxAllocatable"`
+	// NodeMaskSize is the mask size of the per node CIDRs (P2).
+	NodeMaskSize int `json:"nodeMaskSize"`
+	// NodeSelector is the node selector of the ClusterCIDR (P3).
+	NodeSelector string `json:"nodeSelector"`
+	// CIDR is the IPv4 range of the ClusterCIDR if present, the IPv6 range
+	// otherwise (P4).
+	CIDR string `json:"cidr"`
+	// Free is the number of free per node CIDRs of the ip family with the
+	// fewest free CIDRs.
+	Free int `json:"free"`
+	// Terminating, Draining and AllocationPaused exclude the ClusterCIDR from
+	// the ranking.
+	Terminating      bool `json:"terminating,omitempty"`
+	Draining         bool `json:"draining,omitempty"`
+	AllocationPaused bool `json:"allocationPaused,omitempty"`
+	// Rank is the position of the ClusterCIDR in the ranking starting at 1, 0
+	// if the ClusterCIDR is not ranked.
+	Rank int `json:"rank"`
+}
+
+// Explain explains the ranking of the ClusterCIDRs for the node with the
+// given name or, if nodeName is empty, for a node with the given labels. The
+// ranking is the one of a new node, i.e. the PodCIDRs of the node are ignored.
+func (r *multiCIDRRangeAllocator) Explain(nodeName string, nodeLabels map[string]string) (*Explanation, error) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: nodeLabels}}
+	if nodeName != "" {
+		var err error
+		if node, err = r.nodeLister.Get(nodeName); err != nil {
+			return nil, err
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	explanation := &Explanation{
+		Node:         nodeName,
+		Labels:       node.Labels,
+		PodCIDRs:     node.Spec.PodCIDRs,
+		ClusterCIDRs: []ClusterCIDRExplanation{},
+	}
+	if len(node.Spec.PodCIDRs) > 0 {
+		for _, clusterCIDR := range r.ownerClusterCIDRs(node) {
+			explanation.CurrentClusterCIDRs = append(explanation.CurrentClusterCIDRs, clusterCIDR.Name)
+		}
+	}
+
+	newNode := node.DeepCopy()
+	newNode.Spec.PodCIDRs = nil
+	ranked, err := r.orderedMatchingClusterCIDRs(newNode, true)
+	if err != nil {
+		explanation.Message = err.Error()
+	}
+	ranks := make(map[*cidrset.ClusterCIDR]int, len(ranked))
+	for i, clusterCIDR := range ranked {
+		ranks[clusterCIDR] = i + 1
+	}
+
+	defaultSelector, err := nodeSelectorAsSelector(defaultNodeSelector())
+	if err != nil {
+		return nil, err
+	}
+	for label, clusterCIDRList := range r.cidrMap {
+		matched, matchCount, err := r.matchCIDRLabels(newNode, label)
+		if err != nil {
+			return nil, err
+		}
+		if label == defaultSelector.String() {
+			matched, matchCount = true, 0
+		}
+		for _, clusterCIDR := range clusterCIDRList {
+			item := &PriorityQueueItem{clusterCIDR: clusterCIDR}
+			explanation.ClusterCIDRs = append(explanation.ClusterCIDRs, ClusterCIDRExplanation{
+				Name:             clusterCIDR.Name,
+				Matched:          matched,
+				MatchCount:       matchCount,
+				MaxAllocatable:   item.maxAllocatable(),
+				NodeMaskSize:     item.nodeMaskSize(),
+				NodeSelector:     label,
+				CIDR:             item.cidrLabel(),
+				Free:             freeCIDRs(clusterCIDR),
+				Terminating:      clusterCIDR.Terminating,
+				Draining:         clusterCIDR.Draining,
+				AllocationPaused: clusterCIDR.AllocationPaused,
+				Rank:             ranks[clusterCIDR],
+			})
+		}
+	}
+
+	sort.Slice(explanation.ClusterCIDRs, func(i, j int) bool {
+		a, b := explanation.ClusterCIDRs[i], explanation.ClusterCIDRs[j]
+		if (a.Rank == 0) != (b.Rank == 0) {
+			return a.Rank != 0
+		}
+		if a.Rank != b.Rank {
+			return a.Rank < b.Rank
+		}
+		return a.Name < b.Name
+	})
+	return explanation, nil
+}
+
+// freeCIDRs returns the number of free per node CIDRs of the ip family of the
+// ClusterCIDR with the fewest free CIDRs.
+func freeCIDRs(clusterCIDR *cidrset.ClusterCIDR) int {
+	free := math.MaxInt
+	for _, cidrSet := range []*cidrset.MultiCIDRSet{clusterCIDR.IPv4CIDRSet, clusterCIDR.IPv6CIDRSet} {
+		if cidrSet != nil && cidrSet.Free() < free {
+			free = cidrSet.Free()
+		}
+	}
+	return free
+}
+
+// NewExplainHandler returns the handler of the explain debug endpoint. The
+// node is given by the `node` query parameter or by its labels in the
+// `labels` query parameter, e.g. `labels=zone=a,pool=gpu`.
+func NewExplainHandler(allocator CIDRAllocator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		nodeName := query.Get("node")
+		if (nodeName == "") == !query.Has("labels") {
+			http.Error(w, "exactly one of the node and labels query parameters must be specified", http.StatusBadRequest)
+			return
+		}
+		nodeLabels, err := labels.ConvertSelectorToLabelsMap(query.Get("labels"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid labels: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		explanation, err := allocator.Explain(nodeName, nodeLabels)
+		if apierrors.IsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(explanation); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"time"
+
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// allocationGatedReason is the event reason for nodes held at the allocation
+// gate.
+const allocationGatedReason = "AllocationGated"
+
+// AllocationGate holds the allocation of CIDRs to new nodes until the node has
+// the label, the annotation or the taint, e.g. because the labels matching the
+// ClusterCIDR are set by another controller after the node is created. The
+// gate is disabled if none of them is set.
+type AllocationGate struct {
+	// Label is the key of the node label opening the gate.
+	Label string
+	// Annotation is the key of the node annotation opening the gate.
+	Annotation string
+	// TaintKey is the key of the node taint opening the gate.
+	TaintKey string
+	// Timeout is the time after the node creation the gate opens regardless
+	// of the node, 0 if nodes wait indefinitely.
+	Timeout time.Duration
+}
+
+// enabled returns true if the gate holds nodes.
+func (g AllocationGate) enabled() bool {
+	return g.Label != "" || g.Annotation != "" || g.TaintKey != ""
+}
+
+// open returns true if the node has the label, the annotation or the taint
+// of the gate.
+func (g AllocationGate) open(node *corev1.Node) bool {
+	if _, ok := node.Labels[g.Label]; ok && g.Label != "" {
+		return true
+	}
+	if _, ok := node.Annotations[g.Annotation]; ok && g.Annotation != "" {
+		return true
+	}
+	if g.TaintKey != "" {
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == g.TaintKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holdAtGate returns true if the allocation of CIDRs to the node waits for
+// the allocation gate. Held nodes are requeued once the gate times out.
+func (r *multiCIDRRangeAllocator) holdAtGate(logger klog.Logger, node *corev1.Node) bool {
+	if !r.allocationGate.enabled() || r.allocationGate.open(node) {
+		r.releaseFromGate(node.Name)
+		return false
+	}
+
+	var wait time.Duration
+	if r.allocationGate.Timeout > 0 {
+		wait = node.CreationTimestamp.Add(r.allocationGate.Timeout).Sub(r.clock.Now())
+		if wait <= 0 {
+			logger.Info("Allocation gate timed out", "node", klog.KObj(node), "timeout", r.allocationGate.Timeout)
+			r.releaseFromGate(node.Name)
+			return false
+		}
+		r.nodeQueue.AddAfter(node.Name, wait)
+	}
+
+	if !r.gatedNodes[node.Name] {
+		r.gatedNodes[node.Name] = true
+		nodesHeldAtGate.Set(float64(len(r.gatedNodes)))
+		controllerutil.RecordNodeEvent(logger, r.recorder, node, allocationGatedReason,
+			fmt.Sprintf("Waiting for the allocation gate, label %q, annotation %q or taint %q", r.allocationGate.Label, r.allocationGate.Annotation, r.allocationGate.TaintKey))
+	}
+	logger.V(2).Info("Node is held at the allocation gate", "node", klog.KObj(node), "timeout", wait)
+	return true
+}
+
+// releaseFromGate removes the node from the nodes held at the allocation
+// gate.
+func (r *multiCIDRRangeAllocator) releaseFromGate(nodeName string) {
+	if !r.gatedNodes[nodeName] {
+		return
+	}
+	delete(r.gatedNodes, nodeName)
+	nodesHeldAtGate.Set(float64(len(r.gatedNodes)))
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+const (
+	// ipFamilyOrderMismatchReason is the event reason for dual-stack nodes
+	// whose PodCIDRs do not start with the primary ip family of their
+	// ClusterCIDR.
+	ipFamilyOrderMismatchReason = "PodCIDRFamilyOrderMismatch"
+	// invalidIPFamiliesReason is the event reason for nodes requesting
+	// unknown ip families.
+	invalidIPFamiliesReason = "InvalidIPFamilies"
+	// singleStackRequestedReason is the event reason for nodes that opted
+	// out of an ip family of a dual-stack ClusterCIDR.
+	singleStackRequestedReason = "SingleStackRequested"
+	// singleStackFallbackReason is the event reason for dual-stack nodes
+	// allocated a single ip family because the other one is exhausted.
+	singleStackFallbackReason = "SingleStackFallback"
+)
+
+// ipFamilies is the set of ip families allocated to a node.
+type ipFamilies struct {
+	ipv4 bool
+	ipv6 bool
+}
+
+func (f ipFamilies) dualStack() bool {
+	return f.ipv4 && f.ipv6
+}
+
+func (f ipFamilies) String() string {
+	switch {
+	case f.dualStack():
+		return v1.IPFamiliesDualStack
+	case f.ipv6:
+		return v1.IPFamiliesIPv6
+	default:
+		return v1.IPFamiliesIPv4
+	}
+}
+
+// cidrSets returns the cidrSets of the ip families of the ClusterCIDR, IPv4
+// first.
+func (f ipFamilies) cidrSets(clusterCIDR *cidrset.ClusterCIDR) []*cidrset.MultiCIDRSet {
+	var cidrSets []*cidrset.MultiCIDRSet
+	if f.ipv4 && clusterCIDR.IPv4CIDRSet != nil {
+		cidrSets = append(cidrSets, clusterCIDR.IPv4CIDRSet)
+	}
+	if f.ipv6 && clusterCIDR.IPv6CIDRSet != nil {
+		cidrSets = append(cidrSets, clusterCIDR.IPv6CIDRSet)
+	}
+	return cidrSets
+}
+
+// cidrsIPFamilies returns the ip families of the CIDRs.
+func cidrsIPFamilies(cidrs []*net.IPNet) ipFamilies {
+	var families ipFamilies
+	for _, cidr := range cidrs {
+		if netutil.IsIPv6CIDR(cidr) {
+			families.ipv6 = true
+		} else {
+			families.ipv4 = true
+		}
+	}
+	return families
+}
+
+// nodeIPFamilies returns the ip families requested by the node with the
+// AnnotationIPFamilies annotation or the LabelIPFamilies label, nil if the
+// node does not request any.
+func nodeIPFamilies(node *corev1.Node) (*ipFamilies, error) {
+	value, ok := node.Annotations[v1.AnnotationIPFamilies]
+	if !ok {
+		value, ok = node.Labels[v1.LabelIPFamilies]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	switch value {
+	case v1.IPFamiliesIPv4:
+		return &ipFamilies{ipv4: true}, nil
+	case v1.IPFamiliesIPv6:
+		return &ipFamilies{ipv6: true}, nil
+	case v1.IPFamiliesDualStack:
+		return &ipFamilies{ipv4: true, ipv6: true}, nil
+	default:
+		return nil, fmt.Errorf("invalid ip families %q requested by node %s, must be one of %s, %s or %s",
+			value, node.Name, v1.IPFamiliesIPv4, v1.IPFamiliesIPv6, v1.IPFamiliesDualStack)
+	}
+}
+
+// clusterCIDRIPFamilies returns the ip families to allocate from the
+// ClusterCIDR, false if it does not provide all the requested ip families.
+// Nodes not requesting ip families get all the ip families of the ClusterCIDR.
+func clusterCIDRIPFamilies(clusterCIDR *cidrset.ClusterCIDR, requested *ipFamilies) (ipFamilies, bool) {
+	available := ipFamilies{ipv4: clusterCIDR.IPv4CIDRSet != nil, ipv6: clusterCIDR.IPv6CIDRSet != nil}
+	if requested == nil {
+		return available, true
+	}
+	if (requested.ipv4 && !available.ipv4) || (requested.ipv6 && !available.ipv6) {
+		return ipFamilies{}, false
+	}
+	return *requested, true
+}
+
+// allocateIPFamilies allocates a CIDR of each ip family from the ClusterCIDR.
+// Either all or none of the CIDRs are allocated.
+func (r *multiCIDRRangeAllocator) allocateIPFamilies(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node, families ipFamilies) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0)
+	group := nodeGroup(clusterCIDR, node)
+	hostBits := r.blockHostBits(clusterCIDR, node)
+	for _, cidrSet := range families.cidrSets(clusterCIDR) {
+		cidr, err := r.allocateCIDR(clusterCIDR, cidrSet, group, hostBits)
+		if err != nil {
+			// Release the CIDR of the other ip family.
+			for _, allocated := range cidrs {
+				if err := r.rollback(logger, clusterCIDR, allocated); err != nil {
+					logger.Error(err, "Failed to release CIDR", "CIDR", allocated)
+				}
+			}
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	if group != "" {
+		// Publish the supernet in case it was reserved by this allocation.
+		r.cidrQueue.Add(clusterCIDR.Name)
+	}
+	return cidrs, nil
+}
+
+// allocateSingleStackFallback allocates a single ip family to a dual-stack
+// node from the first ClusterCIDR that allows the single-stack fallback and
+// has free CIDRs of one ip family. A warning event is recorded with the reason
+// the other ip family could not be allocated.
+func (r *multiCIDRRangeAllocator) allocateSingleStackFallback(logger klog.Logger, clusterCIDRList []*cidrset.ClusterCIDR, node *corev1.Node, requested *ipFamilies) ([]*net.IPNet, *cidrset.ClusterCIDR) {
+	for _, clusterCIDR := range clusterCIDRList {
+		if !clusterCIDR.SingleStackFallback || clusterCIDR.NodeIndex != nil {
+			continue
+		}
+		families, ok := clusterCIDRIPFamilies(clusterCIDR, requested)
+		if !ok || !families.dualStack() {
+			continue
+		}
+
+		ipv4CIDRs, ipv4Err := r.allocateIPFamilies(logger, clusterCIDR, node, ipFamilies{ipv4: true})
+		if ipv4Err == nil {
+			r.recordSingleStackFallback(logger, clusterCIDR, node, ipFamilies{ipv4: true}, ipFamilies{ipv6: true})
+			return ipv4CIDRs, clusterCIDR
+		}
+		ipv6CIDRs, ipv6Err := r.allocateIPFamilies(logger, clusterCIDR, node, ipFamilies{ipv6: true})
+		if ipv6Err == nil {
+			r.recordSingleStackFallback(logger, clusterCIDR, node, ipFamilies{ipv6: true}, ipFamilies{ipv4: true})
+			return ipv6CIDRs, clusterCIDR
+		}
+		logger.V(3).Info("Unable to allocate a single ip family, trying next range", "clusterCIDR", clusterCIDR.Name, "ipv4Err", ipv4Err, "ipv6Err", ipv6Err)
+	}
+	return nil, nil
+}
+
+func (r *multiCIDRRangeAllocator) recordSingleStackFallback(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node, allocated, exhausted ipFamilies) {
+	controllerutil.RecordNodeWarning(logger, r.recorder, node, singleStackFallbackReason,
+		fmt.Sprintf("No free %s CIDRs in the matching ClusterCIDRs, allocated %s only from ClusterCIDR %s", exhausted, allocated, clusterCIDR.Name))
+}
+
+// recordSingleStackRequest records an event for a node that requested a single
+// ip family of a dual-stack ClusterCIDR.
+func (r *multiCIDRRangeAllocator) recordSingleStackRequest(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node, families ipFamilies) {
+	if families.dualStack() || clusterCIDR.IPv4CIDRSet == nil || clusterCIDR.IPv6CIDRSet == nil {
+		return
+	}
+	controllerutil.RecordNodeEvent(logger, r.recorder, node, singleStackRequestedReason,
+		fmt.Sprintf("Node requested %s PodCIDRs only from dual-stack ClusterCIDR %s", families, clusterCIDR.Name))
+}
+
+// ipv6Primary returns true if IPv6 is the primary ip family of the
+// ClusterCIDR, falling back to the controller default.
+func (r *multiCIDRRangeAllocator) ipv6Primary(clusterCIDR *v1.ClusterCIDR) bool {
+	if clusterCIDR.Spec.PrimaryIPFamily != "" {
+		return clusterCIDR.Spec.PrimaryIPFamily == corev1.IPv6Protocol
+	}
+	return r.primaryIPFamily == corev1.IPv6Protocol
+}
+
+// orderByIPFamily orders the CIDRs so that the CIDRs of the primary ip
+// family come first.
+func orderByIPFamily(cidrs []*net.IPNet, ipv6Primary bool) []*net.IPNet {
+	ordered := append([]*net.IPNet(nil), cidrs...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return netutil.IsIPv6CIDR(ordered[i]) == ipv6Primary && netutil.IsIPv6CIDR(ordered[j]) != ipv6Primary
+	})
+	return ordered
+}
+
+// checkIPFamilyOrder records a warning event for a dual-stack node whose
+// PodCIDRs do not start with the primary ip family of the ClusterCIDR. The
+// PodCIDRs of a node can not be changed, so the node keeps its order.
+func (r *multiCIDRRangeAllocator) checkIPFamilyOrder(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node) {
+	if clusterCIDR.IPv4CIDRSet == nil || clusterCIDR.IPv6CIDRSet == nil || len(node.Spec.PodCIDRs) < 2 {
+		return
+	}
+
+	dualStack, err := netutil.IsDualStackCIDRStrings(node.Spec.PodCIDRs)
+	if err != nil || !dualStack {
+		return
+	}
+	if netutil.IsIPv6CIDRString(node.Spec.PodCIDRs[0]) == clusterCIDR.IPv6Primary {
+		return
+	}
+
+	primary := corev1.IPv4Protocol
+	if clusterCIDR.IPv6Primary {
+		primary = corev1.IPv6Protocol
+	}
+	logger.Info("Node PodCIDRs do not start with the primary ip family", "node", klog.KObj(node), "podCIDRs", node.Spec.PodCIDRs, "primaryIPFamily", primary)
+	controllerutil.RecordNodeWarning(logger, r.recorder, node, ipFamilyOrderMismatchReason,
+		fmt.Sprintf("PodCIDRs %v do not start with the primary ip family %s of ClusterCIDR %s", node.Spec.PodCIDRs, primary, clusterCIDR.Name))
+}
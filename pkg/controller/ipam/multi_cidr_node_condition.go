@@ -0,0 +1,131 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"strings"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// podCIDRAllocatedCondition is the node condition reporting whether the node
+// is allocated PodCIDRs.
+const podCIDRAllocatedCondition corev1.NodeConditionType = "PodCIDRAllocated"
+
+const (
+	// podCIDRAllocatedReason is the condition reason of nodes allocated
+	// PodCIDRs.
+	podCIDRAllocatedReason = "PodCIDRAllocated"
+	// cidrNotAvailableReason is the event reason of nodes whose PodCIDRs
+	// could not be allocated.
+	cidrNotAvailableReason = "CIDRNotAvailable"
+	// noMatchingClusterCIDRReason is the condition reason of nodes not
+	// matching any ClusterCIDR.
+	noMatchingClusterCIDRReason = "NoMatchingClusterCIDR"
+	// clusterCIDRExhaustedReason is the condition reason of nodes whose
+	// matching ClusterCIDRs have no free PodCIDRs.
+	clusterCIDRExhaustedReason = "ClusterCIDRExhausted"
+	// cidrAssignmentFailedReason is the condition reason of nodes whose
+	// PodCIDRs could not be patched.
+	cidrAssignmentFailedReason = "CIDRAssignmentFailed"
+)
+
+// setNodeCondition updates the condition of the node. The node is not
+// patched if the condition is unchanged, since every patch triggers another
+// sync of the node.
+func (r *multiCIDRRangeAllocator) setNodeCondition(logger klog.Logger, node *corev1.Node, conditionType corev1.NodeConditionType, status corev1.ConditionStatus, reason, message string) {
+	condition := corev1.NodeCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.NewTime(r.clock.Now()),
+	}
+	for _, existing := range node.Status.Conditions {
+		if existing.Type != conditionType {
+			continue
+		}
+		if existing.Status == status && existing.Reason == reason && existing.Message == message {
+			return
+		}
+		if existing.Status == status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+
+	if r.skipWrite(logger, nodeRef(node), dryRunSetNodeCondition, fmt.Sprintf("would set condition %s to %s with reason %s on node %s", conditionType, status, reason, node.Name)) {
+		return
+	}
+	if err := controllerutil.SetNodeCondition(r.client, types.NodeName(node.Name), condition); err != nil {
+		logger.Error(err, "Failed to update node condition", "node", klog.KObj(node), "condition", conditionType)
+	}
+}
+
+// hasNodeCondition returns true if the node has a condition of the type.
+func hasNodeCondition(node *corev1.Node, conditionType corev1.NodeConditionType) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPodCIDRAllocated reports the PodCIDRs of the node and the
+// ClusterCIDRs they are allocated from.
+func (r *multiCIDRRangeAllocator) recordPodCIDRAllocated(logger klog.Logger, node *corev1.Node, podCIDRs []string, clusterCIDRs []*cidrset.ClusterCIDR) {
+	names := make([]string, 0, len(clusterCIDRs))
+	for _, clusterCIDR := range clusterCIDRs {
+		names = append(names, clusterCIDR.Name)
+	}
+	r.setNodeCondition(logger, node, podCIDRAllocatedCondition, corev1.ConditionTrue, podCIDRAllocatedReason,
+		fmt.Sprintf("PodCIDRs %v allocated from ClusterCIDR %s", podCIDRs, strings.Join(names, ", ")))
+}
+
+// recordCIDRNotAvailable reports that no PodCIDRs could be allocated to the
+// node, either because no ClusterCIDR matches the node or because the
+// matching ClusterCIDRs are exhausted. Nodes with the startup taint keep the
+// taint until the condition is resolved.
+func (r *multiCIDRRangeAllocator) recordCIDRNotAvailable(logger klog.Logger, node *corev1.Node) {
+	controllerutil.RecordNodeStatusChange(logger, r.recorder, node, cidrNotAvailableReason)
+
+	clusterCIDRList, err := r.orderedMatchingClusterCIDRs(node, true)
+	if err != nil || len(clusterCIDRList) == 0 {
+		r.setNodeCondition(logger, node, podCIDRAllocatedCondition, corev1.ConditionFalse, noMatchingClusterCIDRReason, "No ClusterCIDR matches the node")
+		return
+	}
+	names := make([]string, 0, len(clusterCIDRList))
+	for _, clusterCIDR := range clusterCIDRList {
+		names = append(names, clusterCIDR.Name)
+	}
+	r.setNodeCondition(logger, node, podCIDRAllocatedCondition, corev1.ConditionFalse, clusterCIDRExhaustedReason,
+		fmt.Sprintf("No PodCIDRs available in the matching ClusterCIDRs %s", strings.Join(names, ", ")))
+}
+
+// recordCIDRAssignmentFailed reports that the PodCIDRs could not be set on
+// the node.
+func (r *multiCIDRRangeAllocator) recordCIDRAssignmentFailed(logger klog.Logger, node *corev1.Node, err error) {
+	controllerutil.RecordNodeStatusChange(logger, r.recorder, node, cidrAssignmentFailedReason)
+	r.setNodeCondition(logger, node, podCIDRAllocatedCondition, corev1.ConditionFalse, cidrAssignmentFailedReason,
+		fmt.Sprintf("Unable to set PodCIDRs: %v", err))
+}
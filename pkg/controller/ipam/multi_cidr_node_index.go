@@ -0,0 +1,111 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// nodeIndexInvalidReason is the event reason for nodes without a valid index.
+	nodeIndexInvalidReason = "NodeIndexInvalid"
+	// nodeIndexOutOfRangeReason is the event reason for nodes whose index is
+	// outside of the ClusterCIDR.
+	nodeIndexOutOfRangeReason = "NodeIndexOutOfRange"
+	// nodeIndexCIDRTakenReason is the event reason for nodes whose CIDR is
+	// already allocated, quarantined or in the supernet of another group.
+	nodeIndexCIDRTakenReason = "NodeIndexCIDRTaken"
+)
+
+// allocateIndexedCIDRs allocates the CIDRs at the index of the node in the
+// cidrSets of the requested ip families. A warning event is recorded for the
+// node if the index is invalid, out of range or the CIDR is not free.
+func (r *multiCIDRRangeAllocator) allocateIndexedCIDRs(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node, families ipFamilies) ([]*net.IPNet, error) {
+	index, err := clusterCIDR.NodeIndex.Index(node.Name, node.Labels)
+	if err != nil {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, nodeIndexInvalidReason,
+			fmt.Sprintf("Unable to get the CIDR index of the node for ClusterCIDR %s: %v", clusterCIDR.Name, err))
+		return nil, err
+	}
+
+	cidrs := make([]*net.IPNet, 0)
+	for _, cidrSet := range families.cidrSets(clusterCIDR) {
+		cidr, err := r.allocateIndexedCIDR(logger, clusterCIDR, cidrSet, node, index)
+		if err != nil {
+			// Release the CIDR of the other ip family.
+			for _, allocated := range cidrs {
+				if err := r.rollback(logger, clusterCIDR, allocated); err != nil {
+					logger.Error(err, "Failed to release indexed CIDR", "CIDR", allocated)
+				}
+			}
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+func (r *multiCIDRRangeAllocator) allocateIndexedCIDR(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, cidrSet *cidrset.MultiCIDRSet, node *corev1.Node, index int) (*net.IPNet, error) {
+	cidr, err := cidrSet.CIDRBlock(index)
+	if err != nil {
+		reason := nodeIndexInvalidReason
+		var outOfRangeErr *cidrset.CIDRIndexOutOfRangeErr
+		if errors.As(err, &outOfRangeErr) {
+			reason = nodeIndexOutOfRangeReason
+		}
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, reason,
+			fmt.Sprintf("Unable to allocate a CIDR from ClusterCIDR %s: %v", clusterCIDR.Name, err))
+		return nil, err
+	}
+
+	group := nodeGroup(clusterCIDR, node)
+	if r.cidrInAllocatedList(cidr) || r.cidrOverlapWithAllocatedList(cidr) {
+		err = fmt.Errorf("CIDR %v at index %d of ClusterCIDR %s is already allocated", cidr, index, clusterCIDR.Name)
+	} else if !cidrSet.IsFree(index) {
+		err = fmt.Errorf("CIDR %v at index %d of ClusterCIDR %s is quarantined", cidr, index, clusterCIDR.Name)
+	} else if owner, reserved := cidrSet.SupernetGroup(cidr); reserved && owner != group {
+		err = fmt.Errorf("CIDR %v at index %d of ClusterCIDR %s is in the supernet of group %q", cidr, index, clusterCIDR.Name, owner)
+	}
+	if err != nil {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, nodeIndexCIDRTakenReason, err.Error())
+		return nil, err
+	}
+
+	if err := r.Occupy(clusterCIDR, cidr); err != nil {
+		return nil, err
+	}
+	if group != "" {
+		if err := cidrSet.OccupyGroup(group, cidr); err != nil {
+			if releaseErr := r.rollback(logger, clusterCIDR, cidr); releaseErr != nil {
+				logger.Error(releaseErr, "Failed to release indexed CIDR", "CIDR", cidr)
+			}
+			controllerutil.RecordNodeWarning(logger, r.recorder, node, nodeIndexCIDRTakenReason,
+				fmt.Sprintf("CIDR %v at index %d of ClusterCIDR %s is outside of the supernet of group %q: %v", cidr, index, clusterCIDR.Name, group, err))
+			return nil, err
+		}
+		// Publish the supernet in case it was reserved by this allocation.
+		r.cidrQueue.Add(clusterCIDR.Name)
+	}
+	return cidr, nil
+}
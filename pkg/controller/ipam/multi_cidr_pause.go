@@ -0,0 +1,89 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/klog/v2"
+)
+
+// withoutPaused returns the ClusterCIDRs of the list which allocate CIDRs to
+// new nodes.
+func withoutPaused(clusterCIDRList []*cidrset.ClusterCIDR) []*cidrset.ClusterCIDR {
+	result := make([]*cidrset.ClusterCIDR, 0, len(clusterCIDRList))
+	for _, clusterCIDR := range clusterCIDRList {
+		if !clusterCIDR.AllocationPaused {
+			result = append(result, clusterCIDR)
+		}
+	}
+	return result
+}
+
+// reconcileAllocationPaused observes the new generation of a tracked
+// ClusterCIDR if only its mutable fields were changed and updates the paused
+// state of the tracked ClusterCIDR. Changes of immutable fields are ignored,
+// the tracked ClusterCIDR keeps allocating from the spec it was created from.
+func (r *multiCIDRRangeAllocator) reconcileAllocationPaused(logger klog.Logger, clusterCIDR *v1.ClusterCIDR, clusterCIDRSet *cidrset.ClusterCIDR) {
+	if clusterCIDRSet.Terminating || clusterCIDR.Generation == clusterCIDRSet.ObservedGeneration {
+		return
+	}
+
+	spec, ok := r.clusterCIDRSpecs[clusterCIDR.Name]
+	if ok && !equalImmutableFields(spec, &clusterCIDR.Spec) {
+		logger.Error(nil, "Ignoring modified immutable fields of ClusterCIDR", "clusterCIDR", clusterCIDR.Name, "generation", clusterCIDR.Generation)
+		return
+	}
+
+	if clusterCIDRSet.AllocationPaused != clusterCIDR.Spec.AllocationPaused {
+		logger.Info("Updating ClusterCIDR allocation paused state", "clusterCIDR", clusterCIDR.Name, "allocationPaused", clusterCIDR.Spec.AllocationPaused)
+		if !clusterCIDR.Spec.AllocationPaused {
+			// Allocate the pinned CIDRs to the nodes held while paused.
+			r.requeuePinnedNodes(clusterCIDRSet)
+		}
+	}
+	clusterCIDRSet.AllocationPaused = clusterCIDR.Spec.AllocationPaused
+	clusterCIDRSet.ObservedGeneration = clusterCIDR.Generation
+	r.clusterCIDRSpecs[clusterCIDR.Name] = clusterCIDR.Spec.DeepCopy()
+}
+
+// equalImmutableFields returns true if the specs differ only in mutable
+// fields.
+func equalImmutableFields(a, b *v1.ClusterCIDRSpec) bool {
+	return apiequality.Semantic.DeepEqual(immutableFields(a), immutableFields(b))
+}
+
+// immutableSpecHash returns the hash of the immutable fields of the spec.
+func immutableSpecHash(spec *v1.ClusterCIDRSpec) string {
+	// Encoding a spec does not fail.
+	data, _ := json.Marshal(immutableFields(spec))
+	hasher := fnv.New64a()
+	hasher.Write(data)
+	return strconv.FormatUint(hasher.Sum64(), 16)
+}
+
+// immutableFields returns a copy of the spec with the mutable fields unset.
+func immutableFields(spec *v1.ClusterCIDRSpec) *v1.ClusterCIDRSpec {
+	spec = spec.DeepCopy()
+	spec.AllocationPaused = false
+	return spec
+}
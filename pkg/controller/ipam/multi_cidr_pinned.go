@@ -0,0 +1,289 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+const (
+	// invalidPinnedCIDRReason is the event reason for nodes with an invalid
+	// requested PodCIDRs annotation.
+	invalidPinnedCIDRReason = "PinnedCIDRInvalid"
+	// pinnedCIDROutOfRangeReason is the event reason for nodes requesting
+	// PodCIDRs which are not per node CIDRs of a matching ClusterCIDR.
+	pinnedCIDROutOfRangeReason = "PinnedCIDROutOfRange"
+	// pinnedCIDRTakenReason is the event reason for nodes whose pinned or
+	// requested PodCIDRs are allocated to another node.
+	pinnedCIDRTakenReason = "PinnedCIDRTaken"
+	// pinnedCIDRConflictReason is the event reason for nodes holding a CIDR
+	// pinned to another node.
+	pinnedCIDRConflictReason = "PinnedCIDRConflict"
+	// pinnedClusterCIDRUnavailableReason is the event reason for nodes whose
+	// CIDRs are pinned by a draining or paused ClusterCIDR.
+	pinnedClusterCIDRUnavailableReason = "PinnedClusterCIDRUnavailable"
+
+	// pinnedNodeRequeuePeriod is the period held pinned nodes are requeued
+	// with.
+	pinnedNodeRequeuePeriod = time.Minute
+)
+
+// occupyPinnedReservations occupies the CIDRs pinned by the ClusterCIDR. A
+// reservation is taken if one of its CIDRs is already allocated from another
+// ClusterCIDR.
+func (r *multiCIDRRangeAllocator) occupyPinnedReservations(clusterCIDRSet *cidrset.ClusterCIDR, clusterCIDR *v1.ClusterCIDR) error {
+	for _, reservation := range clusterCIDR.Spec.Reservations {
+		pinned := &cidrset.PinnedReservation{}
+		for _, cidr := range reservation.PodCIDRs {
+			_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+			if err != nil {
+				return fmt.Errorf("unable to parse CIDR %s pinned to node %s: %w", cidr, reservation.NodeName, err)
+			}
+			if r.cidrInAllocatedList(podCIDR) || r.cidrOverlapWithAllocatedList(podCIDR) {
+				pinned.Taken = true
+			}
+			if err := r.Occupy(clusterCIDRSet, podCIDR); err != nil {
+				return fmt.Errorf("unable to occupy CIDR %s pinned to node %s: %w", cidr, reservation.NodeName, err)
+			}
+			pinned.CIDRs = append(pinned.CIDRs, podCIDR)
+		}
+		clusterCIDRSet.PinnedReservations[reservation.NodeName] = pinned
+	}
+	return nil
+}
+
+// requestedPodCIDRs returns the PodCIDRs requested by the node annotation, at
+// most one for each ip family.
+func requestedPodCIDRs(node *corev1.Node) ([]*net.IPNet, error) {
+	value, ok := node.Annotations[v1.AnnotationRequestedPodCIDRs]
+	if !ok {
+		return nil, nil
+	}
+
+	var cidrs []*net.IPNet
+	var families ipFamilies
+	for _, cidr := range strings.Split(value, ",") {
+		ip, podCIDR, err := netutil.ParseCIDRSloppy(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q in %s annotation on node %s: %w", cidr, v1.AnnotationRequestedPodCIDRs, node.Name, err)
+		}
+		if !ip.Equal(podCIDR.IP) {
+			return nil, fmt.Errorf("invalid CIDR %q in %s annotation on node %s: host bits must be zero", cidr, v1.AnnotationRequestedPodCIDRs, node.Name)
+		}
+		ipv6 := netutil.IsIPv6CIDR(podCIDR)
+		if (ipv6 && families.ipv6) || (!ipv6 && families.ipv4) {
+			return nil, fmt.Errorf("invalid %s annotation on node %s: at most one CIDR per ip family is allowed", v1.AnnotationRequestedPodCIDRs, node.Name)
+		}
+		families = ipFamilies{ipv4: families.ipv4 || !ipv6, ipv6: families.ipv6 || ipv6}
+		cidrs = append(cidrs, podCIDR)
+	}
+	return cidrs, nil
+}
+
+// pinnableClusterCIDR returns the first ClusterCIDR of the list for which the
+// CIDR is a per node CIDR, nil if there is none.
+func pinnableClusterCIDR(clusterCIDRList []*cidrset.ClusterCIDR, cidr *net.IPNet) *cidrset.ClusterCIDR {
+	ones, size := cidr.Mask.Size()
+	hostBits := size - ones
+	for _, clusterCIDR := range clusterCIDRList {
+		cidrSet := clusterCIDR.IPv4CIDRSet
+		if netutil.IsIPv6CIDR(cidr) {
+			cidrSet = clusterCIDR.IPv6CIDRSet
+		}
+		if cidrSet == nil || !cidrSet.ClusterCIDR.Contains(cidr.IP) {
+			continue
+		}
+		if fitted, ok := fitHostBits(clusterCIDR, hostBits); ok && fitted == hostBits {
+			return clusterCIDR
+		}
+	}
+	return nil
+}
+
+// pinnedReservation returns the reservation of the ClusterCIDR with a CIDR
+// overlapping the CIDR and the name of the node it is pinned to.
+func pinnedReservation(clusterCIDR *cidrset.ClusterCIDR, cidr *net.IPNet) (string, *cidrset.PinnedReservation) {
+	for nodeName, pinned := range clusterCIDR.PinnedReservations {
+		for _, pinnedCIDR := range pinned.CIDRs {
+			if pinnedCIDR.Contains(cidr.IP) || cidr.Contains(pinnedCIDR.IP) {
+				return nodeName, pinned
+			}
+		}
+	}
+	return "", nil
+}
+
+// claimPinnedCIDRs returns the CIDRs pinned to the node by a matching
+// ClusterCIDR or requested by the node annotation. Pinned CIDRs take
+// precedence over the annotation. It returns false if the node has neither,
+// and an error if the CIDRs cannot be allocated to the node. In that case the
+// node is not allocated other CIDRs.
+func (r *multiCIDRRangeAllocator) claimPinnedCIDRs(logger klog.Logger, node *corev1.Node) (multiCIDRNodeReservedCIDRs, bool, error) {
+	reserved := multiCIDRNodeReservedCIDRs{nodeReservedCIDRs: nodeReservedCIDRs{nodeName: node.Name}}
+	clusterCIDRList, err := r.orderedMatchingClusterCIDRs(node, true)
+	if err != nil {
+		return reserved, false, err
+	}
+
+	for _, clusterCIDR := range clusterCIDRList {
+		pinned, ok := clusterCIDR.PinnedReservations[node.Name]
+		if !ok {
+			continue
+		}
+		if pinned.Taken {
+			msg := fmt.Sprintf("PodCIDRs %v pinned by ClusterCIDR %s are allocated to another node", ipnetToStringList(pinned.CIDRs), clusterCIDR.Name)
+			controllerutil.RecordNodeWarning(logger, r.recorder, node, pinnedCIDRTakenReason, msg)
+			return reserved, false, errors.New(msg)
+		}
+		logger.Info("Allocating pinned CIDRs to node", "node", klog.KObj(node), "podCIDRs", ipnetToStringList(pinned.CIDRs), "clusterCIDR", clusterCIDR.Name)
+		reserved.add(clusterCIDR, pinned.CIDRs)
+		return reserved, true, nil
+	}
+	if clusterCIDR := r.unmatchedPinnedClusterCIDR(node); clusterCIDR != nil {
+		msg := fmt.Sprintf("PodCIDRs are pinned by ClusterCIDR %s which does not match the node", clusterCIDR.Name)
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, pinnedCIDROutOfRangeReason, msg)
+		return reserved, false, errors.New(msg)
+	}
+
+	requested, err := requestedPodCIDRs(node)
+	if err != nil {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, invalidPinnedCIDRReason, err.Error())
+		return reserved, false, err
+	}
+	if len(requested) == 0 {
+		return reserved, false, nil
+	}
+
+	clusterCIDRs := make([]*cidrset.ClusterCIDR, 0, len(requested))
+	for _, cidr := range requested {
+		clusterCIDR := pinnableClusterCIDR(clusterCIDRList, cidr)
+		if clusterCIDR == nil {
+			msg := fmt.Sprintf("Requested PodCIDR %s is not a per node CIDR of a matching ClusterCIDR", cidr)
+			controllerutil.RecordNodeWarning(logger, r.recorder, node, pinnedCIDROutOfRangeReason, msg)
+			return reserved, false, errors.New(msg)
+		}
+		if r.cidrInAllocatedList(cidr) || r.cidrOverlapWithAllocatedList(cidr) {
+			msg := fmt.Sprintf("Requested PodCIDR %s is allocated to another node", cidr)
+			controllerutil.RecordNodeWarning(logger, r.recorder, node, pinnedCIDRTakenReason, msg)
+			return reserved, false, errors.New(msg)
+		}
+		clusterCIDRs = append(clusterCIDRs, clusterCIDR)
+	}
+
+	// Occupy the CIDRs once all of them are known to be free.
+	for i, cidr := range requested {
+		if err := r.Occupy(clusterCIDRs[i], cidr); err != nil {
+			return reserved, false, err
+		}
+		reserved.add(clusterCIDRs[i], []*net.IPNet{cidr})
+	}
+	logger.Info("Allocating requested CIDRs to node", "node", klog.KObj(node), "podCIDRs", ipnetToStringList(requested))
+	return reserved, true, nil
+}
+
+// holdPinnedNode returns true if the allocation of CIDRs to the node waits
+// for the draining or paused ClusterCIDR pinning CIDRs to the node, instead of
+// allocating other CIDRs. Held nodes are requeued periodically and when the
+// ClusterCIDR is unpaused.
+func (r *multiCIDRRangeAllocator) holdPinnedNode(logger klog.Logger, node *corev1.Node) bool {
+	var unavailable *cidrset.ClusterCIDR
+	for _, clusterCIDRList := range r.cidrMap {
+		for _, clusterCIDR := range clusterCIDRList {
+			if _, ok := clusterCIDR.PinnedReservations[node.Name]; !ok || clusterCIDR.Terminating {
+				continue
+			}
+			if !clusterCIDR.Draining && !clusterCIDR.AllocationPaused {
+				// The node is allocated the CIDRs of an available
+				// ClusterCIDR.
+				return false
+			}
+			unavailable = clusterCIDR
+		}
+	}
+	if unavailable == nil {
+		return false
+	}
+
+	r.nodeQueue.AddAfter(node.Name, pinnedNodeRequeuePeriod)
+	controllerutil.RecordNodeEvent(logger, r.recorder, node, pinnedClusterCIDRUnavailableReason,
+		fmt.Sprintf("Waiting for ClusterCIDR %s pinning the PodCIDRs, it is draining or paused", unavailable.Name))
+	logger.V(2).Info("Node is held by its pinned ClusterCIDR", "node", klog.KObj(node), "clusterCIDR", unavailable.Name,
+		"draining", unavailable.Draining, "allocationPaused", unavailable.AllocationPaused)
+	return true
+}
+
+// requeuePinnedNodes queues the nodes the ClusterCIDR pins CIDRs to.
+func (r *multiCIDRRangeAllocator) requeuePinnedNodes(clusterCIDR *cidrset.ClusterCIDR) {
+	for nodeName := range clusterCIDR.PinnedReservations {
+		r.nodeQueue.Add(nodeName)
+	}
+}
+
+// unmatchedPinnedClusterCIDR returns a ClusterCIDR pinning CIDRs to the node
+// whose node selector does not match the node, nil if there is none.
+func (r *multiCIDRRangeAllocator) unmatchedPinnedClusterCIDR(node *corev1.Node) *cidrset.ClusterCIDR {
+	for _, clusterCIDRList := range r.cidrMap {
+		for _, clusterCIDR := range clusterCIDRList {
+			if _, ok := clusterCIDR.PinnedReservations[node.Name]; ok && !clusterCIDR.Terminating && !clusterCIDR.Draining && !clusterCIDR.AllocationPaused {
+				return clusterCIDR
+			}
+		}
+	}
+	return nil
+}
+
+// checkPinnedCIDRs records a warning event for a node holding a CIDR pinned to
+// another node, e.g. because the node was allocated the CIDR before the
+// ClusterCIDR was created. The reservation is marked as taken until the node
+// is deleted.
+func (r *multiCIDRRangeAllocator) checkPinnedCIDRs(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node) {
+	conflicts := make(map[string][]string)
+	var pinnedNodes []string
+	for _, cidr := range node.Spec.PodCIDRs {
+		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+		if err != nil {
+			return
+		}
+		nodeName, pinned := pinnedReservation(clusterCIDR, podCIDR)
+		if pinned == nil || nodeName == node.Name {
+			continue
+		}
+
+		pinned.Taken = true
+		if _, ok := conflicts[nodeName]; !ok {
+			pinnedNodes = append(pinnedNodes, nodeName)
+		}
+		conflicts[nodeName] = append(conflicts[nodeName], cidr)
+	}
+
+	for _, nodeName := range pinnedNodes {
+		logger.Info("Node holds CIDRs pinned to another node", "node", klog.KObj(node), "podCIDRs", conflicts[nodeName], "pinnedNode", nodeName, "clusterCIDR", clusterCIDR.Name)
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, pinnedCIDRConflictReason,
+			fmt.Sprintf("PodCIDRs %v are pinned to node %s by ClusterCIDR %s", conflicts[nodeName], nodeName, clusterCIDR.Name))
+	}
+}
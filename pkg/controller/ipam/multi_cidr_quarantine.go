@@ -0,0 +1,69 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	netutil "k8s.io/utils/net"
+)
+
+// restoreQuarantine puts the CIDRs published in the ClusterCIDR status back
+// in quarantine. CIDRs whose quarantine has expired in the meantime are
+// available right away. CIDRs released while the controller was not running
+// are not in the status and are not quarantined.
+func restoreQuarantine(clusterCIDRSet *cidrset.ClusterCIDR, clusterCIDR *v1.ClusterCIDR) error {
+	for _, quarantined := range clusterCIDR.Status.Quarantine {
+		_, cidr, err := netutil.ParseCIDRSloppy(quarantined.CIDR)
+		if err != nil {
+			return fmt.Errorf("unable to parse quarantined CIDR %s: %w", quarantined.CIDR, err)
+		}
+		cidrSet := clusterCIDRSet.IPv6CIDRSet
+		if netutil.IsIPv4CIDR(cidr) {
+			cidrSet = clusterCIDRSet.IPv4CIDRSet
+		}
+		if cidrSet == nil || cidrSet.QuarantineDuration == 0 {
+			continue
+		}
+		if err := cidrSet.Quarantine(cidr, quarantined.ReleaseTime.Time); err != nil {
+			return fmt.Errorf("unable to restore quarantined CIDR %s: %w", quarantined.CIDR, err)
+		}
+	}
+	return nil
+}
+
+// quarantinedCIDRs returns the CIDRs in quarantine in the cidrSets of the
+// ClusterCIDR.
+func quarantinedCIDRs(clusterCIDRSet *cidrset.ClusterCIDR) []v1.QuarantinedCIDR {
+	var result []v1.QuarantinedCIDR
+	for _, cidrSet := range []*cidrset.MultiCIDRSet{clusterCIDRSet.IPv4CIDRSet, clusterCIDRSet.IPv6CIDRSet} {
+		if cidrSet == nil {
+			continue
+		}
+		for _, quarantined := range cidrSet.Quarantined() {
+			// The API server stores the time with second precision.
+			result = append(result, v1.QuarantinedCIDR{
+				CIDR:        quarantined.CIDR.String(),
+				ReleaseTime: metav1.NewTime(quarantined.ReleaseTime).Rfc3339Copy(),
+			})
+		}
+	}
+	return result
+}
@@ -40,7 +40,6 @@ import (
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
-	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	informers "k8s.io/client-go/informers/core/v1"
@@ -51,8 +50,8 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
-	nodeutil "k8s.io/component-helpers/node/util"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 	netutil "k8s.io/utils/net"
 )
 
@@ -82,7 +81,9 @@ const (
 )
 
 // +kubebuilder:rbac:groups=networking.x-k8s.io,resources=clustercidrs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.x-k8s.io,resources=clustercidrs/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;patch;update
+// +kubebuilder:rbac:groups=core,resources=nodes/status,verbs=patch
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // CIDRAllocator is an interface implemented by things that know how
@@ -96,6 +97,14 @@ type CIDRAllocator interface {
 	ReleaseCIDR(logger klog.Logger, node *corev1.Node) error
 	// Run starts all the working logic of the allocator.
 	Run(ctx context.Context)
+	// Explain explains which ClusterCIDR a node is allocated PodCIDRs from.
+	Explain(nodeName string, nodeLabels map[string]string) (*Explanation, error)
+	// State returns a snapshot of the ClusterCIDRs tracked by the allocator.
+	State(offset, limit int) (*AllocatorState, error)
+	// FreeBlocks returns the largest free blocks of a ClusterCIDR.
+	FreeBlocks(clusterCIDRName string, limit int) ([]*net.IPNet, error)
+	// Whois returns the owner of an IP address or CIDR.
+	Whois(address string) (*WhoisResult, error)
 }
 
 // CIDRAllocatorParams is parameters that's required for creating new
@@ -109,6 +118,25 @@ type CIDRAllocatorParams struct {
 	SecondaryServiceCIDR *net.IPNet
 	// NodeCIDRMaskSizes is list of node cidr mask sizes.
 	NodeCIDRMaskSizes []int
+	// QuarantineDuration is the time a released node CIDR is not allocated
+	// to other nodes, 0 disables the quarantine.
+	QuarantineDuration time.Duration
+	// PrimaryIPFamily is the ip family of the first CIDR in the PodCIDRs of
+	// dual-stack nodes for ClusterCIDRs that do not specify one. Defaults to IPv4.
+	PrimaryIPFamily corev1.IPFamily
+	// SizeByPodCapacity sizes the CIDRs of nodes without the max pods
+	// annotation by the pod capacity in their status.
+	SizeByPodCapacity bool
+	// AllocationGate holds the allocation of CIDRs to new nodes until they
+	// are ready to be matched against the ClusterCIDRs.
+	AllocationGate AllocationGate
+	// DryRun computes the allocations without writing to the API server.
+	// The writes are logged, recorded as events and counted in metrics
+	// instead, the state of the allocator advances as if they succeeded.
+	DryRun bool
+	// StartupTaintKey is the key of the taint removed from nodes once they
+	// are allocated PodCIDRs, empty if no taint is removed.
+	StartupTaintKey string
 }
 
 // CIDRs are reserved, then node resource is patched with them.
@@ -122,7 +150,42 @@ type nodeReservedCIDRs struct {
 // multiCIDRNodeReservedCIDRs holds the reservation info for a node.
 type multiCIDRNodeReservedCIDRs struct {
 	nodeReservedCIDRs
+	// clusterCIDR is the ClusterCIDR the CIDRs were allocated from. If the
+	// IPv4 and IPv6 CIDRs come from different ClusterCIDRs, it is the
+	// ClusterCIDR of the IPv4 CIDR.
 	clusterCIDR *cidrset.ClusterCIDR
+	// ipv6ClusterCIDR is the ClusterCIDR of the IPv6 CIDR if it differs from
+	// clusterCIDR.
+	ipv6ClusterCIDR *cidrset.ClusterCIDR
+}
+
+// add adds the CIDRs allocated from the ClusterCIDR to the reservation.
+func (d *multiCIDRNodeReservedCIDRs) add(clusterCIDR *cidrset.ClusterCIDR, cidrs []*net.IPNet) {
+	d.allocatedCIDRs = append(d.allocatedCIDRs, cidrs...)
+	switch {
+	case d.clusterCIDR == nil || d.clusterCIDR == clusterCIDR:
+		d.clusterCIDR = clusterCIDR
+	case len(cidrs) > 0 && netutil.IsIPv6CIDR(cidrs[0]):
+		d.ipv6ClusterCIDR = clusterCIDR
+	default:
+		d.clusterCIDR, d.ipv6ClusterCIDR = clusterCIDR, d.clusterCIDR
+	}
+}
+
+// clusterCIDRFor returns the ClusterCIDR the CIDR was allocated from.
+func (d *multiCIDRNodeReservedCIDRs) clusterCIDRFor(cidr *net.IPNet) *cidrset.ClusterCIDR {
+	if d.ipv6ClusterCIDR != nil && netutil.IsIPv6CIDR(cidr) {
+		return d.ipv6ClusterCIDR
+	}
+	return d.clusterCIDR
+}
+
+// clusterCIDRs returns the ClusterCIDRs the CIDRs were allocated from.
+func (d *multiCIDRNodeReservedCIDRs) clusterCIDRs() []*cidrset.ClusterCIDR {
+	if d.ipv6ClusterCIDR != nil {
+		return []*cidrset.ClusterCIDR{d.clusterCIDR, d.ipv6ClusterCIDR}
+	}
+	return []*cidrset.ClusterCIDR{d.clusterCIDR}
 }
 
 type multiCIDRRangeAllocator struct {
@@ -150,6 +213,40 @@ type multiCIDRRangeAllocator struct {
 	lock *sync.Mutex
 	// cidrMap maps ClusterCIDR labels to internal ClusterCIDR objects.
 	cidrMap map[string][]*cidrset.ClusterCIDR
+	// quarantineDuration is the time a released node CIDR is not allocated.
+	quarantineDuration time.Duration
+	// clock is used to expire sticky reservations.
+	clock clock.PassiveClock
+	// primaryIPFamily is the default primary ip family of dual-stack nodes.
+	primaryIPFamily corev1.IPFamily
+	// sizeByPodCapacity is true if node CIDRs are sized by the node pod capacity.
+	sizeByPodCapacity bool
+	// allocationGate holds the allocation of CIDRs to new nodes.
+	allocationGate AllocationGate
+	// gatedNodes is the set of node names held at the allocation gate.
+	gatedNodes map[string]bool
+	// driftedNodes is the set of node names that would be allocated PodCIDRs
+	// from a different ClusterCIDR.
+	driftedNodes map[string]bool
+	// startupTaintKey is the key of the taint removed from nodes once they
+	// are allocated PodCIDRs.
+	startupTaintKey string
+	// clusterCIDRSpecs maps the name of a tracked ClusterCIDR to the spec it
+	// was created from.
+	clusterCIDRSpecs map[string]*v1.ClusterCIDRSpec
+	// podCIDROwners maps the PodCIDRs and additional pod CIDRs of nodes to
+	// the node names.
+	podCIDROwners map[string]string
+	// serviceCIDRs are the service CIDRs of the cluster.
+	serviceCIDRs []*net.IPNet
+	// dryRun skips the writes to the API server.
+	dryRun bool
+	// dryRunPodCIDRs maps node names to the PodCIDRs that would have been
+	// patched in dry-run mode.
+	dryRunPodCIDRs map[string][]string
+	// dryRunAdditional maps node names to the value of the additional
+	// pod CIDRs annotation that would have been patched in dry-run mode.
+	dryRunAdditional map[string]string
 }
 
 // NewMultiCIDRRangeAllocator returns a CIDRAllocator to allocate CIDRs for node (one for each ip family).
@@ -180,6 +277,7 @@ func NewMultiCIDRRangeAllocator(
 		Component: "multiCIDRRangeAllocator",
 	}
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, eventSource)
+	registerAllocatorMetrics()
 
 	ra := &multiCIDRRangeAllocator{
 		client:                client,
@@ -192,10 +290,23 @@ func NewMultiCIDRRangeAllocator(
 		broadcaster:           eventBroadcaster,
 		recorder:              recorder,
 		// todo(mneverov): Use NewRateLimitingQueueWithConfig instead.
-		cidrQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "multi_cidr_range_allocator_cidr"),
-		nodeQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "multi_cidr_range_allocator_node"),
-		lock:      &sync.Mutex{},
-		cidrMap:   make(map[string][]*cidrset.ClusterCIDR, 0),
+		cidrQueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "multi_cidr_range_allocator_cidr"),
+		nodeQueue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "multi_cidr_range_allocator_node"),
+		lock:               &sync.Mutex{},
+		cidrMap:            make(map[string][]*cidrset.ClusterCIDR, 0),
+		quarantineDuration: allocatorParams.QuarantineDuration,
+		clock:              clock.RealClock{},
+		primaryIPFamily:    allocatorParams.PrimaryIPFamily,
+		sizeByPodCapacity:  allocatorParams.SizeByPodCapacity,
+		allocationGate:     allocatorParams.AllocationGate,
+		gatedNodes:         make(map[string]bool),
+		driftedNodes:       make(map[string]bool),
+		startupTaintKey:    allocatorParams.StartupTaintKey,
+		clusterCIDRSpecs:   make(map[string]*v1.ClusterCIDRSpec),
+		podCIDROwners:      make(map[string]string),
+		dryRun:             allocatorParams.DryRun,
+		dryRunPodCIDRs:     make(map[string][]string),
+		dryRunAdditional:   make(map[string]string),
 	}
 
 	// testCIDRMap is only set for testing purposes.
@@ -252,12 +363,14 @@ func NewMultiCIDRRangeAllocator(
 	}
 
 	if allocatorParams.ServiceCIDR != nil {
+		ra.serviceCIDRs = append(ra.serviceCIDRs, allocatorParams.ServiceCIDR)
 		ra.filterOutServiceRange(logger, allocatorParams.ServiceCIDR)
 	} else {
 		logger.Info("No Service CIDR provided. Skipping filtering out service addresses")
 	}
 
 	if allocatorParams.SecondaryServiceCIDR != nil {
+		ra.serviceCIDRs = append(ra.serviceCIDRs, allocatorParams.SecondaryServiceCIDR)
 		ra.filterOutServiceRange(logger, allocatorParams.SecondaryServiceCIDR)
 	} else {
 		logger.Info("No Secondary Service CIDR provided. Skipping filtering out secondary service addresses")
@@ -279,6 +392,12 @@ func NewMultiCIDRRangeAllocator(
 				return nil, err
 			}
 		}
+		// Additional pod CIDRs are occupied once the PodCIDRs of all nodes
+		// are, so that a published CIDR overlapping the PodCIDRs of another
+		// node is rejected instead of crashing the controller.
+		for i := range nodeList.Items {
+			ra.restoreAdditionalPodCIDRs(logger, &nodeList.Items[i])
+		}
 	}
 
 	_, err = nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -505,6 +624,9 @@ func (r *multiCIDRRangeAllocator) syncClusterCIDR(ctx context.Context, key strin
 	clusterCIDR, err := r.clusterCIDRLister.Get(key)
 	if apierrors.IsNotFound(err) {
 		logger.V(3).Info("clusterCIDR has been deleted", "key", key)
+		if r.dryRun {
+			return r.releaseDeletedClusterCIDR(logger, key)
+		}
 		return nil
 	}
 
@@ -552,10 +674,22 @@ func (r *multiCIDRRangeAllocator) occupyCIDRs(logger klog.Logger, node *corev1.N
 			// Mark CIDRs as occupied only if the CCC is able to occupy all the node CIDRs.
 			if occupiedCount == len(node.Spec.PodCIDRs) {
 				clusterCIDR.AssociatedNodes[node.Name] = true
+				r.indexPodCIDRs(node.Name, node.Spec.PodCIDRs)
+				r.occupyGroup(logger, clusterCIDR, node)
+				r.checkCorrelatedIndices(logger, clusterCIDR, node)
+				r.checkIPFamilyOrder(logger, clusterCIDR, node)
+				r.checkPinnedCIDRs(logger, clusterCIDR, node)
+				r.dropHeldStickyReservations(logger, clusterCIDRList, node)
 				return nil
 			}
 		}
 
+		// The IPv4 and IPv6 CIDRs may come from different ClusterCIDRs.
+		if len(node.Spec.PodCIDRs) > 1 && r.occupyCombinedCIDRs(logger, clusterCIDRList, node) {
+			r.dropHeldStickyReservations(logger, clusterCIDRList, node)
+			return nil
+		}
+
 		return fmt.Errorf("could not occupy cidrs: %v, No matching ClusterCIDRs found", node.Spec.PodCIDRs)
 	}(node)
 
@@ -580,6 +714,9 @@ func (r *multiCIDRRangeAllocator) Occupy(clusterCIDR *cidrset.ClusterCIDR, cidr
 	if err != nil {
 		return err
 	}
+	if currCIDRSet == nil {
+		return fmt.Errorf("clusterCIDR %s has no cidrSet for the ip family of cidr %v", clusterCIDR.Name, cidr)
+	}
 
 	if err := currCIDRSet.Occupy(cidr); err != nil {
 		return fmt.Errorf("unable to occupy cidr %v in cidrSet", cidr)
@@ -595,11 +732,41 @@ func (r *multiCIDRRangeAllocator) Release(logger klog.Logger, clusterCIDR *cidrs
 	if err != nil {
 		return err
 	}
+	if currCIDRSet == nil {
+		return fmt.Errorf("clusterCIDR %s has no cidrSet for the ip family of cidr %v", clusterCIDR.Name, cidr)
+	}
 
 	if err := currCIDRSet.Release(cidr); err != nil {
 		logger.Info("Unable to release cidr in cidrSet", "CIDR", cidr)
 		return err
 	}
+	if clusterCIDR.TopologyKey != "" {
+		// Publish the supernet in case it was freed by this release.
+		r.cidrQueue.Add(clusterCIDR.Name)
+	}
+
+	return nil
+}
+
+// rollback marks the CIDR as free in the cidrSet without quarantine. It
+// releases CIDRs reserved for a node that were not set on the node.
+func (r *multiCIDRRangeAllocator) rollback(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, cidr *net.IPNet) error {
+	currCIDRSet, err := r.associatedCIDRSet(clusterCIDR, cidr)
+	if err != nil {
+		return err
+	}
+	if currCIDRSet == nil {
+		return fmt.Errorf("clusterCIDR %s has no cidrSet for the ip family of cidr %v", clusterCIDR.Name, cidr)
+	}
+
+	if err := currCIDRSet.Rollback(cidr); err != nil {
+		logger.Info("Unable to roll back cidr in cidrSet", "CIDR", cidr)
+		return err
+	}
+	if clusterCIDR.TopologyKey != "" {
+		// Publish the supernet in case it was freed by this rollback.
+		r.cidrQueue.Add(clusterCIDR.Name)
+	}
 
 	return nil
 }
@@ -617,32 +784,82 @@ func (r *multiCIDRRangeAllocator) AllocateOrOccupyCIDR(logger klog.Logger, node
 	if node == nil {
 		return nil
 	}
+	node = r.withDryRunPodCIDRs(node)
 
 	if len(node.Spec.PodCIDRs) > 0 {
-		return r.occupyCIDRs(logger, node)
+		r.checkDrift(logger, node)
+		if err := r.occupyCIDRs(logger, node); err != nil {
+			return err
+		}
+		if allocated, err := r.allocatedClusterCIDRs(node); err == nil {
+			r.recordPodCIDRAllocated(logger, node, node.Spec.PodCIDRs, allocated.clusterCIDRs())
+		}
+		return r.syncAdditionalPodCIDRs(logger, node)
 	}
 
-	cidrs, clusterCIDR, err := r.prioritizedCIDRs(logger, node)
+	if r.holdAtGate(logger, node) || r.holdPinnedNode(logger, node) {
+		return nil
+	}
+
+	allocated, ok, err := r.claimPinnedCIDRs(logger, node)
 	if err != nil {
-		controllerutil.RecordNodeStatusChange(logger, r.recorder, node, "CIDRNotAvailable")
-		return fmt.Errorf("failed to get cidrs for node %s", node.Name)
+		return fmt.Errorf("failed to allocate pinned cidrs to node %s: %w", node.Name, err)
+	}
+	if !ok {
+		allocated, ok = r.claimStickyReservation(logger, node)
+	}
+	if !ok {
+		allocated, err = r.reserveCIDRs(logger, node)
+		if err != nil {
+			r.recordCIDRNotAvailable(logger, node)
+			return fmt.Errorf("failed to get cidrs for node %s", node.Name)
+		}
 	}
 
-	if len(cidrs) == 0 {
-		controllerutil.RecordNodeStatusChange(logger, r.recorder, node, "CIDRNotAvailable")
+	if len(allocated.allocatedCIDRs) == 0 {
+		r.recordCIDRNotAvailable(logger, node)
 		return fmt.Errorf("no cidrSets with matching labels found for node %s", node.Name)
 	}
 
-	// allocate and queue the assignment.
-	allocated := multiCIDRNodeReservedCIDRs{
-		nodeReservedCIDRs: nodeReservedCIDRs{
-			nodeName:       node.Name,
-			allocatedCIDRs: cidrs,
-		},
-		clusterCIDR: clusterCIDR,
+	// queue the assignment.
+	return r.updateCIDRsAllocation(logger, allocated)
+}
+
+// reserveCIDRs allocates the CIDRs of the node. The CIDRs are allocated from
+// a single ClusterCIDR if possible. Nodes requesting dual-stack are then
+// allocated an IPv4 and an IPv6 CIDR from different ClusterCIDRs and finally
+// a single ip family from ClusterCIDRs allowing the single-stack fallback.
+func (r *multiCIDRRangeAllocator) reserveCIDRs(logger klog.Logger, node *corev1.Node) (multiCIDRNodeReservedCIDRs, error) {
+	reserved := multiCIDRNodeReservedCIDRs{nodeReservedCIDRs: nodeReservedCIDRs{nodeName: node.Name}}
+	cidrs, clusterCIDR, err := r.prioritizedCIDRs(logger, node)
+	if err == nil {
+		reserved.add(clusterCIDR, cidrs)
+		return reserved, nil
+	}
+	if clusterCIDR != nil {
+		// The CIDRs of the node are fixed by its index in the ClusterCIDR.
+		return reserved, err
 	}
 
-	return r.updateCIDRsAllocation(logger, allocated)
+	requested, familiesErr := nodeIPFamilies(node)
+	if familiesErr != nil || (requested != nil && !requested.dualStack()) {
+		return reserved, err
+	}
+	clusterCIDRList, listErr := r.orderedMatchingClusterCIDRs(node, true)
+	if listErr != nil {
+		return reserved, err
+	}
+
+	if requested != nil {
+		if combined, ok := r.combineIPFamilies(logger, clusterCIDRList, node); ok {
+			return combined, nil
+		}
+	}
+	if cidrs, clusterCIDR := r.allocateSingleStackFallback(logger, clusterCIDRList, node, requested); clusterCIDR != nil {
+		reserved.add(clusterCIDR, cidrs)
+		return reserved, nil
+	}
+	return reserved, err
 }
 
 // ReleaseCIDR marks node.podCIDRs[...] as unused in our tracked cidrSets.
@@ -650,29 +867,74 @@ func (r *multiCIDRRangeAllocator) ReleaseCIDR(logger klog.Logger, node *corev1.N
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	if node == nil || len(node.Spec.PodCIDRs) == 0 {
+	if node == nil {
+		return nil
+	}
+	node = r.withDryRunPodCIDRs(node)
+	r.forgetDryRunPodCIDRs(node.Name)
+	r.releaseFromGate(node.Name)
+	r.forgetDrift(node.Name)
+	// Only the additional pod CIDRs owned by the node are released.
+	additional, additionalErr := r.ownedAdditionalPodCIDRs(node)
+	r.unindexPodCIDRs(node)
+	if len(node.Spec.PodCIDRs) == 0 {
 		return nil
 	}
 
-	clusterCIDR, err := r.allocatedClusterCIDR(node)
+	allocated, err := r.allocatedClusterCIDRs(node)
 	if err != nil {
 		return err
 	}
 
-	for _, cidr := range node.Spec.PodCIDRs {
-		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
-		if err != nil {
-			return fmt.Errorf("failed to parse CIDR %q on Node %q: %w", cidr, node.Name, err)
+	// Additional pod CIDRs are not kept in sticky reservations.
+	if additionalErr != nil {
+		logger.Error(additionalErr, "Unable to release additional pod CIDRs", "node", klog.KObj(node))
+	} else {
+		r.releaseAdditionalPodCIDRs(logger, allocated, additional)
+	}
+
+	for _, clusterCIDR := range allocated.clusterCIDRs() {
+		var podCIDRs []*net.IPNet
+		for _, podCIDR := range allocated.allocatedCIDRs {
+			if allocated.clusterCIDRFor(podCIDR) != clusterCIDR {
+				continue
+			}
+			// Pinned CIDRs stay occupied.
+			if nodeName, pinned := pinnedReservation(clusterCIDR, podCIDR); pinned != nil {
+				if nodeName != node.Name {
+					pinned.Taken = false
+				}
+				continue
+			}
+			podCIDRs = append(podCIDRs, podCIDR)
 		}
 
-		logger.Info("release CIDR for node", "CIDR", cidr, "node", klog.KObj(node))
-		if err := r.Release(logger, clusterCIDR, podCIDR); err != nil {
-			return fmt.Errorf("failed to release cidr %q from clusterCIDR %q for node %q: %w", cidr, clusterCIDR.Name, node.Name, err)
+		if clusterCIDR.StickyGracePeriod > 0 {
+			r.reserveStickyCIDRs(logger, clusterCIDR, node, podCIDRs)
+			continue
 		}
-	}
 
-	// Remove the node from the ClusterCIDR AssociatedNodes.
-	delete(clusterCIDR.AssociatedNodes, node.Name)
+		for _, podCIDR := range podCIDRs {
+			logger.Info("release CIDR for node", "CIDR", podCIDR, "node", klog.KObj(node))
+			if err := r.Release(logger, clusterCIDR, podCIDR); err != nil {
+				return fmt.Errorf("failed to release cidr %q from clusterCIDR %q for node %q: %w", podCIDR, clusterCIDR.Name, node.Name, err)
+			}
+		}
+
+		// Remove the node from the ClusterCIDR AssociatedNodes.
+		delete(clusterCIDR.AssociatedNodes, node.Name)
+
+		if clusterCIDR.Draining {
+			// Publish the remaining nodes of the draining ClusterCIDR.
+			r.cidrQueue.Add(clusterCIDR.Name)
+		}
+
+		if r.quarantineDuration > 0 {
+			// Publish the quarantined CIDRs and remove them once the quarantine expires.
+			r.cidrQueue.Add(clusterCIDR.Name)
+			r.cidrQueue.AddAfter(clusterCIDR.Name, r.quarantineDuration)
+		}
+	}
 
 	return nil
 }
@@ -717,6 +979,7 @@ func (r *multiCIDRRangeAllocator) occupyServiceCIDR(clusterCIDR *cidrset.Cluster
 // updateCIDRsAllocation assigns CIDR to Node and sends an update to the API server.
 func (r *multiCIDRRangeAllocator) updateCIDRsAllocation(logger klog.Logger, data multiCIDRNodeReservedCIDRs) error {
 	err := func(data multiCIDRNodeReservedCIDRs) error {
+		data.allocatedCIDRs = orderByIPFamily(data.allocatedCIDRs, data.clusterCIDR.IPv6Primary)
 		cidrsString := ipnetToStringList(data.allocatedCIDRs)
 		node, err := r.nodeLister.Get(data.nodeName)
 		if err != nil {
@@ -744,34 +1007,37 @@ func (r *multiCIDRRangeAllocator) updateCIDRsAllocation(logger klog.Logger, data
 		// node has cidrs allocated, release the reserved.
 		if len(node.Spec.PodCIDRs) != 0 {
 			logger.Error(nil, "Node already has a CIDR allocated. Releasing the new one", "node", klog.KObj(node), "podCIDRs", node.Spec.PodCIDRs)
-			for _, cidr := range data.allocatedCIDRs {
-				if err := r.Release(logger, data.clusterCIDR, cidr); err != nil {
-					return fmt.Errorf("failed to release cidr %s from clusterCIDR %s for node: %s: %w", cidr, data.clusterCIDR.Name, node.Name, err)
-				}
-			}
-			return nil
+			return r.rollbackReservedCIDRs(logger, data)
 		}
 
 		// If we reached here, it means that the node has no CIDR currently assigned. So we set it.
 		for i := 0; i < cidrUpdateRetries; i++ {
-			if err = nodeutil.PatchNodeCIDRs(r.client, types.NodeName(node.Name), cidrsString); err == nil {
-				data.clusterCIDR.AssociatedNodes[node.Name] = true
+			if err = r.patchNodeCIDRs(logger, node, cidrsString); err == nil {
+				for _, clusterCIDR := range data.clusterCIDRs() {
+					clusterCIDR.AssociatedNodes[node.Name] = true
+				}
+				r.indexPodCIDRs(node.Name, cidrsString)
 				logger.Info("Set node PodCIDR", "node", klog.KObj(node), "podCIDR", cidrsString)
+				r.recordPodCIDRAllocated(logger, node, cidrsString, data.clusterCIDRs())
 				return nil
 			}
+			// The taints changed since the node was listed.
+			if apierrors.IsConflict(err) {
+				if latest, getErr := r.client.CoreV1().Nodes().Get(context.TODO(), node.Name, metav1.GetOptions{}); getErr == nil {
+					node = latest
+				}
+			}
 		}
 		// failed release back to the pool.
 		logger.Error(err, "Failed to update node PodCIDR after attempts", "node", klog.KObj(node), "podCIDR", cidrsString, "retries", cidrUpdateRetries)
-		controllerutil.RecordNodeStatusChange(logger, r.recorder, node, "CIDRAssignmentFailed")
+		r.recordCIDRAssignmentFailed(logger, node, err)
 		// We accept the fact that we may leak CIDRs here. This is safer than releasing
 		// them in case when we don't know if request went through.
 		// NodeController restart will return all falsely allocated CIDRs to the pool.
 		if !apierrors.IsServerTimeout(err) {
 			logger.Error(err, "CIDR assignment for node failed. Releasing allocated CIDR", "node", klog.KObj(node))
-			for _, cidr := range data.allocatedCIDRs {
-				if err := r.Release(logger, data.clusterCIDR, cidr); err != nil {
-					return fmt.Errorf("failed to release cidr %q from clusterCIDR %q for node: %q: %w", cidr, data.clusterCIDR.Name, node.Name, err)
-				}
+			if err := r.rollbackReservedCIDRs(logger, data); err != nil {
+				return err
 			}
 		}
 		return err
@@ -780,6 +1046,21 @@ func (r *multiCIDRRangeAllocator) updateCIDRsAllocation(logger klog.Logger, data
 	return err
 }
 
+// rollbackReservedCIDRs releases the CIDRs reserved for the node that were not
+// published on the node, without quarantine. Pinned CIDRs stay occupied.
+func (r *multiCIDRRangeAllocator) rollbackReservedCIDRs(logger klog.Logger, data multiCIDRNodeReservedCIDRs) error {
+	for _, cidr := range data.allocatedCIDRs {
+		clusterCIDR := data.clusterCIDRFor(cidr)
+		if _, pinned := pinnedReservation(clusterCIDR, cidr); pinned != nil {
+			continue
+		}
+		if err := r.rollback(logger, clusterCIDR, cidr); err != nil {
+			return fmt.Errorf("failed to release cidr %s from clusterCIDR %s for node %s: %w", cidr, clusterCIDR.Name, data.nodeName, err)
+		}
+	}
+	return nil
+}
+
 // defaultNodeSelector generates a label with defaultClusterCIDRKey as the key and
 // defaultClusterCIDRValue as the value, it is an internal nodeSelector matching all
 // nodes. Only used if no ClusterCIDR selects the node.
@@ -802,40 +1083,63 @@ func defaultNodeSelector() *corev1.NodeSelector {
 // prioritizedCIDRs returns a list of CIDRs to be allocated to the node.
 // Returns 1 CIDR  if single stack.
 // Returns 2 CIDRs , 1 from each ip family if dual stack.
+// If the CIDRs at the index of the node can not be allocated, the ClusterCIDR
+// allocating by node index is returned with the error.
 func (r *multiCIDRRangeAllocator) prioritizedCIDRs(logger klog.Logger, node *corev1.Node) ([]*net.IPNet, *cidrset.ClusterCIDR, error) {
 	clusterCIDRList, err := r.orderedMatchingClusterCIDRs(node, true)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to get a clusterCIDR for node %s: %w", node.Name, err)
 	}
 
+	requested, err := nodeIPFamilies(node)
+	if err != nil {
+		controllerutil.RecordNodeWarning(logger, r.recorder, node, invalidIPFamiliesReason, err.Error())
+		return nil, nil, err
+	}
+
 	for _, clusterCIDR := range clusterCIDRList {
-		cidrs := make([]*net.IPNet, 0)
-		if clusterCIDR.IPv4CIDRSet != nil {
-			cidr, err := r.allocateCIDR(clusterCIDR, clusterCIDR.IPv4CIDRSet)
+		families, ok := clusterCIDRIPFamilies(clusterCIDR, requested)
+		if !ok {
+			logger.V(3).Info("ClusterCIDR does not provide the requested ip families, trying next range", "clusterCIDR", clusterCIDR.Name, "ipFamilies", requested)
+			continue
+		}
+
+		if clusterCIDR.NodeIndex != nil {
+			// The CIDRs of the node are fixed by its index, do not fall back
+			// to other ranges.
+			cidrs, err := r.allocateIndexedCIDRs(logger, clusterCIDR, node, families)
 			if err != nil {
-				logger.V(3).Info("Unable to allocate IPv4 CIDR, trying next range", "err", err)
-				continue
+				return nil, clusterCIDR, err
 			}
-			cidrs = append(cidrs, cidr)
+			return cidrs, clusterCIDR, nil
 		}
 
-		if clusterCIDR.IPv6CIDRSet != nil {
-			cidr, err := r.allocateCIDR(clusterCIDR, clusterCIDR.IPv6CIDRSet)
+		if clusterCIDR.CorrelatedIndices && families.dualStack() {
+			cidrs, err := r.allocateCorrelatedCIDRs(logger, clusterCIDR)
 			if err != nil {
-				logger.V(3).Info("Unable to allocate IPv6 CIDR, trying next range", "err", err)
+				logger.V(3).Info("Unable to allocate correlated CIDRs, trying next range", "err", err)
 				continue
 			}
-			cidrs = append(cidrs, cidr)
+			return cidrs, clusterCIDR, nil
 		}
 
+		cidrs, err := r.allocateIPFamilies(logger, clusterCIDR, node, families)
+		if err != nil {
+			logger.V(3).Info("Unable to allocate CIDRs, trying next range", "err", err)
+			continue
+		}
+		r.recordSingleStackRequest(logger, clusterCIDR, node, families)
 		return cidrs, clusterCIDR, nil
 	}
 	return nil, nil, fmt.Errorf("unable to get a clusterCIDR for node %s, no available CIDRs", node.Name)
 }
 
-func (r *multiCIDRRangeAllocator) allocateCIDR(clusterCIDR *cidrset.ClusterCIDR, cidrSet *cidrset.MultiCIDRSet) (*net.IPNet, error) {
+// allocateCIDR allocates the next free block with the given host bits from
+// the cidrSet. If group is not empty, the CIDR is allocated from the supernet
+// of the group.
+func (r *multiCIDRRangeAllocator) allocateCIDR(clusterCIDR *cidrset.ClusterCIDR, cidrSet *cidrset.MultiCIDRSet, group string, hostBits int) (*net.IPNet, error) {
 	for evaluated := 0; evaluated < cidrSet.MaxCIDRs; evaluated++ {
-		candidate, lastEvaluated, err := cidrSet.NextCandidate()
+		candidate, lastEvaluated, err := cidrSet.NextBlockCandidate(group, hostBits)
 		if err != nil {
 			return nil, err
 		}
@@ -895,19 +1199,46 @@ func (r *multiCIDRRangeAllocator) cidrOverlapWithAllocatedList(cidr *net.IPNet)
 	return false
 }
 
-// allocatedClusterCIDR returns the ClusterCIDR from which the node CIDRs were allocated.
-func (r *multiCIDRRangeAllocator) allocatedClusterCIDR(node *corev1.Node) (*cidrset.ClusterCIDR, error) {
+// allocatedClusterCIDRs returns the node CIDRs and the ClusterCIDRs from which
+// they were allocated.
+func (r *multiCIDRRangeAllocator) allocatedClusterCIDRs(node *corev1.Node) (multiCIDRNodeReservedCIDRs, error) {
+	allocated := multiCIDRNodeReservedCIDRs{nodeReservedCIDRs: nodeReservedCIDRs{nodeName: node.Name}}
 	clusterCIDRList, err := r.orderedMatchingClusterCIDRs(node, false)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get a clusterCIDR for node %s: %w", node.Name, err)
+		return allocated, fmt.Errorf("unable to get a clusterCIDR for node %s: %w", node.Name, err)
+	}
+
+	for _, cidr := range node.Spec.PodCIDRs {
+		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+		if err != nil {
+			return allocated, fmt.Errorf("failed to parse CIDR %q on Node %q: %w", cidr, node.Name, err)
+		}
+
+		clusterCIDR := associatedClusterCIDR(clusterCIDRList, node, podCIDR)
+		if clusterCIDR == nil {
+			return allocated, fmt.Errorf("no clusterCIDR found associated with node: %s", node.Name)
+		}
+		allocated.add(clusterCIDR, []*net.IPNet{podCIDR})
 	}
+	return allocated, nil
+}
 
+// associatedClusterCIDR returns the first ClusterCIDR associated with the
+// node that contains the CIDR.
+func associatedClusterCIDR(clusterCIDRList []*cidrset.ClusterCIDR, node *corev1.Node, cidr *net.IPNet) *cidrset.ClusterCIDR {
 	for _, clusterCIDR := range clusterCIDRList {
-		if ok := clusterCIDR.AssociatedNodes[node.Name]; ok {
-			return clusterCIDR, nil
+		if !clusterCIDR.AssociatedNodes[node.Name] {
+			continue
+		}
+		cidrSet := clusterCIDR.IPv4CIDRSet
+		if netutil.IsIPv6CIDR(cidr) {
+			cidrSet = clusterCIDR.IPv6CIDRSet
+		}
+		if cidrSet != nil && cidrSet.ClusterCIDR.Contains(cidr.IP) {
+			return clusterCIDR
 		}
 	}
-	return nil, fmt.Errorf("no clusterCIDR found associated with node: %s", node.Name)
+	return nil
 }
 
 // orderedMatchingClusterCIDRs returns a list of all the ClusterCIDRs matching the node labels.
@@ -921,6 +1252,9 @@ func (r *multiCIDRRangeAllocator) allocatedClusterCIDR(node *corev1.Node) (*cidr
 // orderedMatchingClusterCIDRs takes `occupy` as an argument, it determines whether the function
 // is called during an occupy or a release operation. For a release operation, a ClusterCIDR must
 // be added to the matching ClusterCIDRs list, irrespective of whether the ClusterCIDR is terminating.
+// Draining and paused ClusterCIDRs are removed from the list for nodes without PodCIDRs.
+// For nodes without PodCIDRs requesting a CIDR size, ClusterCIDRs with a too small or an
+// unnecessarily large per node CIDR are removed from the list, see filterBySize.
 func (r *multiCIDRRangeAllocator) orderedMatchingClusterCIDRs(node *corev1.Node, occupy bool) ([]*cidrset.ClusterCIDR, error) {
 	matchingCIDRs := make([]*cidrset.ClusterCIDR, 0)
 	pq := make(PriorityQueue, 0)
@@ -966,6 +1300,12 @@ func (r *multiCIDRRangeAllocator) orderedMatchingClusterCIDRs(node *corev1.Node,
 	if clusterCIDRList, ok := r.cidrMap[defaultSelector.String()]; ok {
 		matchingCIDRs = append(matchingCIDRs, clusterCIDRList...)
 	}
+
+	// Size the CIDRs of nodes that are being allocated, draining and paused
+	// ClusterCIDRs do not allocate CIDRs to new nodes.
+	if occupy && len(node.Spec.PodCIDRs) == 0 {
+		return r.filterBySize(node, withoutPaused(withoutDraining(matchingCIDRs)))
+	}
 	return matchingCIDRs, nil
 }
 
@@ -1084,8 +1424,19 @@ func (r *multiCIDRRangeAllocator) reconcileCreate(ctx context.Context, clusterCI
 			logger.Error(err, "Unable to create ClusterCIDR", "clusterCIDR", clusterCIDR.Name)
 			return err
 		}
+		return nil
 	}
-	return nil
+
+	clusterCIDRSet, err := r.clusterCIDRSet(clusterCIDR)
+	if err != nil || clusterCIDRSet == nil {
+		return err
+	}
+	r.releaseExpiredStickyReservations(logger, clusterCIDRSet)
+	r.reconcileAllocationPaused(logger, clusterCIDR, clusterCIDRSet)
+	if err := r.reconcileDrain(ctx, clusterCIDR, clusterCIDRSet); err != nil {
+		return err
+	}
+	return r.updateClusterCIDRStatus(ctx, clusterCIDR, clusterCIDRSet)
 }
 
 // reconcileBootstrap handles creation of existing ClusterCIDRs.
@@ -1095,10 +1446,14 @@ func (r *multiCIDRRangeAllocator) reconcileBootstrap(ctx context.Context, cluste
 	defer r.lock.Unlock()
 
 	logger := klog.FromContext(ctx)
-	terminating := false
-	// Create the ClusterCIDR only if the Spec has not been modified.
-	if clusterCIDR.Generation > 1 {
-		terminating = true
+	// Create the ClusterCIDR only if the immutable fields of the Spec have
+	// not been modified. A status published before the spec hash records
+	// the changes of mutable fields in the observed generation.
+	terminating := clusterCIDR.Status.SpecHash != immutableSpecHash(&clusterCIDR.Spec)
+	if clusterCIDR.Status.SpecHash == "" {
+		terminating = clusterCIDR.Generation > 1 && clusterCIDR.Generation != clusterCIDR.Status.ObservedGeneration
+	}
+	if terminating {
 		err := fmt.Errorf("CIDRs from ClusterCIDR %s will not be used for allocation as it was modified", clusterCIDR.Name)
 		logger.Error(err, "ClusterCIDR Modified")
 	}
@@ -1131,6 +1486,7 @@ func (r *multiCIDRRangeAllocator) createClusterCIDR(ctx context.Context, cluster
 	if err := r.mapClusterCIDRSet(r.cidrMap, nodeSelector, clusterCIDRSet); err != nil {
 		return fmt.Errorf("unable to map clusterCIDRSet: %w", err)
 	}
+	r.clusterCIDRSpecs[clusterCIDR.Name] = clusterCIDR.Spec.DeepCopy()
 
 	// Make a copy so we don't mutate the shared informer cache.
 	updatedClusterCIDR := clusterCIDR.DeepCopy()
@@ -1139,6 +1495,9 @@ func (r *multiCIDRRangeAllocator) createClusterCIDR(ctx context.Context, cluster
 	}
 
 	logger := klog.FromContext(ctx)
+	if r.skipWrite(logger, clusterCIDRRef(clusterCIDR), dryRunAddFinalizer, fmt.Sprintf("would add finalizer %s to ClusterCIDR %s", clusterCIDRFinalizer, clusterCIDR.Name)) {
+		return nil
+	}
 	if updatedClusterCIDR.ResourceVersion == "" {
 		// Create is only used for creating default ClusterCIDR.
 		if _, err := r.networkClient.Create(ctx, updatedClusterCIDR, metav1.CreateOptions{}); err != nil {
@@ -1159,9 +1518,53 @@ func (r *multiCIDRRangeAllocator) createClusterCIDR(ctx context.Context, cluster
 // createClusterCIDRSet creates and returns new cidrset.ClusterCIDR based on ClusterCIDR API object.
 func (r *multiCIDRRangeAllocator) createClusterCIDRSet(clusterCIDR *v1.ClusterCIDR, terminating bool) (*cidrset.ClusterCIDR, error) {
 	clusterCIDRSet := &cidrset.ClusterCIDR{
-		Name:            clusterCIDR.Name,
-		AssociatedNodes: make(map[string]bool, 0),
-		Terminating:     terminating,
+		Name:                clusterCIDR.Name,
+		AssociatedNodes:     make(map[string]bool, 0),
+		Terminating:         terminating,
+		StickyReservations:  make(map[string]*cidrset.StickyReservation),
+		CorrelatedIndices:   clusterCIDR.Spec.CorrelatedIndices,
+		IPv6Primary:         r.ipv6Primary(clusterCIDR),
+		SingleStackFallback: clusterCIDR.Spec.SingleStackFallback,
+		MaxNodeHostBits:     int(clusterCIDR.Spec.MaxPerNodeHostBits),
+		PinnedReservations:  make(map[string]*cidrset.PinnedReservation),
+		Draining:            isDraining(clusterCIDR),
+		AllocationPaused:    clusterCIDR.Spec.AllocationPaused,
+		ObservedGeneration:  clusterCIDR.Generation,
+		SpecHash:            immutableSpecHash(&clusterCIDR.Spec),
+	}
+	if terminating {
+		// Keep the generation and the spec the ClusterCIDR was allocated
+		// from before it was modified.
+		clusterCIDRSet.ObservedGeneration = clusterCIDR.Status.ObservedGeneration
+		clusterCIDRSet.SpecHash = clusterCIDR.Status.SpecHash
+	}
+	if clusterCIDR.Spec.StickyGracePeriod != nil {
+		clusterCIDRSet.StickyGracePeriod = clusterCIDR.Spec.StickyGracePeriod.Duration
+	}
+
+	if clusterCIDR.Spec.CorrelatedIndices && clusterCIDR.Spec.MaxPerNodeHostBits != 0 {
+		// Correlated CIDRs are allocated at the same index, they all have
+		// the per node size.
+		return nil, errors.New("maxPerNodeHostBits may not be specified together with correlatedIndices")
+	}
+	if clusterCIDR.Spec.CorrelatedIndices && clusterCIDR.Spec.Aggregation != nil {
+		// Correlated CIDRs are allocated at the same index regardless of
+		// the supernet of the node group.
+		return nil, errors.New("aggregation may not be specified together with correlatedIndices")
+	}
+
+	strategy, err := cidrset.NewStrategy(string(clusterCIDR.Spec.AllocationStrategy))
+	if err != nil {
+		return nil, err
+	}
+	if strategy == cidrset.NodeIndex {
+		if clusterCIDR.Spec.NodeIndex == nil {
+			return nil, errors.New("nodeIndex must be specified for the NodeIndex allocation strategy")
+		}
+		clusterCIDRSet.NodeIndex, err = cidrset.NewNodeIndexTemplate(clusterCIDR.Spec.NodeIndex.NameRegex, clusterCIDR.Spec.NodeIndex.Label)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if clusterCIDR.Spec.IPv4 != "" {
@@ -1173,6 +1576,8 @@ func (r *multiCIDRRangeAllocator) createClusterCIDRSet(clusterCIDR *v1.ClusterCI
 		if err != nil {
 			return nil, fmt.Errorf("unable to create IPv4 cidrSet: %w", err)
 		}
+		clusterCIDRSet.IPv4CIDRSet.Strategy = strategy
+		clusterCIDRSet.IPv4CIDRSet.QuarantineDuration = r.quarantineDuration
 	}
 
 	if clusterCIDR.Spec.IPv6 != "" {
@@ -1184,6 +1589,26 @@ func (r *multiCIDRRangeAllocator) createClusterCIDRSet(clusterCIDR *v1.ClusterCI
 		if err != nil {
 			return nil, fmt.Errorf("unable to create IPv6 cidrSet: %w", err)
 		}
+		clusterCIDRSet.IPv6CIDRSet.Strategy = strategy
+		clusterCIDRSet.IPv6CIDRSet.QuarantineDuration = r.quarantineDuration
+	}
+
+	if clusterCIDR.Spec.Aggregation != nil {
+		if err := enableAggregation(clusterCIDRSet, clusterCIDR); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := restoreQuarantine(clusterCIDRSet, clusterCIDR); err != nil {
+		return nil, err
+	}
+
+	if err := r.occupyPinnedReservations(clusterCIDRSet, clusterCIDR); err != nil {
+		return nil, err
+	}
+
+	if err := r.restoreStickyReservations(clusterCIDRSet, clusterCIDR); err != nil {
+		return nil, err
 	}
 
 	return clusterCIDRSet, nil
@@ -1219,6 +1644,9 @@ func (r *multiCIDRRangeAllocator) reconcileDelete(ctx context.Context, clusterCI
 		// Remove the finalizer as delete is successful.
 		cccCopy := clusterCIDR.DeepCopy()
 		cccCopy.ObjectMeta.Finalizers = slice.RemoveString(cccCopy.ObjectMeta.Finalizers, clusterCIDRFinalizer, nil)
+		if r.skipWrite(logger, clusterCIDRRef(clusterCIDR), dryRunRemoveFinalizer, fmt.Sprintf("would remove finalizer %s from ClusterCIDR %s", clusterCIDRFinalizer, clusterCIDR.Name)) {
+			return nil
+		}
 		if _, err := r.networkClient.Update(ctx, cccCopy, metav1.UpdateOptions{}); err != nil {
 			logger.V(2).Info("Error removing finalizer for ClusterCIDR", "clusterCIDR", clusterCIDR.Name, "err", err)
 			return err
@@ -1254,6 +1682,7 @@ func (r *multiCIDRRangeAllocator) deleteClusterCIDR(logger klog.Logger, clusterC
 			return fmt.Errorf("ClusterCIDRSet %s marked as terminating, won't be deleted until all associated nodes are deleted", clusterCIDR.Name)
 		}
 
+		delete(r.clusterCIDRSpecs, clusterCIDR.Name)
 		// Remove the label from the map if this was the only clusterCIDR associated
 		// with it.
 		if len(clusterCIDRSetList) == 1 {
@@ -18,8 +18,13 @@ package ipam
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -33,16 +38,20 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/ktesting"
+	testingclock "k8s.io/utils/clock/testing"
 	utilnet "k8s.io/utils/net"
 )
 
@@ -1659,7 +1668,10 @@ func newController(ctx context.Context) (*clustercidrfake.Clientset, *clusterCID
 	})
 	client.PrependReactor("update", "clustercidrs", func(action k8stesting.Action) (bool, runtime.Object, error) {
 		clusterCIDR := action.(k8stesting.CreateAction).GetObject().(*v1.ClusterCIDR)
-		clusterCIDR.Generation++
+		// Status updates do not change the generation.
+		if action.GetSubresource() != "status" {
+			clusterCIDR.Generation++
+		}
 		cccIndexer.Update(clusterCIDR)
 
 		return false, clusterCIDR, nil
@@ -1791,6 +1803,363 @@ func TestSyncClusterCIDRCreate(t *testing.T) {
 	}
 }
 
+// Ensure the allocation strategy of a ClusterCIDR is used by its cidrSets.
+func TestCreateClusterCIDRSetStrategy(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+
+	ccc := makeClusterCIDR("best-fit", "10.4.0.0/16", "fd00:4::/112", 8, nil)
+	ccc.Spec.AllocationStrategy = v1.BestFitAllocationStrategy
+	clusterCIDRSet, err := cccController.createClusterCIDRSet(ccc, false)
+	require.NoError(t, err)
+	assert.Equal(t, multicidrset.BestFit, clusterCIDRSet.IPv4CIDRSet.Strategy)
+	assert.Equal(t, multicidrset.BestFit, clusterCIDRSet.IPv6CIDRSet.Strategy)
+
+	ccc = makeClusterCIDR("default-strategy", "10.5.0.0/16", "", 8, nil)
+	clusterCIDRSet, err = cccController.createClusterCIDRSet(ccc, false)
+	require.NoError(t, err)
+	assert.Equal(t, multicidrset.RoundRobin, clusterCIDRSet.IPv4CIDRSet.Strategy)
+
+	ccc = makeClusterCIDR("invalid-strategy", "10.6.0.0/16", "", 8, nil)
+	ccc.Spec.AllocationStrategy = "FirstFit"
+	_, err = cccController.createClusterCIDRSet(ccc, false)
+	assert.Error(t, err)
+}
+
+// Ensure nodes of an aggregated ClusterCIDR get CIDRs from the supernet of
+// their group and the supernets are published in the ClusterCIDR status.
+func TestClusterCIDRAggregation(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client, cccController := newController(ctx)
+
+	ccc := makeClusterCIDR("aggregated", "10.7.0.0/16", "fd00:7::/112", 4, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.Aggregation = &v1.Aggregation{TopologyKey: corev1.LabelTopologyZone, SupernetHostBits: 6}
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	makeNode := func(name, zone string) *corev1.Node {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}}}
+		if zone != "" {
+			node.Labels[corev1.LabelTopologyZone] = zone
+		}
+		return node
+	}
+
+	logger := klog.FromContext(ctx)
+	for _, tc := range []struct {
+		node     *corev1.Node
+		expected []string
+	}{
+		{node: makeNode("node-0", "zone-a"), expected: []string{"10.7.0.0/28", "fd00:7::/124"}},
+		{node: makeNode("node-1", "zone-b"), expected: []string{"10.7.0.64/28", "fd00:7::40/124"}},
+		{node: makeNode("node-2", "zone-a"), expected: []string{"10.7.0.16/28", "fd00:7::10/124"}},
+		{node: makeNode("node-3", ""), expected: []string{"10.7.0.128/28", "fd00:7::80/124"}},
+	} {
+		cidrs, clusterCIDR, err := cccController.prioritizedCIDRs(logger, tc.node)
+		require.NoError(t, err)
+		assert.Equal(t, ccc.Name, clusterCIDR.Name)
+		assert.Equal(t, tc.expected, ipnetToStringList(cidrs), "unexpected CIDRs for node %s", tc.node.Name)
+	}
+
+	created, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	cccController.clusterCIDRStore.Update(created)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	expectActions(t, client.Actions(), 1, "update", "clustercidrs")
+
+	updated, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	expectedSupernets := []v1.Supernet{
+		{Group: "zone-a", IPv4: "10.7.0.0/26", IPv6: "fd00:7::/122"},
+		{Group: "zone-b", IPv4: "10.7.0.64/26", IPv6: "fd00:7::40/122"},
+	}
+	assert.Equal(t, expectedSupernets, updated.Status.Supernets)
+	assert.Equal(t, created.Generation, updated.Generation, "status update must not change the generation")
+
+	// The supernets are restored from the status.
+	clusterCIDRSet, err := cccController.createClusterCIDRSet(updated, false)
+	require.NoError(t, err)
+	assert.Equal(t, expectedSupernets, supernets(clusterCIDRSet))
+}
+
+// Ensure released CIDRs are quarantined, published in the ClusterCIDR status
+// and restored from it.
+func TestClusterCIDRQuarantine(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client, cccController := newController(ctx)
+	cccController.quarantineDuration = time.Hour
+
+	ccc := makeClusterCIDR("quarantine", "10.8.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-0", Labels: map[string]string{"foo": "bar"}}}
+	cidrs, _, err := cccController.prioritizedCIDRs(logger, node)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.8.0.0/24"}, ipnetToStringList(cidrs))
+
+	node.Spec.PodCIDRs = ipnetToStringList(cidrs)
+	require.NoError(t, cccController.occupyCIDRs(logger, node))
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+
+	cidrs, _, err = cccController.prioritizedCIDRs(logger, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"foo": "bar"}}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.8.1.0/24"}, ipnetToStringList(cidrs), "quarantined CIDR must not be allocated")
+
+	created, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	cccController.clusterCIDRStore.Update(created)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	updated, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, updated.Status.Quarantine, 1)
+	assert.Equal(t, "10.8.0.0/24", updated.Status.Quarantine[0].CIDR)
+
+	// The quarantine is restored from the status.
+	clusterCIDRSet, err := cccController.createClusterCIDRSet(updated, false)
+	require.NoError(t, err)
+	assert.Equal(t, updated.Status.Quarantine, quarantinedCIDRs(clusterCIDRSet))
+}
+
+// Ensure the CIDRs of a deleted node are reserved for a node with the same
+// name during the sticky grace period and released afterwards.
+func TestClusterCIDRStickyReservation(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client, cccController := newController(ctx)
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	cccController.clock = fakeClock
+
+	ccc := makeClusterCIDR("sticky", "10.9.0.0/16", "fd00:9::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.StickyGracePeriod = &metav1.Duration{Duration: time.Hour}
+	ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name string, podCIDRs ...string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}},
+			Spec:       corev1.NodeSpec{PodCIDRs: podCIDRs},
+		}
+	}
+
+	reserved := []string{"10.9.0.0/24", "fd00:9::/120"}
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-0", reserved...)))
+	require.NoError(t, cccController.ReleaseCIDR(logger, makeNode("node-0", reserved...)))
+
+	// The reserved CIDRs are not allocated to other nodes.
+	cidrs, _, err := cccController.prioritizedCIDRs(logger, makeNode("node-1"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.9.1.0/24", "fd00:9::100/120"}, ipnetToStringList(cidrs))
+
+	created, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	cccController.clusterCIDRStore.Update(created)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	updated, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, updated.Status.StickyReservations, 1)
+	assert.Equal(t, "node-0", updated.Status.StickyReservations[0].NodeName)
+	assert.Equal(t, reserved, updated.Status.StickyReservations[0].PodCIDRs)
+
+	// The reservation is restored from the status.
+	clusterCIDRSet, err := cccController.createClusterCIDRSet(updated, false)
+	require.NoError(t, err)
+	assert.Equal(t, updated.Status.StickyReservations, stickyReservations(clusterCIDRSet))
+
+	// A node with the same name gets the reserved CIDRs back.
+	claimed, ok := cccController.claimStickyReservation(logger, makeNode("node-0"))
+	require.True(t, ok)
+	assert.Equal(t, reserved, ipnetToStringList(claimed.allocatedCIDRs))
+	assert.Empty(t, claimed.clusterCIDR.StickyReservations)
+
+	// An expired reservation is released.
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-0", reserved...)))
+	require.NoError(t, cccController.ReleaseCIDR(logger, makeNode("node-0", reserved...)))
+	fakeClock.SetTime(fakeClock.Now().Add(time.Hour))
+	_, ok = cccController.claimStickyReservation(logger, makeNode("node-0"))
+	assert.False(t, ok, "expired reservation must not be claimed")
+
+	cccController.clusterCIDRStore.Update(updated)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	updated, err = client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, updated.Status.StickyReservations)
+	cidrs, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-2"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.9.0.0/24", "fd00:9::/120"}, ipnetToStringList(cidrs))
+
+	// A restored reservation is dropped once the re-created node holding the
+	// reserved CIDRs is occupied.
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-0", reserved...)))
+	require.NoError(t, cccController.ReleaseCIDR(logger, makeNode("node-0", reserved...)))
+	clusterCIDRSet = claimed.clusterCIDR
+	require.Contains(t, clusterCIDRSet.StickyReservations, "node-0")
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-0", reserved...)))
+	assert.NotContains(t, clusterCIDRSet.StickyReservations, "node-0")
+
+	// An expired reservation does not release CIDRs owned by a node.
+	clusterCIDRSet.StickyReservations["node-3"] = &multicidrset.StickyReservation{
+		CIDRs:          claimed.allocatedCIDRs,
+		ExpirationTime: fakeClock.Now(),
+	}
+	cccController.releaseExpiredStickyReservations(logger, clusterCIDRSet)
+	assert.Empty(t, clusterCIDRSet.StickyReservations)
+	cidrs, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-2"))
+	require.NoError(t, err)
+	assert.NotEqual(t, reserved, ipnetToStringList(cidrs), "CIDRs of node-0 must stay allocated")
+}
+
+// Ensure the NodeIndex allocation strategy allocates the CIDRs at the node
+// index and records an event if the CIDRs can not be allocated.
+func TestClusterCIDRNodeIndex(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+
+	ccc := makeClusterCIDR("node-index", "10.10.0.0/16", "fd00:10::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+	ccc.Spec.NodeIndex = &v1.NodeIndex{NameRegex: `^rack\d+-node(\d+)$`}
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}}}
+	}
+
+	cidrs, clusterCIDR, err := cccController.prioritizedCIDRs(logger, makeNode("rack3-node17"))
+	require.NoError(t, err)
+	assert.Equal(t, ccc.Name, clusterCIDR.Name)
+	assert.Equal(t, []string{"10.10.17.0/24", "fd00:10::1100/120"}, ipnetToStringList(cidrs))
+
+	for _, tc := range []struct {
+		nodeName string
+		reason   string
+	}{
+		{nodeName: "rack4-node17", reason: nodeIndexCIDRTakenReason},
+		{nodeName: "rack3-node256", reason: nodeIndexOutOfRangeReason},
+		{nodeName: "worker", reason: nodeIndexInvalidReason},
+	} {
+		_, _, err := cccController.prioritizedCIDRs(logger, makeNode(tc.nodeName))
+		assert.Error(t, err, "node %s", tc.nodeName)
+		require.Len(t, recorder.Events, 1, "node %s", tc.nodeName)
+		assert.Contains(t, <-recorder.Events, tc.reason, "node %s", tc.nodeName)
+	}
+}
+
+// Ensure a node whose CIDRs at its index are allocated, quarantined or in the
+// supernet of another group does not get CIDRs from other ClusterCIDRs.
+func TestClusterCIDRNodeIndexNotFree(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+	cccController.quarantineDuration = time.Hour
+
+	ccc := makeClusterCIDR("node-index", "10.10.0.0/16", "fd00:10::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.AllocationStrategy = v1.NodeIndexAllocationStrategy
+	ccc.Spec.NodeIndex = &v1.NodeIndex{NameRegex: `^rack\d+-node(\d+)$`}
+	ccc.Spec.Aggregation = &v1.Aggregation{TopologyKey: corev1.LabelTopologyZone, SupernetHostBits: 10}
+	for _, c := range []*v1.ClusterCIDR{
+		ccc,
+		makeClusterCIDR("ipv4", "10.20.0.0/16", "", 8, nil),
+		makeClusterCIDR("ipv6", "", "fd00:20::/112", 8, nil),
+	} {
+		cccController.clusterCIDRStore.Add(c)
+		require.NoError(t, cccController.syncClusterCIDR(ctx, c.Name))
+	}
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name, zone string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{
+			"foo":                    "bar",
+			corev1.LabelTopologyZone: zone,
+			v1.LabelIPFamilies:       v1.IPFamiliesDualStack,
+		}}}
+	}
+	expectNotFree := func(node *corev1.Node) {
+		t.Helper()
+		reserved, err := cccController.reserveCIDRs(logger, node)
+		assert.Error(t, err, "node %s", node.Name)
+		assert.Empty(t, reserved.allocatedCIDRs, "node %s must not get CIDRs from other ClusterCIDRs", node.Name)
+		require.NotEmpty(t, recorder.Events, "node %s", node.Name)
+		assert.Contains(t, <-recorder.Events, nodeIndexCIDRTakenReason, "node %s", node.Name)
+		for len(recorder.Events) > 0 {
+			<-recorder.Events
+		}
+	}
+
+	node := makeNode("rack1-node1", "zone-a")
+	reserved, err := cccController.reserveCIDRs(logger, node)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.10.1.0/24", "fd00:10::100/120"}, ipnetToStringList(reserved.allocatedCIDRs))
+
+	// Allocated.
+	expectNotFree(makeNode("rack2-node1", "zone-a"))
+	// In the supernet of zone-a.
+	expectNotFree(makeNode("rack1-node2", "zone-b"))
+
+	// Quarantined.
+	node.Spec.PodCIDRs = ipnetToStringList(reserved.allocatedCIDRs)
+	require.NoError(t, cccController.occupyCIDRs(logger, node))
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	expectNotFree(makeNode("rack2-node1", "zone-a"))
+}
+
+// Ensure a dual-stack ClusterCIDR with correlated indices allocates the IPv4
+// and IPv6 CIDRs at the same index and reports nodes breaking the pairing.
+func TestClusterCIDRCorrelatedIndices(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+
+	ccc := makeClusterCIDR("correlated", "10.11.0.0/16", "fd00:11::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.CorrelatedIndices = true
+	ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name string, podCIDRs ...string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}},
+			Spec:       corev1.NodeSpec{PodCIDRs: podCIDRs},
+		}
+	}
+
+	// The existing node breaks the pairing.
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-0", "10.11.0.0/24", "fd00:11::100/120")))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, cidrIndexMismatchReason)
+
+	// Index 0 is taken in IPv4 and index 1 in IPv6.
+	cidrs, _, err := cccController.prioritizedCIDRs(logger, makeNode("node-1"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.11.2.0/24", "fd00:11::200/120"}, ipnetToStringList(cidrs))
+
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-2", "10.11.3.0/24", "fd00:11::300/120")))
+	assert.Empty(t, recorder.Events)
+
+	// Correlated CIDRs all have the per node size.
+	sized := makeClusterCIDR("correlated-sized", "10.12.0.0/16", "fd00:12::/112", 8, nil)
+	sized.Spec.CorrelatedIndices = true
+	sized.Spec.MaxPerNodeHostBits = 10
+	_, err = cccController.createClusterCIDRSet(sized, false)
+	assert.Error(t, err)
+
+	// Correlated CIDRs are not aggregated into supernets.
+	aggregated := makeClusterCIDR("correlated-aggregated", "10.13.0.0/16", "fd00:13::/112", 8, nil)
+	aggregated.Spec.CorrelatedIndices = true
+	aggregated.Spec.Aggregation = &v1.Aggregation{TopologyKey: corev1.LabelTopologyZone, SupernetHostBits: 10}
+	_, err = cccController.createClusterCIDRSet(aggregated, false)
+	assert.Error(t, err)
+}
+
 // Ensure syncClusterCIDR for ClusterCIDR delete removes the ClusterCIDR.
 func TestSyncClusterCIDRDelete(t *testing.T) {
 	_, ctx := ktesting.NewTestContext(t)
@@ -1870,3 +2239,1272 @@ func makeNodeSelector(key string, op corev1.NodeSelectorOperator, values []strin
 func NoResyncPeriodFunc() time.Duration {
 	return 0
 }
+
+func TestClusterCIDRPrimaryIPFamily(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+	cccController.primaryIPFamily = corev1.IPv6Protocol
+
+	ipv4Primary := makeClusterCIDR("ipv4-primary", "10.12.0.0/16", "fd00:12::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ipv4Primary.Spec.PrimaryIPFamily = corev1.IPv4Protocol
+	controllerDefault := makeClusterCIDR("controller-default", "10.13.0.0/16", "fd00:13::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"baz"}))
+	for _, ccc := range []*v1.ClusterCIDR{ipv4Primary, controllerDefault} {
+		ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+		cccController.clusterCIDRStore.Add(ccc)
+		require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	}
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name, label string, podCIDRs ...string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": label}},
+			Spec:       corev1.NodeSpec{PodCIDRs: podCIDRs},
+		}
+	}
+
+	cidrs, clusterCIDR, err := cccController.prioritizedCIDRs(logger, makeNode("node-0", "bar"))
+	require.NoError(t, err)
+	assert.False(t, clusterCIDR.IPv6Primary)
+	assert.Equal(t, []string{"10.12.0.0/24", "fd00:12::/120"}, ipnetToStringList(orderByIPFamily(cidrs, clusterCIDR.IPv6Primary)))
+
+	cidrs, clusterCIDR, err = cccController.prioritizedCIDRs(logger, makeNode("node-1", "baz"))
+	require.NoError(t, err)
+	assert.True(t, clusterCIDR.IPv6Primary)
+	assert.Equal(t, []string{"fd00:13::/120", "10.13.0.0/24"}, ipnetToStringList(orderByIPFamily(cidrs, clusterCIDR.IPv6Primary)))
+
+	// Existing nodes keep their order, a mismatch is reported.
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-2", "bar", "10.12.1.0/24", "fd00:12::100/120")))
+	assert.Empty(t, recorder.Events)
+	require.NoError(t, cccController.occupyCIDRs(logger, makeNode("node-3", "baz", "10.13.1.0/24", "fd00:13::100/120")))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, ipFamilyOrderMismatchReason)
+}
+
+func TestClusterCIDRIPFamilies(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+
+	ccc := makeClusterCIDR("ip-families", "10.14.0.0/22", "fd00:14::/120", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.SingleStackFallback = true
+	ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name, families string) *corev1.Node {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}}}
+		if families != "" {
+			node.Annotations = map[string]string{v1.AnnotationIPFamilies: families}
+		}
+		return node
+	}
+
+	cidrs, _, err := cccController.prioritizedCIDRs(logger, makeNode("node-0", v1.IPFamiliesIPv4))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.14.0.0/24"}, ipnetToStringList(cidrs))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, singleStackRequestedReason)
+
+	cidrs, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-1", ""))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.14.1.0/24", "fd00:14::/120"}, ipnetToStringList(cidrs))
+	assert.Empty(t, recorder.Events)
+
+	// IPv6 is exhausted, the IPv4 CIDR of the failed dual-stack allocation is
+	// released before falling back to IPv4 only.
+	reserved, err := cccController.reserveCIDRs(logger, makeNode("node-2", v1.IPFamiliesDualStack))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.14.2.0/24"}, ipnetToStringList(reserved.allocatedCIDRs))
+	require.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, singleStackFallbackReason)
+	assert.Contains(t, event, "No free IPv6 CIDRs")
+
+	// No matching ClusterCIDR has free IPv6 CIDRs.
+	_, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-3", v1.IPFamiliesIPv6))
+	assert.Error(t, err)
+
+	// Label values are used without the annotation.
+	node := makeNode("node-4", "")
+	node.Labels[v1.LabelIPFamilies] = "IPv5"
+	_, _, err = cccController.prioritizedCIDRs(logger, node)
+	assert.Error(t, err)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, invalidIPFamiliesReason)
+}
+
+func TestClusterCIDRCombinedIPFamilies(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+
+	ipv4 := makeClusterCIDR("combined-ipv4", "10.15.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ipv6 := makeClusterCIDR("combined-ipv6", "", "fd00:15::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	for _, ccc := range []*v1.ClusterCIDR{ipv4, ipv6} {
+		ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+		cccController.clusterCIDRStore.Add(ccc)
+		require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	}
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name string, podCIDRs ...string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{"foo": "bar"},
+				Annotations: map[string]string{v1.AnnotationIPFamilies: v1.IPFamiliesDualStack},
+			},
+			Spec: corev1.NodeSpec{PodCIDRs: podCIDRs},
+		}
+	}
+
+	reserved, err := cccController.reserveCIDRs(logger, makeNode("node-0"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.15.0.0/24", "fd00:15::/120"}, ipnetToStringList(reserved.allocatedCIDRs))
+	assert.Equal(t, ipv4.Name, reserved.clusterCIDR.Name)
+	assert.Equal(t, ipv6.Name, reserved.ipv6ClusterCIDR.Name)
+
+	// Existing nodes are associated with the ClusterCIDR of each ip family.
+	node := makeNode("node-1", "10.15.1.0/24", "fd00:15::100/120")
+	require.NoError(t, cccController.occupyCIDRs(logger, node))
+	allocated, err := cccController.allocatedClusterCIDRs(node)
+	require.NoError(t, err)
+	assert.Equal(t, ipv4.Name, allocated.clusterCIDR.Name)
+	assert.Equal(t, ipv6.Name, allocated.ipv6ClusterCIDR.Name)
+	assert.True(t, allocated.clusterCIDR.AssociatedNodes[node.Name])
+	assert.True(t, allocated.ipv6ClusterCIDR.AssociatedNodes[node.Name])
+
+	// Each CIDR is released to its ClusterCIDR.
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	assert.False(t, allocated.clusterCIDR.IPv4CIDRSet.AllocatedCIDRMap["10.15.1.0/24"])
+	assert.False(t, allocated.ipv6ClusterCIDR.IPv6CIDRSet.AllocatedCIDRMap["fd00:15::100/120"])
+	assert.False(t, allocated.clusterCIDR.AssociatedNodes[node.Name])
+	assert.False(t, allocated.ipv6ClusterCIDR.AssociatedNodes[node.Name])
+
+	// Nodes not requesting ip families get the single ip family of the best
+	// ranked ClusterCIDR, combining is opt-in.
+	unlabelled := makeNode("node-2")
+	delete(unlabelled.Annotations, v1.AnnotationIPFamilies)
+	reserved, err = cccController.reserveCIDRs(logger, unlabelled)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fd00:15::100/120"}, ipnetToStringList(reserved.allocatedCIDRs))
+	assert.Equal(t, ipv6.Name, reserved.clusterCIDR.Name)
+	assert.Nil(t, reserved.ipv6ClusterCIDR)
+
+	// Nodes requesting dual-stack get both ip families.
+	reserved, err = cccController.reserveCIDRs(logger, makeNode("node-4"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.15.1.0/24", "fd00:15::200/120"}, ipnetToStringList(reserved.allocatedCIDRs))
+	assert.Equal(t, ipv4.Name, reserved.clusterCIDR.Name)
+	assert.Equal(t, ipv6.Name, reserved.ipv6ClusterCIDR.Name)
+
+	// The CIDR of the first ip family is released if the CIDR of the second
+	// one can not be occupied.
+	node = makeNode("node-3", "10.15.3.0/24", "fd00:99::/120")
+	clusterCIDRList, err := cccController.orderedMatchingClusterCIDRs(node, true)
+	require.NoError(t, err)
+	assert.False(t, cccController.occupyCombinedCIDRs(logger, clusterCIDRList, node))
+	assert.False(t, allocated.clusterCIDR.IPv4CIDRSet.AllocatedCIDRMap["10.15.3.0/24"])
+	assert.False(t, allocated.clusterCIDR.AssociatedNodes[node.Name])
+}
+
+func TestClusterCIDRNodeSizing(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	cccController.sizeByPodCapacity = true
+
+	small := makeClusterCIDR("sized-small", "10.16.0.0/25", "", 6, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	large := makeClusterCIDR("sized-large", "10.17.0.0/16", "", 9, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	for _, ccc := range []*v1.ClusterCIDR{small, large} {
+		ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+		cccController.clusterCIDRStore.Add(ccc)
+		require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	}
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name, maxPods string, capacity int64) *corev1.Node {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}}}
+		if maxPods != "" {
+			node.Annotations = map[string]string{v1.AnnotationMaxPods: maxPods}
+		}
+		if capacity > 0 {
+			node.Status.Capacity = corev1.ResourceList{corev1.ResourcePods: *resource.NewQuantity(capacity, resource.DecimalSI)}
+		}
+		return node
+	}
+
+	tests := []struct {
+		name         string
+		node         *corev1.Node
+		expectedCIDR string
+	}{
+		{
+			name:         "small node gets a /26",
+			node:         makeNode("edge-0", "30", 0),
+			expectedCIDR: "10.16.0.0/26",
+		},
+		{
+			name:         "pod capacity is used without the annotation",
+			node:         makeNode("edge-1", "", 32),
+			expectedCIDR: "10.16.0.64/26",
+		},
+		{
+			name:         "the annotation takes precedence over the pod capacity",
+			node:         makeNode("metal-0", "250", 30),
+			expectedCIDR: "10.17.0.0/23",
+		},
+		{
+			name:         "default sized node does not get an unnecessarily large CIDR",
+			node:         makeNode("node-0", "110", 0),
+			expectedCIDR: "192.168.0.0/24",
+		},
+		{
+			name:         "the next larger CIDR is used when the smallest is exhausted",
+			node:         makeNode("edge-2", "30", 0),
+			expectedCIDR: "192.168.1.0/24",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cidrs, _, err := cccController.prioritizedCIDRs(logger, tc.node)
+			require.NoError(t, err)
+			assert.Equal(t, []string{tc.expectedCIDR}, ipnetToStringList(cidrs))
+		})
+	}
+
+	_, _, err := cccController.prioritizedCIDRs(logger, makeNode("node-1", "many", 0))
+	assert.Error(t, err)
+	_, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-2", "1000", 0))
+	assert.Error(t, err, "no ClusterCIDR is large enough")
+}
+
+func TestClusterCIDRVariableBlockSizes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+
+	ccc := makeClusterCIDR("variable", "10.18.0.0/24", "", 4, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.MaxPerNodeHostBits = 7
+	ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name, maxPods string, podCIDRs ...string) *corev1.Node {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}},
+			Spec:       corev1.NodeSpec{PodCIDRs: podCIDRs},
+		}
+		if maxPods != "" {
+			node.Annotations = map[string]string{v1.AnnotationMaxPods: maxPods}
+		}
+		return node
+	}
+
+	cidrs, clusterCIDR, err := cccController.prioritizedCIDRs(logger, makeNode("node-0", "30"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.18.0.0/26"}, ipnetToStringList(cidrs))
+	assert.Equal(t, ccc.Name, clusterCIDR.Name)
+
+	cidrs, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-1", ""))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.18.0.64/28"}, ipnetToStringList(cidrs))
+
+	// Existing nodes keep their CIDRs of any size.
+	existing := makeNode("node-2", "", "10.18.0.128/25")
+	require.NoError(t, cccController.occupyCIDRs(logger, existing))
+	assert.True(t, clusterCIDR.AssociatedNodes[existing.Name])
+
+	// No free /26 is left, the next larger CIDR is used.
+	cidrs, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-3", "30"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.168.0.0/24"}, ipnetToStringList(cidrs))
+
+	// Releasing the /25 coalesces the free space.
+	require.NoError(t, cccController.ReleaseCIDR(logger, existing))
+	cidrs, _, err = cccController.prioritizedCIDRs(logger, makeNode("node-4", "60"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.18.0.128/25"}, ipnetToStringList(cidrs))
+}
+
+func TestClusterCIDRAdditionalPodCIDRs(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+
+	ccc := makeClusterCIDR("additional", "10.19.0.0/16", "fd00:19::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node-0",
+			Labels:      map[string]string{"foo": "bar"},
+			Annotations: map[string]string{v1.AnnotationAdditionalPodCIDRsCount: "2"},
+		},
+		Spec: corev1.NodeSpec{PodCIDRs: []string{"10.19.0.0/24", "fd00:19::/120"}},
+	}
+	node, err := cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	expected := []string{"10.19.1.0/24", "fd00:19::100/120", "10.19.2.0/24", "fd00:19::200/120"}
+	additional, err := additionalPodCIDRs(node)
+	require.NoError(t, err)
+	assert.Equal(t, expected, ipnetToStringList(additional))
+
+	// The published CIDRs satisfy the request.
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	additional, err = additionalPodCIDRs(node)
+	require.NoError(t, err)
+	assert.Equal(t, expected, ipnetToStringList(additional))
+
+	allocated, err := cccController.allocatedClusterCIDRs(node)
+	require.NoError(t, err)
+	for _, cidr := range expected {
+		_, ipNet, _ := utilnet.ParseCIDRSloppy(cidr)
+		cidrSet, _ := cccController.associatedCIDRSet(allocated.clusterCIDR, ipNet)
+		assert.True(t, cidrSet.AllocatedCIDRMap[cidr], "%s must be allocated", cidr)
+	}
+
+	// CIDRs of other nodes are rejected and not released with the node
+	// publishing them.
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+	other := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"foo": "bar"},
+			Annotations: map[string]string{
+				v1.AnnotationAdditionalPodCIDRs: `["10.19.0.0/24","10.19.1.0/24","10.19.0.0/23"]`,
+			},
+		},
+		Spec: corev1.NodeSpec{PodCIDRs: []string{"10.19.3.0/24", "fd00:19::300/120"}},
+	}
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, other))
+	require.Len(t, recorder.Events, 3)
+	for len(recorder.Events) > 0 {
+		assert.Contains(t, <-recorder.Events, invalidAdditionalPodCIDRsReason)
+	}
+	require.NoError(t, cccController.ReleaseCIDR(logger, other))
+	for _, cidr := range []string{"10.19.0.0/24", "10.19.1.0/24"} {
+		_, ipNet, _ := utilnet.ParseCIDRSloppy(cidr)
+		cidrSet, _ := cccController.associatedCIDRSet(allocated.clusterCIDR, ipNet)
+		assert.True(t, cidrSet.AllocatedCIDRMap[cidr], "%s must stay allocated", cidr)
+	}
+
+	// The requested count is bounded.
+	other.Annotations = map[string]string{v1.AnnotationAdditionalPodCIDRsCount: "17"}
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, other))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, invalidAdditionalPodCIDRsReason)
+
+	// The additional pod CIDRs are released with the node.
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	for _, cidr := range expected {
+		_, ipNet, _ := utilnet.ParseCIDRSloppy(cidr)
+		cidrSet, _ := cccController.associatedCIDRSet(allocated.clusterCIDR, ipNet)
+		assert.False(t, cidrSet.AllocatedCIDRMap[cidr], "%s must be released", cidr)
+	}
+}
+
+// Ensure pinned and requested CIDRs are allocated to their nodes only and
+// that conflicts are reported.
+func TestClusterCIDRPinnedReservations(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+
+	ccc := makeClusterCIDR("pinned", "10.20.0.0/16", "fd00:20::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.AllocationStrategy = v1.SequentialAllocationStrategy
+	ccc.Spec.Reservations = []v1.PinnedReservation{{NodeName: "gateway-0", PodCIDRs: []string{"10.20.0.0/24", "fd00:20::/120"}}}
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	makeNode := func(name string, annotations map[string]string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{"foo": "bar"},
+				Annotations: annotations,
+			},
+		}
+	}
+	allocate := func(node *corev1.Node) ([]string, error) {
+		reserved, ok, err := cccController.claimPinnedCIDRs(logger, node)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			reserved, err = cccController.reserveCIDRs(logger, node)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ipnetToStringList(reserved.allocatedCIDRs), nil
+	}
+
+	// Pinned CIDRs are not allocated to other nodes.
+	cidrs, err := allocate(makeNode("node-0", nil))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.20.1.0/24", "fd00:20::100/120"}, cidrs)
+
+	gateway := makeNode("gateway-0", nil)
+	cidrs, err = allocate(gateway)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.20.0.0/24", "fd00:20::/120"}, cidrs)
+	gateway.Spec.PodCIDRs = cidrs
+	require.NoError(t, cccController.occupyCIDRs(logger, gateway))
+
+	// Nodes may request exact CIDRs.
+	cidrs, err = allocate(makeNode("node-1", map[string]string{v1.AnnotationRequestedPodCIDRs: "10.20.7.0/24, fd00:20::700/120"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.20.7.0/24", "fd00:20::700/120"}, cidrs)
+	assert.Empty(t, recorder.Events)
+
+	testCases := []struct {
+		nodeName  string
+		requested string
+		reason    string
+	}{
+		{nodeName: "node-2", requested: "10.20.0.0/24", reason: pinnedCIDRTakenReason},
+		{nodeName: "node-3", requested: "10.20.7.0/24", reason: pinnedCIDRTakenReason},
+		{nodeName: "node-4", requested: "10.21.0.0/24", reason: pinnedCIDROutOfRangeReason},
+		{nodeName: "node-5", requested: "10.20.8.0/23", reason: pinnedCIDROutOfRangeReason},
+		{nodeName: "node-6", requested: "10.20.8.1/24", reason: invalidPinnedCIDRReason},
+		{nodeName: "node-7", requested: "10.20.8.0/24,10.20.9.0/24", reason: invalidPinnedCIDRReason},
+	}
+	for _, tc := range testCases {
+		_, err := allocate(makeNode(tc.nodeName, map[string]string{v1.AnnotationRequestedPodCIDRs: tc.requested}))
+		assert.Error(t, err, "node %s", tc.nodeName)
+		require.Len(t, recorder.Events, 1, "node %s", tc.nodeName)
+		assert.Contains(t, <-recorder.Events, tc.reason, "node %s", tc.nodeName)
+	}
+
+	// Pinned CIDRs stay occupied when the node is deleted.
+	require.NoError(t, cccController.ReleaseCIDR(logger, gateway))
+	nodeSelectorKey, _ := cccController.nodeSelectorKey(ccc)
+	clusterCIDR := cccController.cidrMap[nodeSelectorKey][0]
+	assert.True(t, clusterCIDR.IPv4CIDRSet.AllocatedCIDRMap["10.20.0.0/24"])
+	assert.True(t, clusterCIDR.IPv6CIDRSet.AllocatedCIDRMap["fd00:20::/120"])
+
+	// A node holding a pinned CIDR takes the reservation.
+	conflicting := makeNode("node-8", nil)
+	conflicting.Spec.PodCIDRs = []string{"10.20.0.0/24", "fd00:20::/120"}
+	require.NoError(t, cccController.occupyCIDRs(logger, conflicting))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, pinnedCIDRConflictReason)
+	_, ok, err := cccController.claimPinnedCIDRs(logger, gateway)
+	assert.False(t, ok)
+	assert.Error(t, err)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, pinnedCIDRTakenReason)
+}
+
+// Ensure nodes are held at the allocation gate until they have the label or
+// the gate times out.
+func TestClusterCIDRAllocationGate(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	cccController.clock = fakeClock
+	cccController.allocationGate = AllocationGate{Label: "pool", Timeout: time.Minute}
+
+	logger := klog.FromContext(ctx)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "node-0",
+			CreationTimestamp: metav1.NewTime(fakeClock.Now()),
+		},
+	}
+
+	assert.True(t, cccController.holdAtGate(logger, node))
+	assert.True(t, cccController.holdAtGate(logger, node))
+	assert.Equal(t, map[string]bool{"node-0": true}, cccController.gatedNodes)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, allocationGatedReason)
+
+	// The label opens the gate.
+	labelled := node.DeepCopy()
+	labelled.Labels = map[string]string{"pool": "gpu"}
+	assert.False(t, cccController.holdAtGate(logger, labelled))
+	assert.Empty(t, cccController.gatedNodes)
+
+	// The gate opens once it times out.
+	assert.True(t, cccController.holdAtGate(logger, node))
+	fakeClock.SetTime(fakeClock.Now().Add(time.Minute))
+	assert.False(t, cccController.holdAtGate(logger, node))
+	assert.Empty(t, cccController.gatedNodes)
+
+	// Released nodes are removed from the gate.
+	node.Name = "node-1"
+	node.CreationTimestamp = metav1.NewTime(fakeClock.Now())
+	assert.True(t, cccController.holdAtGate(logger, node))
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	assert.Empty(t, cccController.gatedNodes)
+}
+
+// Ensure the startup taint is removed together with setting the PodCIDRs and
+// stays with a condition if no PodCIDRs are available.
+func TestClusterCIDRStartupTaint(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	cccController.startupTaintKey = "networking.x-k8s.io/pod-cidr-unassigned"
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cccController.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+	// Nodes must not fall back to the default ClusterCIDR.
+	defaultNodeSelectorKey, err := cccController.nodeSelectorKey(makeClusterCIDR(defaultClusterCIDRName, "192.168.0.0/16", "", 8, nil))
+	require.NoError(t, err)
+	delete(cccController.cidrMap, defaultNodeSelectorKey)
+
+	ccc := makeClusterCIDR("tainted", "10.21.0.0/24", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	createNode := func(name string) *corev1.Node {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{"foo": "bar"}},
+			Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+				{Key: "node.kubernetes.io/not-ready", Effect: corev1.TaintEffectNoSchedule},
+				{Key: cccController.startupTaintKey, Effect: corev1.TaintEffectNoSchedule},
+			}},
+		}
+		node, err := cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+		require.NoError(t, err)
+		require.NoError(t, nodeIndexer.Add(node))
+		return node
+	}
+
+	node := createNode("node-0")
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.21.0.0/24"}, node.Spec.PodCIDRs)
+	assert.Equal(t, []corev1.Taint{{Key: "node.kubernetes.io/not-ready", Effect: corev1.TaintEffectNoSchedule}}, node.Spec.Taints)
+
+	// The ClusterCIDR is exhausted.
+	node = createNode("node-1")
+	assert.Error(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, node.Spec.PodCIDRs)
+	assert.Len(t, node.Spec.Taints, 2)
+	require.Len(t, node.Status.Conditions, 1)
+	assert.Equal(t, podCIDRAllocatedCondition, node.Status.Conditions[0].Type)
+	assert.Equal(t, corev1.ConditionFalse, node.Status.Conditions[0].Status)
+	assert.Equal(t, clusterCIDRExhaustedReason, node.Status.Conditions[0].Reason)
+}
+
+// Ensure the PodCIDRAllocated node condition reports the allocation state.
+func TestClusterCIDRNodeCondition(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cccController.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+	defaultNodeSelectorKey, err := cccController.nodeSelectorKey(makeClusterCIDR(defaultClusterCIDRName, "192.168.0.0/16", "", 8, nil))
+	require.NoError(t, err)
+	delete(cccController.cidrMap, defaultNodeSelectorKey)
+
+	ccc := makeClusterCIDR("condition", "10.22.0.0/24", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	allocate := func(name string, labels map[string]string) corev1.NodeCondition {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+		node, err := cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+		require.NoError(t, err)
+		require.NoError(t, nodeIndexer.Add(node))
+		_ = cccController.AllocateOrOccupyCIDR(logger, node)
+
+		node, err = cccController.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Len(t, node.Status.Conditions, 1)
+		assert.Equal(t, podCIDRAllocatedCondition, node.Status.Conditions[0].Type)
+		return node.Status.Conditions[0]
+	}
+
+	condition := allocate("node-0", map[string]string{"foo": "bar"})
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+	assert.Equal(t, podCIDRAllocatedReason, condition.Reason)
+	assert.Equal(t, "PodCIDRs [10.22.0.0/24] allocated from ClusterCIDR condition", condition.Message)
+
+	condition = allocate("node-1", map[string]string{"foo": "bar"})
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, clusterCIDRExhaustedReason, condition.Reason)
+
+	condition = allocate("node-2", nil)
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, noMatchingClusterCIDRReason, condition.Reason)
+
+	// Nodes with PodCIDRs report the ClusterCIDR they are allocated from.
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-3", Labels: map[string]string{"foo": "bar"}},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"10.22.0.0/24"}},
+	}
+	node, err = cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, node.Status.Conditions, 1)
+	assert.Equal(t, corev1.ConditionTrue, node.Status.Conditions[0].Status)
+}
+
+// Ensure nodes whose labels no longer match the ClusterCIDR of their PodCIDRs
+// best are reported.
+func TestClusterCIDRDrift(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+
+	ccc := makeClusterCIDR("drift-a", "10.23.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-0", Labels: map[string]string{"foo": "bar"}},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"10.23.0.0/24"}},
+	}
+	node, err := cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	require.NoError(t, err)
+	sync := func(labels map[string]string) *corev1.Node {
+		node.Labels = labels
+		_ = cccController.AllocateOrOccupyCIDR(logger, node)
+		node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return node
+	}
+	driftCondition := func(node *corev1.Node) *corev1.NodeCondition {
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == clusterCIDRDriftCondition {
+				return &condition
+			}
+		}
+		return nil
+	}
+
+	node = sync(map[string]string{"foo": "bar"})
+	assert.Nil(t, driftCondition(node))
+	assert.Empty(t, cccController.driftedNodes)
+
+	// A ClusterCIDR with more matching labels takes precedence.
+	zonal := makeClusterCIDR("drift-b", "10.24.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	zonal.Spec.NodeSelector.NodeSelectorTerms[0].MatchExpressions = append(zonal.Spec.NodeSelector.NodeSelectorTerms[0].MatchExpressions,
+		corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}})
+	cccController.clusterCIDRStore.Add(zonal)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, zonal.Name))
+
+	node = sync(map[string]string{"foo": "bar", "zone": "a"})
+	require.NotNil(t, driftCondition(node))
+	assert.Equal(t, corev1.ConditionTrue, driftCondition(node).Status)
+	assert.Equal(t, higherPriorityMatchReason, driftCondition(node).Reason)
+	assert.Equal(t, map[string]bool{"node-0": true}, cccController.driftedNodes)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, clusterCIDRDriftReason)
+
+	node = sync(map[string]string{"foo": "baz"})
+	assert.Equal(t, ownerNoLongerMatchesReason, driftCondition(node).Reason)
+	// The event is recorded once per drift.
+	for len(recorder.Events) > 0 {
+		assert.NotContains(t, <-recorder.Events, clusterCIDRDriftReason)
+	}
+
+	node = sync(map[string]string{"foo": "bar"})
+	assert.Equal(t, corev1.ConditionFalse, driftCondition(node).Status)
+	assert.Empty(t, cccController.driftedNodes)
+
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	assert.Empty(t, cccController.driftedNodes)
+
+	// Nodes of a ClusterCIDR without a node selector match it.
+	catchAll := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"foo": "baz"}},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"192.168.0.0/24"}},
+	}
+	catchAll, err = cccController.client.CoreV1().Nodes().Create(ctx, catchAll, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, catchAll))
+	catchAll, err = cccController.client.CoreV1().Nodes().Get(ctx, catchAll.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, driftCondition(catchAll))
+	assert.Empty(t, cccController.driftedNodes)
+}
+
+// Ensure draining ClusterCIDRs do not allocate CIDRs to new nodes, publish
+// their remaining nodes and apply the drain policy to them.
+func TestClusterCIDRDrain(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client, cccController := newController(ctx)
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cccController.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+
+	ccc := makeClusterCIDR("draining", "10.25.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	logger := klog.FromContext(ctx)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-0", Labels: map[string]string{"foo": "bar"}},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"10.25.0.0/24"}},
+	}
+	node, err := cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, nodeIndexer.Add(node))
+	require.NoError(t, cccController.occupyCIDRs(logger, node))
+
+	setDrain := func(value *string) *v1.ClusterCIDR {
+		clusterCIDR, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		delete(clusterCIDR.Annotations, v1.AnnotationDrain)
+		if value != nil {
+			metav1.SetMetaDataAnnotation(&clusterCIDR.ObjectMeta, v1.AnnotationDrain, *value)
+		}
+		require.NoError(t, cccController.clusterCIDRStore.Update(clusterCIDR))
+		require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+		clusterCIDR, err = client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return clusterCIDR
+	}
+	refreshNode := func() {
+		node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NoError(t, nodeIndexer.Update(node))
+	}
+
+	policy := v1.DrainActionCordon + "," + v1.DrainActionTaint
+	clusterCIDR := setDrain(&policy)
+	assert.Equal(t, []string{"node-0"}, clusterCIDR.Status.DrainingNodes)
+	refreshNode()
+	assert.True(t, node.Spec.Unschedulable)
+	assert.Equal(t, []corev1.Taint{{Key: v1.TaintClusterCIDRDraining, Value: ccc.Name, Effect: corev1.TaintEffectNoSchedule}}, node.Spec.Taints)
+
+	// New nodes are allocated from the next ClusterCIDR.
+	_, allocated, err := cccController.prioritizedCIDRs(logger, &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"foo": "bar"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, defaultClusterCIDRName, allocated.Name)
+
+	// The taint is removed once the ClusterCIDR is no longer draining.
+	clusterCIDR = setDrain(nil)
+	assert.Empty(t, clusterCIDR.Status.DrainingNodes)
+	refreshNode()
+	assert.True(t, node.Spec.Unschedulable)
+	assert.Empty(t, node.Spec.Taints)
+
+	// Deleted nodes are removed from the status.
+	empty := ""
+	clusterCIDR = setDrain(&empty)
+	assert.Equal(t, []string{"node-0"}, clusterCIDR.Status.DrainingNodes)
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	clusterCIDR, err = client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, clusterCIDR.Status.DrainingNodes)
+}
+
+// Ensure a node whose CIDRs are pinned by a paused ClusterCIDR is held until
+// the ClusterCIDR is unpaused instead of being allocated other CIDRs.
+func TestClusterCIDRPinnedReservationPaused(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client, cccController := newController(ctx)
+	recorder := record.NewFakeRecorder(10)
+	cccController.recorder = recorder
+	logger := klog.FromContext(ctx)
+
+	ccc := makeClusterCIDR("pinned-paused", "10.27.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.Reservations = []v1.PinnedReservation{{NodeName: "gateway-0", PodCIDRs: []string{"10.27.0.0/24"}}}
+	ccc.Spec.AllocationPaused = true
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "gateway-0", Labels: map[string]string{"foo": "bar"}}}
+	node, err := cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	require.NoError(t, err)
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, nodeIndexer.Add(node))
+	cccController.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, node.Spec.PodCIDRs, "held node must not be allocated other CIDRs")
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, pinnedClusterCIDRUnavailableReason)
+
+	// The node is requeued once the ClusterCIDR is unpaused.
+	clusterCIDR, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	clusterCIDR.Spec.AllocationPaused = false
+	clusterCIDR, err = client.NetworkingV1().ClusterCIDRs().Update(ctx, clusterCIDR, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, cccController.clusterCIDRStore.Update(clusterCIDR))
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	require.Equal(t, 1, cccController.nodeQueue.Len())
+	key, _ := cccController.nodeQueue.Get()
+	assert.Equal(t, node.Name, key)
+	cccController.nodeQueue.Done(key)
+
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.27.0.0/24"}, node.Spec.PodCIDRs)
+}
+
+// Ensure pinned CIDRs stay occupied when the node patch fails.
+func TestClusterCIDRPinnedReservationPatchFailed(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	cccController.recorder = record.NewFakeRecorder(10)
+	logger := klog.FromContext(ctx)
+
+	ccc := makeClusterCIDR("pinned-patch", "10.28.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.Reservations = []v1.PinnedReservation{{NodeName: "gateway-0", PodCIDRs: []string{"10.28.0.0/24"}}}
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "gateway-0", Labels: map[string]string{"foo": "bar"}}}
+	node, err := cccController.client.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	require.NoError(t, err)
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	require.NoError(t, nodeIndexer.Add(node))
+	cccController.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+
+	failPatch := true
+	cccController.client.(*fake.Clientset).PrependReactor("patch", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return failPatch, nil, errors.New("patch failed")
+	})
+	assert.Error(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	nodeSelectorKey, _ := cccController.nodeSelectorKey(ccc)
+	clusterCIDR := cccController.cidrMap[nodeSelectorKey][0]
+	assert.True(t, clusterCIDR.IPv4CIDRSet.AllocatedCIDRMap["10.28.0.0/24"], "pinned CIDR must stay occupied")
+
+	failPatch = false
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	node, err = cccController.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.28.0.0/24"}, node.Spec.PodCIDRs)
+}
+
+// Ensure paused ClusterCIDRs do not allocate CIDRs to new nodes while still
+// occupying and releasing the CIDRs of existing nodes, and that the pause
+// survives a controller restart.
+func TestClusterCIDRAllocationPaused(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client, cccController := newController(ctx)
+	logger := klog.FromContext(ctx)
+
+	ccc := makeClusterCIDR("paused", "10.26.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	updateSpec := func(update func(spec *v1.ClusterCIDRSpec)) *v1.ClusterCIDR {
+		clusterCIDR, err := client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		update(&clusterCIDR.Spec)
+		clusterCIDR, err = client.NetworkingV1().ClusterCIDRs().Update(ctx, clusterCIDR, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		require.NoError(t, cccController.clusterCIDRStore.Update(clusterCIDR))
+		require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+		clusterCIDR, err = client.NetworkingV1().ClusterCIDRs().Get(ctx, ccc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return clusterCIDR
+	}
+	allocatedFrom := func(nodeName string) string {
+		_, clusterCIDR, err := cccController.prioritizedCIDRs(logger, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeName, Labels: map[string]string{"foo": "bar"}},
+		})
+		require.NoError(t, err)
+		return clusterCIDR.Name
+	}
+	existingNode := func(nodeName, podCIDR string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: nodeName, Labels: map[string]string{"foo": "bar"}},
+			Spec:       corev1.NodeSpec{PodCIDRs: []string{podCIDR}},
+		}
+	}
+	restart := func(clusterCIDR *v1.ClusterCIDR) *multicidrset.ClusterCIDR {
+		key, err := cccController.nodeSelectorKey(clusterCIDR)
+		require.NoError(t, err)
+		delete(cccController.cidrMap, key)
+		// Objects of the fake client have no resource version.
+		clusterCIDR = clusterCIDR.DeepCopy()
+		clusterCIDR.ResourceVersion = "1"
+		require.NoError(t, cccController.reconcileBootstrap(ctx, clusterCIDR))
+		clusterCIDRSet, err := cccController.clusterCIDRSet(clusterCIDR)
+		require.NoError(t, err)
+		return clusterCIDRSet
+	}
+
+	node0 := existingNode("node-0", "10.26.0.0/24")
+	require.NoError(t, cccController.occupyCIDRs(logger, node0))
+	assert.Equal(t, ccc.Name, allocatedFrom("node-1"))
+
+	clusterCIDR := updateSpec(func(spec *v1.ClusterCIDRSpec) { spec.AllocationPaused = true })
+	assert.True(t, clusterCIDR.Status.AllocationPaused)
+	assert.Equal(t, clusterCIDR.Generation, clusterCIDR.Status.ObservedGeneration)
+	assert.Equal(t, defaultClusterCIDRName, allocatedFrom("node-1"))
+
+	// Existing nodes are still occupied and released.
+	node2 := existingNode("node-2", "10.26.2.0/24")
+	require.NoError(t, cccController.occupyCIDRs(logger, node2))
+	require.NoError(t, cccController.ReleaseCIDR(logger, node0))
+	clusterCIDRSet, err := cccController.clusterCIDRSet(clusterCIDR)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"node-2": true}, clusterCIDRSet.AssociatedNodes)
+
+	// The paused ClusterCIDR is not terminated on restart.
+	clusterCIDRSet = restart(clusterCIDR)
+	assert.False(t, clusterCIDRSet.Terminating)
+	assert.True(t, clusterCIDRSet.AllocationPaused)
+	assert.Equal(t, defaultClusterCIDRName, allocatedFrom("node-1"))
+
+	clusterCIDR = updateSpec(func(spec *v1.ClusterCIDRSpec) { spec.AllocationPaused = false })
+	assert.False(t, clusterCIDR.Status.AllocationPaused)
+	assert.Equal(t, ccc.Name, allocatedFrom("node-1"))
+
+	// A ClusterCIDR paused while the controller is down is not terminated on
+	// restart.
+	clusterCIDR.Spec.AllocationPaused = true
+	clusterCIDR, err = client.NetworkingV1().ClusterCIDRs().Update(ctx, clusterCIDR, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NotEqual(t, clusterCIDR.Generation, clusterCIDR.Status.ObservedGeneration)
+	clusterCIDRSet = restart(clusterCIDR)
+	assert.False(t, clusterCIDRSet.Terminating)
+	assert.True(t, clusterCIDRSet.AllocationPaused)
+	clusterCIDR = updateSpec(func(spec *v1.ClusterCIDRSpec) { spec.AllocationPaused = false })
+	assert.Equal(t, clusterCIDR.Generation, clusterCIDR.Status.ObservedGeneration)
+
+	// Changes of immutable fields are not observed and terminate the
+	// ClusterCIDR on restart.
+	observedGeneration := clusterCIDR.Status.ObservedGeneration
+	specHash := clusterCIDR.Status.SpecHash
+	clusterCIDR = updateSpec(func(spec *v1.ClusterCIDRSpec) { spec.PerNodeHostBits = 10 })
+	assert.Equal(t, observedGeneration, clusterCIDR.Status.ObservedGeneration)
+	assert.Equal(t, specHash, clusterCIDR.Status.SpecHash)
+	clusterCIDRSet = restart(clusterCIDR)
+	assert.True(t, clusterCIDRSet.Terminating)
+	assert.Equal(t, observedGeneration, clusterCIDRSet.ObservedGeneration)
+	assert.Equal(t, specHash, clusterCIDRSet.SpecHash)
+}
+
+// Ensure the explanation ranks the matching ClusterCIDRs like the allocation
+// and lists the ClusterCIDRs not matching the node.
+func TestClusterCIDRExplain(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cccController.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+	logger := klog.FromContext(ctx)
+
+	for _, ccc := range []*v1.ClusterCIDR{
+		makeClusterCIDR("explain-large", "10.27.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})),
+		makeClusterCIDR("explain-small", "10.28.0.0/24", "", 4, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"})),
+		makeClusterCIDR("explain-other", "10.29.0.0/16", "", 8, makeNodeSelector("other", corev1.NodeSelectorOpIn, []string{"bar"})),
+	} {
+		cccController.clusterCIDRStore.Add(ccc)
+		require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-0", Labels: map[string]string{"foo": "bar"}},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"10.27.0.0/24"}},
+	}
+	require.NoError(t, nodeIndexer.Add(node))
+	require.NoError(t, cccController.occupyCIDRs(logger, node))
+
+	type ranking struct {
+		name       string
+		matched    bool
+		matchCount int
+		free       int
+		rank       int
+	}
+	expected := []ranking{
+		{name: "explain-small", matched: true, matchCount: 1, free: 16, rank: 1},
+		{name: "explain-large", matched: true, matchCount: 1, free: 255, rank: 2},
+		{name: defaultClusterCIDRName, matched: true, matchCount: 0, free: 256, rank: 3},
+		{name: "explain-other", matched: false, matchCount: 0, free: 256, rank: 0},
+	}
+
+	explanation, err := cccController.Explain("node-0", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"explain-large"}, explanation.CurrentClusterCIDRs)
+	var got []ranking
+	for _, clusterCIDR := range explanation.ClusterCIDRs {
+		got = append(got, ranking{clusterCIDR.Name, clusterCIDR.Matched, clusterCIDR.MatchCount, clusterCIDR.Free, clusterCIDR.Rank})
+	}
+	assert.Equal(t, expected, got)
+	assert.Equal(t, 16, explanation.ClusterCIDRs[0].MaxAllocatable)
+	assert.Equal(t, 28, explanation.ClusterCIDRs[0].NodeMaskSize)
+	assert.Equal(t, "10.28.0.0/24", explanation.ClusterCIDRs[0].CIDR)
+
+	// The explain endpoint explains nodes given by their labels.
+	server := httptest.NewServer(NewExplainHandler(cccController))
+	defer server.Close()
+	for query, status := range map[string]int{
+		"":                     http.StatusBadRequest,
+		"node=node-0&labels=a": http.StatusBadRequest,
+		"labels=foo%3D%3D":     http.StatusBadRequest,
+		"node=node-1":          http.StatusNotFound,
+		"labels=other%3Dbar":   http.StatusOK,
+	} {
+		resp, err := http.Get(server.URL + "?" + query)
+		require.NoError(t, err)
+		assert.Equal(t, status, resp.StatusCode, query)
+		if status == http.StatusOK {
+			explanation := &Explanation{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(explanation))
+			require.NotEmpty(t, explanation.ClusterCIDRs)
+			assert.Equal(t, "explain-other", explanation.ClusterCIDRs[0].Name)
+			assert.Equal(t, 1, explanation.ClusterCIDRs[0].Rank)
+			assert.Equal(t, map[string]string{"other": "bar"}, explanation.Labels)
+		}
+		resp.Body.Close()
+	}
+}
+
+// Ensure the state snapshot lists the tracked ClusterCIDRs and pages their
+// allocated CIDRs.
+func TestClusterCIDRState(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	logger := klog.FromContext(ctx)
+
+	ccc := makeClusterCIDR("state", "10.30.0.0/16", "fd00:30::/112", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	for i, podCIDRs := range [][]string{
+		{"10.30.1.0/24", "fd00:30::100/120"},
+		{"10.30.0.0/24", "fd00:30::/120"},
+	} {
+		require.NoError(t, cccController.occupyCIDRs(logger, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node-%d", i), Labels: map[string]string{"foo": "bar"}},
+			Spec:       corev1.NodeSpec{PodCIDRs: podCIDRs},
+		}))
+	}
+
+	state, err := cccController.State(0, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "3", state.Continue)
+	require.Len(t, state.NodeSelectors, 2)
+	var clusterCIDR ClusterCIDRState
+	for _, selectorState := range state.NodeSelectors {
+		for _, clusterCIDRState := range selectorState.ClusterCIDRs {
+			if clusterCIDRState.Name == ccc.Name {
+				clusterCIDR = clusterCIDRState
+			}
+		}
+	}
+	assert.Equal(t, []string{"node-0", "node-1"}, clusterCIDR.AssociatedNodes)
+	require.NotNil(t, clusterCIDR.IPv4)
+	require.NotNil(t, clusterCIDR.IPv6)
+	assert.Equal(t, CIDRSetState{
+		CIDR:           "10.30.0.0/16",
+		NodeMaskSize:   24,
+		Strategy:       "RoundRobin",
+		MaxCIDRs:       256,
+		Allocated:      2,
+		Free:           254,
+		AllocatedCIDRs: []string{"10.30.0.0/24", "10.30.1.0/24"},
+	}, *clusterCIDR.IPv4)
+	assert.Equal(t, []string{"fd00:30::/120"}, clusterCIDR.IPv6.AllocatedCIDRs)
+
+	// The next page continues with the remaining allocated CIDRs.
+	state, err = cccController.State(3, 3)
+	require.NoError(t, err)
+	assert.Empty(t, state.Continue)
+	for _, selectorState := range state.NodeSelectors {
+		for _, clusterCIDRState := range selectorState.ClusterCIDRs {
+			if clusterCIDRState.Name == ccc.Name {
+				assert.Empty(t, clusterCIDRState.IPv4.AllocatedCIDRs)
+				assert.Equal(t, []string{"fd00:30::100/120"}, clusterCIDRState.IPv6.AllocatedCIDRs)
+			}
+		}
+	}
+
+	blocks, err := cccController.FreeBlocks(ccc.Name, 2)
+	require.NoError(t, err)
+	var freeBlocks []string
+	for _, block := range blocks {
+		freeBlocks = append(freeBlocks, block.String())
+	}
+	assert.Equal(t, []string{"10.30.128.0/17", "10.30.64.0/18", "fd00:30::8000/113", "fd00:30::4000/114"}, freeBlocks)
+	_, err = cccController.FreeBlocks("unknown", 2)
+	assert.Error(t, err)
+
+	server := httptest.NewServer(NewStateHandler(cccController))
+	defer server.Close()
+	for query, status := range map[string]int{
+		"limit=0":      http.StatusBadRequest,
+		"continue=-1":  http.StatusBadRequest,
+		"limit=1":      http.StatusOK,
+		"continue=100": http.StatusOK,
+	} {
+		resp, err := http.Get(server.URL + "?" + query)
+		require.NoError(t, err)
+		assert.Equal(t, status, resp.StatusCode, query)
+		resp.Body.Close()
+	}
+}
+
+// Ensure addresses are looked up in the allocated, reserved, free and service
+// CIDRs.
+func TestClusterCIDRWhois(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, cccController := newController(ctx)
+	logger := klog.FromContext(ctx)
+
+	ccc := makeClusterCIDR("whois", "10.31.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.Spec.Reservations = []v1.PinnedReservation{{NodeName: "pinned-0", PodCIDRs: []string{"10.31.5.0/24"}}}
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-0", Labels: map[string]string{"foo": "bar"}},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"10.31.1.0/24"}},
+	}
+	require.NoError(t, cccController.occupyCIDRs(logger, node))
+
+	testCases := []struct {
+		address  string
+		expected WhoisResult
+	}{{
+		address:  "10.31.1.7",
+		expected: WhoisResult{Address: "10.31.1.7/32", Status: WhoisAllocated, ClusterCIDR: "whois", Range: "10.31.0.0/16", Block: "10.31.1.0/24", Node: "node-0"},
+	}, {
+		address:  "10.31.1.64/26",
+		expected: WhoisResult{Address: "10.31.1.64/26", Status: WhoisAllocated, ClusterCIDR: "whois", Range: "10.31.0.0/16", Block: "10.31.1.0/24", Node: "node-0"},
+	}, {
+		address:  "10.31.2.1",
+		expected: WhoisResult{Address: "10.31.2.1/32", Status: WhoisFree, ClusterCIDR: "whois", Range: "10.31.0.0/16", Block: "10.31.2.0/24"},
+	}, {
+		address: "10.31.5.1",
+		expected: WhoisResult{Address: "10.31.5.1/32", Status: WhoisReserved, ClusterCIDR: "whois", Range: "10.31.0.0/16", Block: "10.31.5.0/24", Node: "pinned-0",
+			Message: "pinned to node pinned-0 by ClusterCIDR whois"},
+	}, {
+		address:  "10.1.2.3",
+		expected: WhoisResult{Address: "10.1.2.3/32", Status: WhoisServiceRange, ServiceCIDR: "10.1.0.0/16"},
+	}, {
+		address:  "172.16.0.1",
+		expected: WhoisResult{Address: "172.16.0.1/32", Status: WhoisOutsidePools},
+	}}
+	for _, tc := range testCases {
+		result, err := cccController.Whois(tc.address)
+		require.NoError(t, err, tc.address)
+		assert.Equal(t, tc.expected, *result, tc.address)
+	}
+
+	for _, address := range []string{"foo", "10.31.0.0/16"} {
+		_, err := cccController.Whois(address)
+		assert.Error(t, err, address)
+	}
+
+	// The address is free once the node is deleted.
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	result, err := cccController.Whois("10.31.1.7")
+	require.NoError(t, err)
+	assert.Equal(t, WhoisFree, result.Status)
+	assert.Empty(t, result.Node)
+
+	server := httptest.NewServer(NewWhoisHandler(cccController))
+	defer server.Close()
+	for query, status := range map[string]int{
+		"":                   http.StatusBadRequest,
+		"address=foo":        http.StatusBadRequest,
+		"address=10.31.1.7":  http.StatusOK,
+		"address=fd00%3A%3A": http.StatusOK,
+	} {
+		resp, err := http.Get(server.URL + "?" + query)
+		require.NoError(t, err)
+		assert.Equal(t, status, resp.StatusCode, query)
+		resp.Body.Close()
+	}
+}
+
+// Ensure the dry-run mode does not write to the API server and keeps the
+// in-memory state coherent.
+func TestClusterCIDRDryRun(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client, cccController := newController(ctx)
+	cccController.dryRun = true
+	recorder := record.NewFakeRecorder(100)
+	cccController.recorder = recorder
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cccController.nodeLister = corelisters.NewNodeLister(nodeIndexer)
+	nodeClient := cccController.client.(*fake.Clientset)
+
+	ccc := makeClusterCIDR("dry-run", "10.32.0.0/16", "", 8, makeNodeSelector("foo", corev1.NodeSelectorOpIn, []string{"bar"}))
+	ccc.ResourceVersion = "1"
+	_, err := client.NetworkingV1().ClusterCIDRs().Create(ctx, ccc, metav1.CreateOptions{})
+	require.NoError(t, err)
+	client.ClearActions()
+	cccController.clusterCIDRStore.Add(ccc)
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	for _, action := range client.Actions() {
+		assert.Failf(t, "unexpected ClusterCIDR write", "%s %s", action.GetVerb(), action.GetResource().Resource)
+	}
+
+	logger := klog.FromContext(ctx)
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-0", Labels: map[string]string{"foo": "bar"}}}
+	node, err = nodeClient.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, nodeIndexer.Add(node))
+	nodeClient.ClearActions()
+
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	for _, action := range nodeClient.Actions() {
+		assert.NotEqual(t, "patch", action.GetVerb(), "unexpected node patch")
+	}
+	podCIDRs := cccController.dryRunPodCIDRs[node.Name]
+	require.Len(t, podCIDRs, 1)
+	result, err := cccController.Whois(podCIDRs[0])
+	require.NoError(t, err)
+	assert.Equal(t, WhoisAllocated, result.Status)
+	assert.Equal(t, node.Name, result.Node)
+	assert.Equal(t, ccc.Name, result.ClusterCIDR)
+
+	// The node is not allocated PodCIDRs again on the next sync.
+	require.NoError(t, cccController.AllocateOrOccupyCIDR(logger, node))
+	assert.Equal(t, podCIDRs, cccController.dryRunPodCIDRs[node.Name])
+	state, err := cccController.State(0, -1)
+	require.NoError(t, err)
+	for _, selectorState := range state.NodeSelectors {
+		for _, clusterCIDRState := range selectorState.ClusterCIDRs {
+			if clusterCIDRState.Name == ccc.Name {
+				assert.Equal(t, podCIDRs, clusterCIDRState.IPv4.AllocatedCIDRs)
+			}
+		}
+	}
+
+	var dryRunEvents int
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.Contains(event, dryRunReason) {
+			dryRunEvents++
+		}
+	}
+	assert.Positive(t, dryRunEvents)
+
+	// The PodCIDRs are released with the node and the ClusterCIDR deleted
+	// from the API server is released.
+	require.NoError(t, cccController.ReleaseCIDR(logger, node))
+	assert.Empty(t, cccController.dryRunPodCIDRs)
+	require.NoError(t, cccController.clusterCIDRStore.Delete(ccc))
+	require.NoError(t, cccController.syncClusterCIDR(ctx, ccc.Name))
+	assert.NotContains(t, cccController.clusterCIDRSpecs, ccc.Name)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addressesPerPod is the number of addresses in a node CIDR per pod, which
+// leaves room for pod IPs that are not yet reused after a pod is deleted.
+// It matches the default of 110 pods per /24 node CIDR.
+const addressesPerPod = 2
+
+// nodeHostBits returns the per node host bits of the ClusterCIDR.
+func nodeHostBits(clusterCIDR *cidrset.ClusterCIDR) int {
+	if clusterCIDR.IPv4CIDRSet != nil {
+		return 32 - clusterCIDR.IPv4CIDRSet.NodeMaskSize
+	}
+	return 128 - clusterCIDR.IPv6CIDRSet.NodeMaskSize
+}
+
+// fitHostBits returns the host bits of the node CIDR with the required host
+// bits allocated from the ClusterCIDR, false if the per node CIDRs of the
+// ClusterCIDR are too small.
+func fitHostBits(clusterCIDR *cidrset.ClusterCIDR, required int) (int, bool) {
+	minHostBits := nodeHostBits(clusterCIDR)
+	maxHostBits := clusterCIDR.MaxNodeHostBits
+	if maxHostBits == 0 {
+		maxHostBits = minHostBits
+	}
+
+	switch {
+	case required > maxHostBits:
+		return 0, false
+	case required < minHostBits:
+		return minHostBits, true
+	default:
+		return required, true
+	}
+}
+
+// blockHostBits returns the host bits of the node CIDR allocated to the node
+// from the ClusterCIDR.
+func (r *multiCIDRRangeAllocator) blockHostBits(clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node) int {
+	required, err := r.requiredHostBits(node)
+	if err != nil {
+		return nodeHostBits(clusterCIDR)
+	}
+	if hostBits, ok := fitHostBits(clusterCIDR, required); ok {
+		return hostBits
+	}
+	return nodeHostBits(clusterCIDR)
+}
+
+// hasFreeBlock returns true if every cidrSet of the ClusterCIDR has a free
+// block with the given host bits.
+func hasFreeBlock(clusterCIDR *cidrset.ClusterCIDR, hostBits int) bool {
+	blockSize := 1 << (hostBits - nodeHostBits(clusterCIDR))
+	for _, cidrSet := range []*cidrset.MultiCIDRSet{clusterCIDR.IPv4CIDRSet, clusterCIDR.IPv6CIDRSet} {
+		if cidrSet != nil && cidrSet.LargestFreeBlock() < blockSize {
+			return false
+		}
+	}
+	return true
+}
+
+// requiredHostBits returns the host bits of a node CIDR with addressesPerPod
+// addresses per pod. The number of pods is requested with the max pods
+// annotation, or taken from the node pod capacity if sizing by pod capacity
+// is enabled. It returns 0 if the node does not request a size.
+func (r *multiCIDRRangeAllocator) requiredHostBits(node *corev1.Node) (int, error) {
+	var pods int64
+	if value, ok := node.Annotations[v1.AnnotationMaxPods]; ok {
+		maxPods, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || maxPods <= 0 {
+			return 0, fmt.Errorf("invalid %s annotation %q on node %s, must be a positive integer", v1.AnnotationMaxPods, value, node.Name)
+		}
+		pods = maxPods
+	} else if r.sizeByPodCapacity {
+		capacity, ok := node.Status.Capacity[corev1.ResourcePods]
+		if !ok || capacity.Value() <= 0 {
+			return 0, nil
+		}
+		pods = capacity.Value()
+	} else {
+		return 0, nil
+	}
+
+	return bits.Len64(uint64(pods*addressesPerPod - 1)), nil
+}
+
+// filterBySize removes the ClusterCIDRs whose largest per node CIDR is too
+// small for the size requested by the node. Of the remaining ClusterCIDRs it
+// also removes those that would allocate a larger node CIDR than the smallest
+// one still available, so that large CIDRs are kept for the nodes that need
+// them.
+func (r *multiCIDRRangeAllocator) filterBySize(node *corev1.Node, clusterCIDRList []*cidrset.ClusterCIDR) ([]*cidrset.ClusterCIDR, error) {
+	required, err := r.requiredHostBits(node)
+	if err != nil || required == 0 {
+		return clusterCIDRList, err
+	}
+
+	smallest := -1
+	for _, clusterCIDR := range clusterCIDRList {
+		hostBits, ok := fitHostBits(clusterCIDR, required)
+		if ok && hasFreeBlock(clusterCIDR, hostBits) && (smallest == -1 || hostBits < smallest) {
+			smallest = hostBits
+		}
+	}
+	if smallest == -1 {
+		return nil, fmt.Errorf("no ClusterCIDR has free CIDRs with at least %d host bits for node %s", required, node.Name)
+	}
+
+	filtered := make([]*cidrset.ClusterCIDR, 0, len(clusterCIDRList))
+	for _, clusterCIDR := range clusterCIDRList {
+		if hostBits, ok := fitHostBits(clusterCIDR, required); ok && hostBits == smallest {
+			filtered = append(filtered, clusterCIDR)
+		}
+	}
+	return filtered, nil
+}
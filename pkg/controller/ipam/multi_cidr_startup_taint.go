@@ -0,0 +1,62 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+
+	controllerutil "github.com/mneverov/cluster-cidr-controller/pkg/util/node"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	nodeutil "k8s.io/component-helpers/node/util"
+	"k8s.io/klog/v2"
+)
+
+// hasStartupTaint returns true if the node has the taint removed once the
+// node is allocated PodCIDRs.
+func (r *multiCIDRRangeAllocator) hasStartupTaint(node *corev1.Node) bool {
+	if r.startupTaintKey == "" {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == r.startupTaintKey {
+			return true
+		}
+	}
+	return false
+}
+
+// patchNodeCIDRs sets the PodCIDRs of the node. The startup taint is removed
+// in the same patch so the node becomes schedulable together with its
+// PodCIDRs.
+func (r *multiCIDRRangeAllocator) patchNodeCIDRs(logger klog.Logger, node *corev1.Node, cidrs []string) error {
+	if r.skipWrite(logger, nodeRef(node), dryRunPatchNodeCIDRs, fmt.Sprintf("would set PodCIDRs %v of node %s", cidrs, node.Name)) {
+		r.dryRunPodCIDRs[node.Name] = cidrs
+		return nil
+	}
+	if !r.hasStartupTaint(node) {
+		return nodeutil.PatchNodeCIDRs(r.client, types.NodeName(node.Name), cidrs)
+	}
+
+	var taints []corev1.Taint
+	for _, taint := range node.Spec.Taints {
+		if taint.Key != r.startupTaintKey {
+			taints = append(taints, taint)
+		}
+	}
+	return controllerutil.PatchNodeCIDRsAndTaints(r.client, node, cidrs, taints)
+}
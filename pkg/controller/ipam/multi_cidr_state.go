@@ -0,0 +1,221 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+)
+
+// defaultStatePageSize is the default number of allocated CIDRs returned by
+// the state debug endpoint.
+const defaultStatePageSize = 1000
+
+// AllocatorState is a snapshot of the ClusterCIDRs tracked by the allocator.
+type AllocatorState struct {
+	// NodeSelectors lists the ClusterCIDRs by their node selector.
+	NodeSelectors []NodeSelectorState `json:"nodeSelectors"`
+	// Continue is the offset of the first allocated CIDR of the next page,
+	// empty on the last page.
+	Continue string `json:"continue,omitempty"`
+}
+
+// NodeSelectorState holds the ClusterCIDRs with the same node selector.
+type NodeSelectorState struct {
+	// NodeSelector is the key of the ClusterCIDRs in the cidrMap.
+	NodeSelector string `json:"nodeSelector"`
+	// ClusterCIDRs are the ClusterCIDRs with the node selector.
+	ClusterCIDRs []ClusterCIDRState `json:"clusterCIDRs"`
+}
+
+// ClusterCIDRState is a snapshot of a cidrset.ClusterCIDR.
+type ClusterCIDRState struct {
+	Name             string   `json:"name"`
+	Terminating      bool     `json:"terminating"`
+	Draining         bool     `json:"draining"`
+	AllocationPaused bool     `json:"allocationPaused"`
+	AssociatedNodes  []string `json:"associatedNodes"`
+	// IPv4 and IPv6 are the cidrSets of the ip families of the ClusterCIDR.
+	IPv4 *CIDRSetState `json:"ipv4,omitempty"`
+	IPv6 *CIDRSetState `json:"ipv6,omitempty"`
+}
+
+// CIDRSetState is a snapshot of a cidrset.MultiCIDRSet.
+type CIDRSetState struct {
+	CIDR          string `json:"cidr"`
+	NodeMaskSize  int    `json:"nodeMaskSize"`
+	Strategy      string `json:"strategy"`
+	MaxCIDRs      int    `json:"maxCIDRs"`
+	Allocated     int    `json:"allocated"`
+	Free          int    `json:"free"`
+	NextCandidate int    `json:"nextCandidate"`
+	// AllocatedCIDRs are the allocated CIDRs of the page ordered by address.
+	AllocatedCIDRs []string `json:"allocatedCIDRs"`
+}
+
+// State returns a snapshot of the ClusterCIDRs tracked by the allocator. The
+// allocated CIDRs of all cidrSets, ordered by node selector, ClusterCIDR name
+// and ip family, are paged: the first offset allocated CIDRs are skipped and
+// at most limit allocated CIDRs are returned.
+func (r *multiCIDRRangeAllocator) State(offset, limit int) (*AllocatorState, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	nodeSelectors := make([]string, 0, len(r.cidrMap))
+	for nodeSelector := range r.cidrMap {
+		nodeSelectors = append(nodeSelectors, nodeSelector)
+	}
+	sort.Strings(nodeSelectors)
+
+	state := &AllocatorState{NodeSelectors: make([]NodeSelectorState, 0, len(nodeSelectors))}
+	skip, remaining, total := offset, limit, 0
+	cidrSetState := func(cidrSet *cidrset.MultiCIDRSet) (*CIDRSetState, error) {
+		if cidrSet == nil {
+			return nil, nil
+		}
+		free := cidrSet.Free()
+		setState := &CIDRSetState{
+			CIDR:           cidrSet.ClusterCIDR.String(),
+			NodeMaskSize:   cidrSet.NodeMaskSize,
+			Strategy:       cidrSet.Strategy.Name(),
+			MaxCIDRs:       cidrSet.MaxCIDRs,
+			Allocated:      cidrSet.MaxCIDRs - free,
+			Free:           free,
+			NextCandidate:  cidrSet.NextCandidateIndex(),
+			AllocatedCIDRs: []string{},
+		}
+		total += setState.Allocated
+		if skip >= setState.Allocated {
+			skip -= setState.Allocated
+			return setState, nil
+		}
+		cidrs, err := cidrSet.AllocatedCIDRs(skip, remaining)
+		if err != nil {
+			return nil, err
+		}
+		skip = 0
+		remaining -= len(cidrs)
+		for _, cidr := range cidrs {
+			setState.AllocatedCIDRs = append(setState.AllocatedCIDRs, cidr.String())
+		}
+		return setState, nil
+	}
+
+	for _, nodeSelector := range nodeSelectors {
+		clusterCIDRList := make([]*cidrset.ClusterCIDR, len(r.cidrMap[nodeSelector]))
+		copy(clusterCIDRList, r.cidrMap[nodeSelector])
+		sort.Slice(clusterCIDRList, func(i, j int) bool { return clusterCIDRList[i].Name < clusterCIDRList[j].Name })
+
+		selectorState := NodeSelectorState{NodeSelector: nodeSelector, ClusterCIDRs: make([]ClusterCIDRState, 0, len(clusterCIDRList))}
+		for _, clusterCIDR := range clusterCIDRList {
+			clusterCIDRState := ClusterCIDRState{
+				Name:             clusterCIDR.Name,
+				Terminating:      clusterCIDR.Terminating,
+				Draining:         clusterCIDR.Draining,
+				AllocationPaused: clusterCIDR.AllocationPaused,
+				AssociatedNodes:  make([]string, 0, len(clusterCIDR.AssociatedNodes)),
+			}
+			for nodeName := range clusterCIDR.AssociatedNodes {
+				clusterCIDRState.AssociatedNodes = append(clusterCIDRState.AssociatedNodes, nodeName)
+			}
+			sort.Strings(clusterCIDRState.AssociatedNodes)
+
+			var err error
+			if clusterCIDRState.IPv4, err = cidrSetState(clusterCIDR.IPv4CIDRSet); err != nil {
+				return nil, err
+			}
+			if clusterCIDRState.IPv6, err = cidrSetState(clusterCIDR.IPv6CIDRSet); err != nil {
+				return nil, err
+			}
+			selectorState.ClusterCIDRs = append(selectorState.ClusterCIDRs, clusterCIDRState)
+		}
+		state.NodeSelectors = append(state.NodeSelectors, selectorState)
+	}
+
+	if limit >= 0 && offset+limit < total {
+		state.Continue = strconv.Itoa(offset + limit)
+	}
+	return state, nil
+}
+
+// FreeBlocks returns the largest free blocks of the cidrSets of the
+// ClusterCIDR, at most limit blocks per ip family.
+func (r *multiCIDRRangeAllocator) FreeBlocks(clusterCIDRName string, limit int) ([]*net.IPNet, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, clusterCIDRList := range r.cidrMap {
+		for _, clusterCIDR := range clusterCIDRList {
+			if clusterCIDR.Name != clusterCIDRName {
+				continue
+			}
+			var blocks []*net.IPNet
+			for _, cidrSet := range []*cidrset.MultiCIDRSet{clusterCIDR.IPv4CIDRSet, clusterCIDR.IPv6CIDRSet} {
+				if cidrSet == nil {
+					continue
+				}
+				free, err := cidrSet.FreeBlocks(limit)
+				if err != nil {
+					return nil, err
+				}
+				blocks = append(blocks, free...)
+			}
+			return blocks, nil
+		}
+	}
+	return nil, fmt.Errorf("ClusterCIDR %s not found", clusterCIDRName)
+}
+
+// NewStateHandler returns the handler of the state debug endpoint. The
+// allocated CIDRs are paged by the `limit` and `continue` query parameters,
+// the `continue` value of a response requests the next page.
+func NewStateHandler(allocator CIDRAllocator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		limit, offset := defaultStatePageSize, 0
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q, must be a positive integer", value), http.StatusBadRequest)
+				return
+			}
+		}
+		if value := query.Get("continue"); value != "" {
+			var err error
+			if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+				http.Error(w, fmt.Sprintf("invalid continue %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		state, err := allocator.State(offset, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// clusterCIDRSet returns the tracked cidrset.ClusterCIDR of the ClusterCIDR
+// API object, nil if the ClusterCIDR is not tracked.
+func (r *multiCIDRRangeAllocator) clusterCIDRSet(clusterCIDR *v1.ClusterCIDR) (*cidrset.ClusterCIDR, error) {
+	nodeSelector, err := r.nodeSelectorKey(clusterCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get labelSelector key: %w", err)
+	}
+
+	for _, clusterCIDRSet := range r.cidrMap[nodeSelector] {
+		if clusterCIDRSet.Name == clusterCIDR.Name {
+			return clusterCIDRSet, nil
+		}
+	}
+	return nil, nil
+}
+
+// updateClusterCIDRStatus publishes the state of the tracked ClusterCIDR in
+// the status of the ClusterCIDR API object. The status is updated only if it
+// has changed.
+func (r *multiCIDRRangeAllocator) updateClusterCIDRStatus(ctx context.Context, clusterCIDR *v1.ClusterCIDR, clusterCIDRSet *cidrset.ClusterCIDR) error {
+	status := clusterCIDRStatus(clusterCIDRSet)
+	if apiequality.Semantic.DeepEqual(clusterCIDR.Status, status) {
+		return nil
+	}
+
+	logger := klog.FromContext(ctx)
+	// Make a copy so we don't mutate the shared informer cache.
+	updatedClusterCIDR := clusterCIDR.DeepCopy()
+	updatedClusterCIDR.Status = status
+	if r.skipWrite(logger, clusterCIDRRef(clusterCIDR), dryRunUpdateStatus, fmt.Sprintf("would update the status of ClusterCIDR %s", clusterCIDR.Name)) {
+		return nil
+	}
+	if _, err := r.networkClient.UpdateStatus(ctx, updatedClusterCIDR, metav1.UpdateOptions{}); err != nil {
+		logger.V(2).Info("Error updating ClusterCIDR status", "clusterCIDR", clusterCIDR.Name, "err", err)
+		return err
+	}
+	logger.V(3).Info("Updated ClusterCIDR status", "clusterCIDR", clusterCIDR.Name)
+	return nil
+}
+
+// clusterCIDRStatus returns the status of the ClusterCIDR API object based on
+// the state of the tracked ClusterCIDR.
+func clusterCIDRStatus(clusterCIDRSet *cidrset.ClusterCIDR) v1.ClusterCIDRStatus {
+	return v1.ClusterCIDRStatus{
+		Supernets:          supernets(clusterCIDRSet),
+		Quarantine:         quarantinedCIDRs(clusterCIDRSet),
+		StickyReservations: stickyReservations(clusterCIDRSet),
+		DrainingNodes:      drainingNodes(clusterCIDRSet),
+		AllocationPaused:   clusterCIDRSet.AllocationPaused,
+		ObservedGeneration: clusterCIDRSet.ObservedGeneration,
+		SpecHash:           clusterCIDRSet.SpecHash,
+	}
+}
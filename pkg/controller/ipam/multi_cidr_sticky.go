@@ -0,0 +1,191 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	netutil "k8s.io/utils/net"
+)
+
+// reserveStickyCIDRs keeps the CIDRs of the deleted node allocated from the
+// ClusterCIDR occupied and reserved for a node with the same name until the
+// sticky grace period of the ClusterCIDR expires.
+func (r *multiCIDRRangeAllocator) reserveStickyCIDRs(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR, node *corev1.Node, cidrs []*net.IPNet) {
+	expirationTime := r.clock.Now().Add(clusterCIDR.StickyGracePeriod)
+	clusterCIDR.StickyReservations[node.Name] = &cidrset.StickyReservation{
+		CIDRs:          cidrs,
+		ExpirationTime: expirationTime,
+	}
+	delete(clusterCIDR.AssociatedNodes, node.Name)
+	logger.Info("Reserved CIDRs for node", "node", klog.KObj(node), "podCIDRs", ipnetToStringList(cidrs), "expirationTime", expirationTime)
+
+	// Publish the reservation and release the CIDRs once it expires.
+	r.cidrQueue.Add(clusterCIDR.Name)
+	r.cidrQueue.AddAfter(clusterCIDR.Name, clusterCIDR.StickyGracePeriod)
+}
+
+// claimStickyReservation returns the CIDRs reserved for the node name and the
+// ClusterCIDRs they belong to. A reservation of a single ip family is combined
+// with a reservation of the other ip family in another ClusterCIDR. It returns
+// false if no matching ClusterCIDR holds a reservation for the node.
+func (r *multiCIDRRangeAllocator) claimStickyReservation(logger klog.Logger, node *corev1.Node) (multiCIDRNodeReservedCIDRs, bool) {
+	reserved := multiCIDRNodeReservedCIDRs{nodeReservedCIDRs: nodeReservedCIDRs{nodeName: node.Name}}
+	clusterCIDRList, err := r.orderedMatchingClusterCIDRs(node, true)
+	if err != nil {
+		return reserved, false
+	}
+
+	var claimed ipFamilies
+	for _, clusterCIDR := range clusterCIDRList {
+		reservation, ok := clusterCIDR.StickyReservations[node.Name]
+		if !ok || !r.clock.Now().Before(reservation.ExpirationTime) {
+			continue
+		}
+		families := cidrsIPFamilies(reservation.CIDRs)
+		if (families.ipv4 && claimed.ipv4) || (families.ipv6 && claimed.ipv6) {
+			continue
+		}
+
+		delete(clusterCIDR.StickyReservations, node.Name)
+		r.cidrQueue.Add(clusterCIDR.Name)
+		logger.Info("Reusing CIDRs reserved for node", "node", klog.KObj(node), "podCIDRs", ipnetToStringList(reservation.CIDRs), "clusterCIDR", clusterCIDR.Name)
+		reserved.add(clusterCIDR, reservation.CIDRs)
+		claimed = ipFamilies{ipv4: claimed.ipv4 || families.ipv4, ipv6: claimed.ipv6 || families.ipv6}
+		if claimed.dualStack() {
+			break
+		}
+	}
+	return reserved, reserved.clusterCIDR != nil
+}
+
+// releaseExpiredStickyReservations releases the CIDRs of the expired
+// reservations of the ClusterCIDR.
+func (r *multiCIDRRangeAllocator) releaseExpiredStickyReservations(logger klog.Logger, clusterCIDR *cidrset.ClusterCIDR) {
+	now := r.clock.Now()
+	for nodeName, reservation := range clusterCIDR.StickyReservations {
+		if now.Before(reservation.ExpirationTime) {
+			continue
+		}
+
+		logger.Info("Reservation expired, releasing CIDRs", "node", klog.KRef("", nodeName), "podCIDRs", ipnetToStringList(reservation.CIDRs), "clusterCIDR", clusterCIDR.Name)
+		for _, cidr := range reservation.CIDRs {
+			// The CIDR was handed to a node in the meantime.
+			if owner, ok := r.podCIDROwners[cidr.String()]; ok {
+				logger.V(3).Info("Reserved CIDR is owned by a node, keeping it", "CIDR", cidr, "owner", klog.KRef("", owner))
+				continue
+			}
+			if err := r.Release(logger, clusterCIDR, cidr); err != nil {
+				logger.Error(err, "Failed to release reserved CIDR", "node", klog.KRef("", nodeName), "CIDR", cidr)
+			}
+		}
+		delete(clusterCIDR.StickyReservations, nodeName)
+
+		if r.quarantineDuration > 0 {
+			r.cidrQueue.AddAfter(clusterCIDR.Name, r.quarantineDuration)
+		}
+	}
+}
+
+// dropHeldStickyReservations deletes the reservations for the node whose CIDRs
+// the node already holds, e.g. when the node was re-created while the
+// controller was down.
+func (r *multiCIDRRangeAllocator) dropHeldStickyReservations(logger klog.Logger, clusterCIDRList []*cidrset.ClusterCIDR, node *corev1.Node) {
+	podCIDRs := make(map[string]bool, len(node.Spec.PodCIDRs))
+	for _, cidr := range node.Spec.PodCIDRs {
+		if _, podCIDR, err := netutil.ParseCIDRSloppy(cidr); err == nil {
+			podCIDRs[podCIDR.String()] = true
+		}
+	}
+
+	for _, clusterCIDR := range clusterCIDRList {
+		reservation, ok := clusterCIDR.StickyReservations[node.Name]
+		if !ok {
+			continue
+		}
+		held := true
+		for _, cidr := range reservation.CIDRs {
+			held = held && podCIDRs[cidr.String()]
+		}
+		if !held {
+			continue
+		}
+
+		delete(clusterCIDR.StickyReservations, node.Name)
+		r.cidrQueue.Add(clusterCIDR.Name)
+		logger.V(3).Info("Node holds its reserved CIDRs, dropping the reservation", "node", klog.KObj(node), "podCIDRs", ipnetToStringList(reservation.CIDRs), "clusterCIDR", clusterCIDR.Name)
+	}
+}
+
+// restoreStickyReservations occupies the CIDRs of the reservations published
+// in the ClusterCIDR status. Expired reservations are dropped.
+func (r *multiCIDRRangeAllocator) restoreStickyReservations(clusterCIDRSet *cidrset.ClusterCIDR, clusterCIDR *v1.ClusterCIDR) error {
+	if clusterCIDRSet.StickyGracePeriod == 0 {
+		return nil
+	}
+
+	now := r.clock.Now()
+	for _, reservation := range clusterCIDR.Status.StickyReservations {
+		if !now.Before(reservation.ExpirationTime.Time) {
+			continue
+		}
+
+		cidrs := make([]*net.IPNet, 0, len(reservation.PodCIDRs))
+		for _, cidr := range reservation.PodCIDRs {
+			_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+			if err != nil {
+				return fmt.Errorf("unable to parse CIDR %s reserved for node %s: %w", cidr, reservation.NodeName, err)
+			}
+			if err := r.Occupy(clusterCIDRSet, podCIDR); err != nil {
+				return fmt.Errorf("unable to restore CIDR %s reserved for node %s: %w", cidr, reservation.NodeName, err)
+			}
+			cidrs = append(cidrs, podCIDR)
+		}
+
+		clusterCIDRSet.StickyReservations[reservation.NodeName] = &cidrset.StickyReservation{
+			CIDRs:          cidrs,
+			ExpirationTime: reservation.ExpirationTime.Time,
+		}
+		r.cidrQueue.AddAfter(clusterCIDR.Name, reservation.ExpirationTime.Sub(now))
+	}
+	return nil
+}
+
+// stickyReservations returns the reservations of the ClusterCIDR sorted by
+// node name.
+func stickyReservations(clusterCIDRSet *cidrset.ClusterCIDR) []v1.StickyReservation {
+	var result []v1.StickyReservation
+	for nodeName, reservation := range clusterCIDRSet.StickyReservations {
+		// The API server stores the time with second precision.
+		result = append(result, v1.StickyReservation{
+			NodeName:       nodeName,
+			PodCIDRs:       ipnetToStringList(reservation.CIDRs),
+			ExpirationTime: metav1.NewTime(reservation.ExpirationTime).Rfc3339Copy(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].NodeName < result[j].NodeName
+	})
+	return result
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	cidrset "github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam/multicidrset"
+	corev1 "k8s.io/api/core/v1"
+	netutil "k8s.io/utils/net"
+)
+
+// WhoisStatus is the allocation status of an address.
+type WhoisStatus string
+
+const (
+	// WhoisAllocated is the status of addresses in a CIDR allocated to a node.
+	WhoisAllocated WhoisStatus = "Allocated"
+	// WhoisReserved is the status of addresses in a CIDR that is pinned to a
+	// node, reserved for a deleted node or quarantined.
+	WhoisReserved WhoisStatus = "Reserved"
+	// WhoisFree is the status of addresses in a CIDR that can be allocated.
+	WhoisFree WhoisStatus = "Free"
+	// WhoisServiceRange is the status of addresses reserved for services.
+	WhoisServiceRange WhoisStatus = "ServiceRange"
+	// WhoisOutsidePools is the status of addresses outside of all
+	// ClusterCIDRs.
+	WhoisOutsidePools WhoisStatus = "OutsidePools"
+)
+
+// WhoisResult describes the owner of an address.
+type WhoisResult struct {
+	// Address is the looked up IP address or CIDR.
+	Address string `json:"address"`
+	// Status is the allocation status of the address.
+	Status WhoisStatus `json:"status"`
+	// ClusterCIDR is the ClusterCIDR containing the address.
+	ClusterCIDR string `json:"clusterCIDR,omitempty"`
+	// Range is the range of the cidrSet of the ClusterCIDR containing the
+	// address.
+	Range string `json:"range,omitempty"`
+	// Block is the per node CIDR containing the address.
+	Block string `json:"block,omitempty"`
+	// Node is the node the block is allocated or reserved for.
+	Node string `json:"node,omitempty"`
+	// ServiceCIDR is the service CIDR containing the address.
+	ServiceCIDR string `json:"serviceCIDR,omitempty"`
+	// Message explains a reserved status.
+	Message string `json:"message,omitempty"`
+}
+
+// indexPodCIDRs records the node as the owner of the CIDRs.
+func (r *multiCIDRRangeAllocator) indexPodCIDRs(nodeName string, cidrs []string) {
+	for _, cidr := range cidrs {
+		if _, podCIDR, err := netutil.ParseCIDRSloppy(cidr); err == nil {
+			r.podCIDROwners[podCIDR.String()] = nodeName
+		}
+	}
+}
+
+// unindexPodCIDRs removes the node as the owner of its PodCIDRs and of its
+// additional pod CIDRs.
+func (r *multiCIDRRangeAllocator) unindexPodCIDRs(node *corev1.Node) {
+	cidrs := append([]string{}, node.Spec.PodCIDRs...)
+	if additional, err := additionalPodCIDRs(node); err == nil {
+		cidrs = append(cidrs, ipnetToStringList(additional)...)
+	}
+	for _, cidr := range cidrs {
+		_, podCIDR, err := netutil.ParseCIDRSloppy(cidr)
+		if err == nil && r.podCIDROwners[podCIDR.String()] == node.Name {
+			delete(r.podCIDROwners, podCIDR.String())
+		}
+	}
+}
+
+// Whois returns the ClusterCIDR, the per node CIDR and the node owning the
+// IP address or CIDR. The owner is looked up in the index of the allocated
+// CIDRs, a CIDR spanning more than one per node CIDR is rejected.
+func (r *multiCIDRRangeAllocator) Whois(address string) (*WhoisResult, error) {
+	cidr, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result := &WhoisResult{Address: cidr.String(), Status: WhoisOutsidePools}
+	for _, serviceCIDR := range r.serviceCIDRs {
+		if serviceCIDR.Contains(cidr.IP) {
+			result.Status = WhoisServiceRange
+			result.ServiceCIDR = serviceCIDR.String()
+		}
+	}
+
+	for _, clusterCIDRList := range r.cidrMap {
+		for _, clusterCIDR := range clusterCIDRList {
+			cidrSet, err := r.associatedCIDRSet(clusterCIDR, cidr)
+			if err != nil || cidrSet == nil || !cidrSet.ClusterCIDR.Contains(cidr.IP) {
+				continue
+			}
+			found, err := r.whoisBlock(clusterCIDR, cidrSet, cidr, result.Status == WhoisServiceRange)
+			if err != nil {
+				return nil, err
+			}
+			found.ServiceCIDR = result.ServiceCIDR
+			// Overlapping ClusterCIDRs are possible, prefer the one owning
+			// the address.
+			if found.Status == WhoisAllocated || result.ClusterCIDR == "" {
+				result = found
+			}
+		}
+	}
+	return result, nil
+}
+
+// whoisBlock looks up the owner of the per node CIDR of the cidrSet of the
+// ClusterCIDR containing the CIDR.
+func (r *multiCIDRRangeAllocator) whoisBlock(clusterCIDR *cidrset.ClusterCIDR, cidrSet *cidrset.MultiCIDRSet, cidr *net.IPNet, service bool) (*WhoisResult, error) {
+	result := &WhoisResult{
+		Address:     cidr.String(),
+		ClusterCIDR: clusterCIDR.Name,
+		Range:       cidrSet.ClusterCIDR.String(),
+	}
+	// Nodes may be allocated blocks larger than the per node CIDR, see
+	// maxPerNodeHostBits.
+	ones, bits := cidr.Mask.Size()
+	for hostBits := bits - cidrSet.NodeMaskSize; hostBits <= maxHostBits(clusterCIDR, cidrSet) && bits-hostBits <= ones; hostBits++ {
+		block := &net.IPNet{IP: cidr.IP.Mask(net.CIDRMask(bits-hostBits, bits)), Mask: net.CIDRMask(bits-hostBits, bits)}
+		if nodeName, ok := r.podCIDROwners[block.String()]; ok {
+			result.Status = WhoisAllocated
+			result.Block = block.String()
+			result.Node = nodeName
+			return result, nil
+		}
+	}
+	if ones < cidrSet.NodeMaskSize {
+		return nil, fmt.Errorf("%s spans more than one per node CIDR of ClusterCIDR %s", cidr, clusterCIDR.Name)
+	}
+
+	block := &net.IPNet{IP: cidr.IP.Mask(net.CIDRMask(cidrSet.NodeMaskSize, bits)), Mask: net.CIDRMask(cidrSet.NodeMaskSize, bits)}
+	result.Block = block.String()
+	if service {
+		result.Status = WhoisServiceRange
+		return result, nil
+	}
+	for nodeName, pinned := range clusterCIDR.PinnedReservations {
+		if containsCIDR(pinned.CIDRs, block) {
+			result.Status = WhoisReserved
+			result.Node = nodeName
+			result.Message = fmt.Sprintf("pinned to node %s by ClusterCIDR %s", nodeName, clusterCIDR.Name)
+			return result, nil
+		}
+	}
+	for nodeName, sticky := range clusterCIDR.StickyReservations {
+		if containsCIDR(sticky.CIDRs, block) {
+			result.Status = WhoisReserved
+			result.Node = nodeName
+			result.Message = fmt.Sprintf("reserved for deleted node %s until %s", nodeName, sticky.ExpirationTime.UTC().Format(time.RFC3339))
+			return result, nil
+		}
+	}
+
+	index, err := cidrSet.Index(block)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cidrSet.IsFree(index):
+		result.Status = WhoisFree
+	case cidrSet.IsQuarantined(index):
+		result.Status = WhoisReserved
+		result.Message = "released and in quarantine"
+	default:
+		result.Status = WhoisReserved
+		result.Message = "occupied without a known owner"
+	}
+	return result, nil
+}
+
+// maxHostBits returns the number of host bits of the largest block allocated
+// to a node from the cidrSet.
+func maxHostBits(clusterCIDR *cidrset.ClusterCIDR, cidrSet *cidrset.MultiCIDRSet) int {
+	_, bits := cidrSet.ClusterCIDR.Mask.Size()
+	if clusterCIDR.MaxNodeHostBits > bits-cidrSet.NodeMaskSize {
+		return clusterCIDR.MaxNodeHostBits
+	}
+	return bits - cidrSet.NodeMaskSize
+}
+
+// containsCIDR returns true if one of the CIDRs contains the block.
+func containsCIDR(cidrs []*net.IPNet, block *net.IPNet) bool {
+	for _, cidr := range cidrs {
+		blockOnes, _ := block.Mask.Size()
+		cidrOnes, _ := cidr.Mask.Size()
+		if cidrOnes <= blockOnes && cidr.Contains(block.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddress parses an IP address or a CIDR, an IP address is returned as
+// a single address CIDR.
+func parseAddress(address string) (*net.IPNet, error) {
+	if ip := netutil.ParseIPSloppy(address); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, cidr, err := netutil.ParseCIDRSloppy(address)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an IP address nor a CIDR", address)
+	}
+	return cidr, nil
+}
+
+// NewWhoisHandler returns the handler of the whois debug endpoint. The IP
+// address or CIDR is given by the `address` query parameter.
+func NewWhoisHandler(allocator CIDRAllocator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		address := req.URL.Query().Get("address")
+		if address == "" {
+			http.Error(w, "the address query parameter must be specified", http.StatusBadRequest)
+			return
+		}
+		result, err := allocator.Whois(address)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
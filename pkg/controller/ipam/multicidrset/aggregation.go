@@ -0,0 +1,210 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"fmt"
+	"net"
+)
+
+// SupernetsExhaustedErr is an error type used to denote there is no free
+// supernet left to reserve for a group.
+type SupernetsExhaustedErr struct {
+	// CIDR represents the CIDR which has no free supernet.
+	CIDR string
+	// Group is the group a supernet was requested for.
+	Group string
+}
+
+func (err *SupernetsExhaustedErr) Error() string {
+	return fmt.Sprintf("supernet reservation failed; there are no free supernets left in the range %s for group %q", err.CIDR, err.Group)
+}
+
+// EnableAggregation splits the set into aligned supernets with the given
+// number of host bits. Each supernet is reserved for a single group of nodes
+// and the CIDRs of the group are allocated inside of it.
+func (s *MultiCIDRSet) EnableAggregation(supernetHostBits int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	ones, bits := s.nodeMask.Size()
+	level := supernetHostBits - (bits - ones)
+	if level <= 0 || level >= len(s.usedBlocks) {
+		return fmt.Errorf("supernet host bits %d must be greater than the per node host bits %d and fit into %s", supernetHostBits, bits-ones, s.Label)
+	}
+
+	s.supernetLevel = level
+	s.supernets = make(map[string]int)
+	s.supernetGroups = make(map[int]string)
+	return nil
+}
+
+// Supernets returns the supernets reserved for each group.
+func (s *MultiCIDRSet) Supernets() map[string]*net.IPNet {
+	s.Lock()
+	defer s.Unlock()
+
+	supernets := make(map[string]*net.IPNet, len(s.supernets))
+	for group, g := range s.supernets {
+		supernet, err := s.supernetCIDR(g)
+		if err != nil {
+			continue
+		}
+		supernets[group] = supernet
+	}
+	return supernets
+}
+
+// ReserveSupernet reserves the given supernet for the group. It is used to
+// restore the reservations, e.g. after a restart.
+func (s *MultiCIDRSet) ReserveSupernet(group string, supernet *net.IPNet) error {
+	s.Lock()
+	defer s.Unlock()
+
+	g, err := s.supernetIndex(supernet)
+	if err != nil {
+		return err
+	}
+	if ones, _ := supernet.Mask.Size(); ones != s.NodeMaskSize-s.supernetLevel {
+		return fmt.Errorf("supernet %v does not have the supernet mask size %d", supernet, s.NodeMaskSize-s.supernetLevel)
+	}
+	return s.reserveSupernetIndex(group, g)
+}
+
+// OccupyGroup marks the supernet containing the given CIDR as reserved for
+// the group, unless the group already has a supernet. It returns an error if
+// the CIDR is not in the supernet of the group.
+func (s *MultiCIDRSet) OccupyGroup(group string, cidr *net.IPNet) error {
+	s.Lock()
+	defer s.Unlock()
+
+	g, err := s.supernetIndex(cidr)
+	if err != nil {
+		return err
+	}
+	if reserved, ok := s.supernets[group]; ok {
+		if reserved != g {
+			return fmt.Errorf("cidr %v is outside of the supernet of group %q", cidr, group)
+		}
+		return nil
+	}
+	return s.reserveSupernetIndex(group, g)
+}
+
+// SupernetGroup returns the group the supernet containing the given CIDR is
+// reserved for, false if the supernet is not reserved or aggregation is
+// disabled.
+func (s *MultiCIDRSet) SupernetGroup(cidr *net.IPNet) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	g, err := s.supernetIndex(cidr)
+	if err != nil {
+		return "", false
+	}
+	group, reserved := s.supernetGroups[g]
+	return group, reserved
+}
+
+// reserveSupernet returns the index of the supernet of the group, a free
+// supernet is reserved if the group does not have one yet.
+func (s *MultiCIDRSet) reserveSupernet(group string) (int, error) {
+	if s.supernetLevel == 0 {
+		return 0, fmt.Errorf("aggregation is not enabled for %s", s.Label)
+	}
+	if g, ok := s.supernets[group]; ok {
+		return g, nil
+	}
+	for g := 0; g < s.MaxCIDRs>>s.supernetLevel; g++ {
+		if _, reserved := s.supernetGroups[g]; s.usedBlocks[s.supernetLevel][g] == 0 && !reserved {
+			s.supernets[group] = g
+			s.supernetGroups[g] = group
+			return g, nil
+		}
+	}
+	return 0, &SupernetsExhaustedErr{CIDR: s.Label, Group: group}
+}
+
+// releaseEmptySupernet frees the reservation of the supernet containing the
+// CIDR with the given index once none of its CIDRs is allocated.
+func (s *MultiCIDRSet) releaseEmptySupernet(index int) {
+	if s.supernetLevel == 0 {
+		return
+	}
+	g := index >> s.supernetLevel
+	if s.usedBlocks[s.supernetLevel][g] != 0 {
+		return
+	}
+	if group, ok := s.supernetGroups[g]; ok {
+		delete(s.supernetGroups, g)
+		delete(s.supernets, group)
+	}
+}
+
+func (s *MultiCIDRSet) reserveSupernetIndex(group string, g int) error {
+	if owner, ok := s.supernetGroups[g]; ok && owner != group {
+		return fmt.Errorf("supernet %d of %s is already reserved for group %q", g, s.Label, owner)
+	}
+	if reserved, ok := s.supernets[group]; ok && reserved != g {
+		return fmt.Errorf("group %q already has supernet %d of %s reserved", group, reserved, s.Label)
+	}
+	s.supernets[group] = g
+	s.supernetGroups[g] = group
+	return nil
+}
+
+// supernetIndex returns the index of the supernet containing the given CIDR.
+func (s *MultiCIDRSet) supernetIndex(cidr *net.IPNet) (int, error) {
+	if s.supernetLevel == 0 {
+		return 0, fmt.Errorf("aggregation is not enabled for %s", s.Label)
+	}
+	if !s.ClusterCIDR.Contains(cidr.IP) {
+		return 0, fmt.Errorf("cidr %v is out the range of cluster cidr %v", cidr, s.ClusterCIDR)
+	}
+	index, err := s.getIndexForIP(cidr.IP.Mask(s.nodeMask))
+	if err != nil {
+		return 0, err
+	}
+	return index >> s.supernetLevel, nil
+}
+
+// supernetCIDR returns the CIDR of the supernet with the given index.
+func (s *MultiCIDRSet) supernetCIDR(g int) (*net.IPNet, error) {
+	first, err := s.indexToCIDRBlock(g << s.supernetLevel)
+	if err != nil {
+		return nil, err
+	}
+	_, bits := s.nodeMask.Size()
+	return &net.IPNet{
+		IP:   first.IP,
+		Mask: net.CIDRMask(s.NodeMaskSize-s.supernetLevel, bits),
+	}, nil
+}
+
+// inCandidateGroup returns true if the CIDR with the given index belongs to
+// the supernet of the group a candidate is looked for, or to no supernet if
+// the group is empty.
+func (s *MultiCIDRSet) inCandidateGroup(index int) bool {
+	if s.supernetLevel == 0 {
+		return true
+	}
+	group, reserved := s.supernetGroups[index>>s.supernetLevel]
+	if s.candidateGroup == "" {
+		return !reserved
+	}
+	return reserved && group == s.candidateGroup
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"errors"
+	"testing"
+
+	utilnet "k8s.io/utils/net"
+)
+
+func newAggregatedSet(t *testing.T, clusterCIDR string, perNodeHostBits, supernetHostBits int) *MultiCIDRSet {
+	t.Helper()
+	_, cidr, err := utilnet.ParseCIDRSloppy(clusterCIDR)
+	if err != nil {
+		t.Fatalf("unexpected error parsing %s: %v", clusterCIDR, err)
+	}
+	set, err := NewMultiCIDRSet(cidr, perNodeHostBits)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+	if err := set.EnableAggregation(supernetHostBits); err != nil {
+		t.Fatalf("unexpected error enabling aggregation: %v", err)
+	}
+	return set
+}
+
+func allocateGroup(t *testing.T, set *MultiCIDRSet, group string) string {
+	t.Helper()
+	candidate, _, err := set.NextGroupCandidate(group)
+	if err != nil {
+		t.Fatalf("unexpected error allocating for group %q: %v", group, err)
+	}
+	if err := set.Occupy(candidate); err != nil {
+		t.Fatalf("unexpected error occupying %v: %v", candidate, err)
+	}
+	return candidate.String()
+}
+
+func TestEnableAggregation(t *testing.T) {
+	_, cidr, _ := utilnet.ParseCIDRSloppy("10.0.0.0/24")
+	cases := []struct {
+		supernetHostBits int
+		wantErr          bool
+	}{
+		{supernetHostBits: 4, wantErr: true},
+		{supernetHostBits: 5},
+		{supernetHostBits: 8},
+		{supernetHostBits: 9, wantErr: true},
+	}
+	for _, tc := range cases {
+		set, err := NewMultiCIDRSet(cidr, 4)
+		if err != nil {
+			t.Fatalf("unexpected error creating set: %v", err)
+		}
+		err = set.EnableAggregation(tc.supernetHostBits)
+		if tc.wantErr != (err != nil) {
+			t.Errorf("supernetHostBits %d: expected error %v, got %v", tc.supernetHostBits, tc.wantErr, err)
+		}
+	}
+}
+
+func TestNextGroupCandidate(t *testing.T) {
+	// 4 supernets /26 with 4 node CIDRs /28 each.
+	set := newAggregatedSet(t, "10.0.0.0/24", 4, 6)
+
+	expected := []struct {
+		group string
+		cidr  string
+	}{
+		{group: "a", cidr: "10.0.0.0/28"},
+		{group: "b", cidr: "10.0.0.64/28"},
+		{group: "a", cidr: "10.0.0.16/28"},
+		{group: "", cidr: "10.0.0.128/28"},
+		{group: "b", cidr: "10.0.0.80/28"},
+		{group: "c", cidr: "10.0.0.192/28"},
+	}
+	for _, e := range expected {
+		if cidr := allocateGroup(t, set, e.group); cidr != e.cidr {
+			t.Errorf("unexpected CIDR for group %q: %s, expected %s", e.group, cidr, e.cidr)
+		}
+	}
+
+	supernets := set.Supernets()
+	for group, supernet := range map[string]string{"a": "10.0.0.0/26", "b": "10.0.0.64/26", "c": "10.0.0.192/26"} {
+		if got := supernets[group]; got == nil || got.String() != supernet {
+			t.Errorf("unexpected supernet for group %q: %v, expected %s", group, got, supernet)
+		}
+	}
+
+	// The supernet at 10.0.0.128/26 is partly used by nodes without a group.
+	_, _, err := set.NextGroupCandidate("d")
+	var exhaustedErr *SupernetsExhaustedErr
+	if !errors.As(err, &exhaustedErr) {
+		t.Errorf("expected SupernetsExhaustedErr, got %v", err)
+	}
+}
+
+func TestNextGroupCandidateSupernetExhausted(t *testing.T) {
+	// 2 supernets /25 with 2 node CIDRs /26 each.
+	set := newAggregatedSet(t, "10.0.0.0/24", 6, 7)
+
+	allocateGroup(t, set, "a")
+	allocateGroup(t, set, "a")
+
+	_, _, err := set.NextGroupCandidate("a")
+	var exhaustedErr *CIDRRangeNoCIDRsRemainingErr
+	if !errors.As(err, &exhaustedErr) {
+		t.Errorf("expected CIDRRangeNoCIDRsRemainingErr, got %v", err)
+	}
+
+	if cidr := allocateGroup(t, set, "b"); cidr != "10.0.0.128/26" {
+		t.Errorf("unexpected CIDR for group b: %s", cidr)
+	}
+}
+
+func TestReserveAndOccupyGroup(t *testing.T) {
+	set := newAggregatedSet(t, "10.0.0.0/24", 4, 6)
+
+	_, supernet, _ := utilnet.ParseCIDRSloppy("10.0.0.128/26")
+	if err := set.ReserveSupernet("a", supernet); err != nil {
+		t.Fatalf("unexpected error reserving supernet: %v", err)
+	}
+	if cidr := allocateGroup(t, set, "a"); cidr != "10.0.0.128/28" {
+		t.Errorf("unexpected CIDR for group a: %s", cidr)
+	}
+
+	_, misaligned, _ := utilnet.ParseCIDRSloppy("10.0.0.0/27")
+	if err := set.ReserveSupernet("b", misaligned); err == nil {
+		t.Errorf("expected error reserving a supernet with the wrong mask size")
+	}
+
+	_, nodeCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.16/28")
+	if err := set.OccupyGroup("b", nodeCIDR); err != nil {
+		t.Fatalf("unexpected error occupying group: %v", err)
+	}
+	if err := set.OccupyGroup("a", nodeCIDR); err == nil {
+		t.Errorf("expected error occupying a CIDR outside of the supernet of the group")
+	}
+	if err := set.OccupyGroup("c", nodeCIDR); err == nil {
+		t.Errorf("expected error occupying a supernet reserved for another group")
+	}
+	if got := set.Supernets()["b"].String(); got != "10.0.0.0/26" {
+		t.Errorf("unexpected supernet for group b: %s", got)
+	}
+}
+
+func TestReleaseEmptySupernet(t *testing.T) {
+	// 2 supernets /25 with 2 node CIDRs /26 each.
+	set := newAggregatedSet(t, "10.0.0.0/24", 6, 7)
+
+	var cidrs []string
+	cidrs = append(cidrs, allocateGroup(t, set, "a"), allocateGroup(t, set, "a"))
+	allocateGroup(t, set, "b")
+
+	// The supernet stays reserved while the group has an allocated CIDR.
+	for i, cidr := range cidrs {
+		_, ipNet, _ := utilnet.ParseCIDRSloppy(cidr)
+		if err := set.Release(ipNet); err != nil {
+			t.Fatalf("unexpected error releasing %s: %v", cidr, err)
+		}
+		if _, reserved := set.Supernets()["a"]; reserved != (i == 0) {
+			t.Errorf("after releasing %s: expected supernet of group a reserved %v", cidr, i == 0)
+		}
+	}
+
+	if cidr := allocateGroup(t, set, "c"); cidr != "10.0.0.0/26" {
+		t.Errorf("unexpected CIDR for group c: %s", cidr)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"fmt"
+	"net"
+)
+
+// NextBlockCandidate returns the next candidate block of CIDRs with the given
+// host bits for a node of the given group and the number of blocks evaluated.
+// A block with the host bits of a single CIDR is picked by the Strategy of
+// the set, see NextGroupCandidate. Larger blocks are picked buddy style: the
+// block is carved out of the smallest free aligned block that can hold it, so
+// larger free blocks are kept whole. Released blocks coalesce with their free
+// buddies. The block is occupied and released with Occupy and Release.
+func (s *MultiCIDRSet) NextBlockCandidate(group string, hostBits int) (*net.IPNet, int, error) {
+	order := hostBits - s.nodeHostBits()
+	if order == 0 {
+		return s.NextGroupCandidate(group)
+	}
+	if order < 0 || order >= len(s.usedBlocks) {
+		return nil, 0, fmt.Errorf("a block with %d host bits does not fit into %s with %d host bits per CIDR", hostBits, s.Label, s.nodeHostBits())
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.freeGroups[order] == 0 {
+		return nil, 0, &CIDRRangeNoCIDRsRemainingErr{
+			CIDR: s.Label,
+		}
+	}
+
+	s.expireQuarantine()
+
+	if group != "" {
+		if _, err := s.reserveSupernet(group); err != nil {
+			return nil, 0, err
+		}
+	}
+	s.candidateGroup = group
+
+	index, evaluated, ok := s.nextBlock(order)
+	if !ok {
+		// Every free block has been rejected, start over on the next request.
+		s.handedOut = make(map[int]bool)
+		return nil, evaluated, &CIDRRangeNoCIDRsRemainingErr{
+			CIDR: s.Label,
+		}
+	}
+
+	candidate, err := s.indexToCIDRBlock(index)
+	if err != nil {
+		return nil, evaluated, err
+	}
+	_, ipBits := s.ClusterCIDR.Mask.Size()
+	candidate.Mask = net.CIDRMask(s.NodeMaskSize-order, ipBits)
+	s.handedOut[index] = true
+	return candidate, evaluated, nil
+}
+
+// nodeHostBits returns the host bits of a single CIDR of the set.
+func (s *MultiCIDRSet) nodeHostBits() int {
+	_, ipBits := s.ClusterCIDR.Mask.Size()
+	return ipBits - s.NodeMaskSize
+}
+
+// nextBlock returns the index of the first CIDR of a candidate block of
+// 2^order CIDRs, the number of blocks evaluated and false if there is no
+// candidate. The maximal free aligned blocks, the free blocks whose buddy is
+// used, are the free lists of a buddy allocator. They are searched from the
+// smallest one that can hold the block up.
+func (s *MultiCIDRSet) nextBlock(order int) (int, int, bool) {
+	evaluated := 0
+	top := len(s.usedBlocks) - 1
+	for level := order; level <= top; level++ {
+		if s.freeGroups[level] == 0 {
+			break
+		}
+		for g := 0; g < s.MaxCIDRs>>level; g++ {
+			if s.usedBlocks[level][g] != 0 || (level < top && s.usedBlocks[level+1][g>>1] == 0) {
+				continue
+			}
+			// Split the free block, the first block that is a candidate is
+			// handed out.
+			for b := g << (level - order); b < (g+1)<<(level-order); b++ {
+				evaluated++
+				if s.isBlockCandidate(b<<order, 1<<order) {
+					return b << order, evaluated, true
+				}
+			}
+		}
+	}
+	return 0, evaluated, false
+}
+
+// isBlockCandidate returns true if every CIDR of the block of size CIDRs
+// starting at index begin is a candidate.
+func (s *MultiCIDRSet) isBlockCandidate(begin, size int) bool {
+	for i := begin; i < begin+size; i++ {
+		if !s.isCandidate(i) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"net"
+	"testing"
+
+	utilnet "k8s.io/utils/net"
+)
+
+func allocateBlock(t *testing.T, set *MultiCIDRSet, hostBits int) string {
+	t.Helper()
+	candidate, _, err := set.NextBlockCandidate("", hostBits)
+	if err != nil {
+		t.Fatalf("unexpected error allocating a block with %d host bits: %v", hostBits, err)
+	}
+	if err := set.Occupy(candidate); err != nil {
+		t.Fatalf("unexpected error occupying %v: %v", candidate, err)
+	}
+	return candidate.String()
+}
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, ipNet, err := utilnet.ParseCIDRSloppy(cidr)
+	if err != nil {
+		t.Fatalf("unexpected error parsing %s: %v", cidr, err)
+	}
+	return ipNet
+}
+
+func TestNextBlockCandidate(t *testing.T) {
+	set, err := NewMultiCIDRSet(mustParseCIDR(t, "10.0.0.0/24"), 4)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+	set.Strategy = Sequential
+
+	// An existing node with the smallest CIDR splits the range.
+	if err := set.Occupy(mustParseCIDR(t, "10.0.0.0/28")); err != nil {
+		t.Fatalf("unexpected error occupying: %v", err)
+	}
+
+	steps := []struct {
+		hostBits int
+		want     string
+	}{
+		// The smallest free block that fits is split, the /25 stays whole.
+		{hostBits: 6, want: "10.0.0.64/26"},
+		{hostBits: 5, want: "10.0.0.32/27"},
+		{hostBits: 4, want: "10.0.0.16/28"},
+		{hostBits: 7, want: "10.0.0.128/25"},
+	}
+	for _, step := range steps {
+		if got := allocateBlock(t, set, step.hostBits); got != step.want {
+			t.Errorf("block with %d host bits: got %s, want %s", step.hostBits, got, step.want)
+		}
+	}
+
+	if _, _, err := set.NextBlockCandidate("", 4); err == nil {
+		t.Errorf("expected the set to be exhausted")
+	}
+
+	// Released blocks coalesce with their buddies.
+	for _, cidr := range []string{"10.0.0.0/28", "10.0.0.16/28", "10.0.0.32/27", "10.0.0.64/26"} {
+		if err := set.Release(mustParseCIDR(t, cidr)); err != nil {
+			t.Fatalf("unexpected error releasing %s: %v", cidr, err)
+		}
+	}
+	if got, want := set.LargestFreeBlock(), 8; got != want {
+		t.Errorf("largest free block: got %d, want %d", got, want)
+	}
+	if got, want := set.Fragmentation(), 0.0; got != want {
+		t.Errorf("fragmentation: got %v, want %v", got, want)
+	}
+	if got, want := allocateBlock(t, set, 7), "10.0.0.0/25"; got != want {
+		t.Errorf("coalesced block: got %s, want %s", got, want)
+	}
+}
+
+func TestNextBlockCandidateInvalidHostBits(t *testing.T) {
+	set, err := NewMultiCIDRSet(mustParseCIDR(t, "10.0.0.0/24"), 4)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+	for _, hostBits := range []int{3, 9} {
+		if _, _, err := set.NextBlockCandidate("", hostBits); err == nil {
+			t.Errorf("expected an error for a block with %d host bits", hostBits)
+		}
+	}
+}
@@ -63,6 +63,33 @@ var (
 		},
 		[]string{"clusterCIDR"},
 	)
+	cidrSetLargestFreeBlock = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      nodeIpamSubsystem,
+			Name:           "multicidrset_largest_free_block_cidrs",
+			Help:           "Gauge measuring the number of CIDRs in the largest aligned free block.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"clusterCIDR"},
+	)
+	cidrSetFragmentation = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      nodeIpamSubsystem,
+			Name:           "multicidrset_fragmentation_ratio",
+			Help:           "Gauge measuring the share of free CIDRs outside of the largest aligned free block.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"clusterCIDR"},
+	)
+	cidrSetQuarantined = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      nodeIpamSubsystem,
+			Name:           "multicidrset_quarantined_cidrs",
+			Help:           "Gauge measuring the number of released CIDRs waiting for the quarantine to expire.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"clusterCIDR"},
+	)
 	cidrSetAllocationTriesPerRequest = metrics.NewHistogramVec(
 		&metrics.HistogramOpts{
 			Subsystem:      nodeIpamSubsystem,
@@ -85,5 +112,8 @@ func registerCidrsetMetrics() {
 		legacyregistry.MustRegister(cidrSetMaxCidrs)
 		legacyregistry.MustRegister(cidrSetUsage)
 		legacyregistry.MustRegister(cidrSetAllocationTriesPerRequest)
+		legacyregistry.MustRegister(cidrSetLargestFreeBlock)
+		legacyregistry.MustRegister(cidrSetFragmentation)
+		legacyregistry.MustRegister(cidrSetQuarantined)
 	})
 }
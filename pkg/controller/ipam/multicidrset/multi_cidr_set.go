@@ -22,8 +22,11 @@ import (
 	"math/big"
 	"math/bits"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
+	"k8s.io/utils/clock"
 	netutils "k8s.io/utils/net"
 )
 
@@ -46,6 +49,13 @@ type MultiCIDRSet struct {
 	// Stores a mapping of the next candidate CIDR for allocation to it's
 	// allocation status. Next candidate is used only if allocation status is false.
 	AllocatedCIDRMap map[string]bool
+	// Strategy decides which free CIDR is returned by NextCandidate.
+	Strategy Strategy
+	// QuarantineDuration is the time a released CIDR is not returned by
+	// NextCandidate, 0 disables the quarantine.
+	QuarantineDuration time.Duration
+	// Clock is used to timestamp released CIDRs.
+	Clock clock.PassiveClock
 
 	// clusterMaskSize is the mask size, in bits, assigned to the cluster.
 	// caches the mask size to avoid the penalty of calling clusterCIDR.Mask.Size().
@@ -56,6 +66,30 @@ type MultiCIDRSet struct {
 	allocatedCIDRs int
 	// nextCandidate points to the next CIDR that should be free.
 	nextCandidate int
+	// usedBlocks counts the allocated CIDRs per aligned group of CIDRs.
+	// usedBlocks[k][g] is the number of allocated CIDRs in the g-th group of
+	// 2^k consecutive CIDRs, usedBlocks[0] is the allocation bitmap. Only the
+	// groups with at least one allocated CIDR have an entry, the memory used
+	// grows with the allocations and not with the size of the set.
+	usedBlocks []map[int]int32
+	// freeGroups[k] counts the groups of 2^k CIDRs without any allocated CIDR.
+	freeGroups []int
+	// handedOut stores the indices returned by NextCandidate since the set was
+	// last changed. It prevents strategies that do not move a cursor from
+	// returning a candidate that has been rejected by the caller.
+	handedOut map[int]bool
+	// supernetLevel is the level in usedBlocks of the supernets reserved for
+	// groups of nodes, 0 if aggregation is disabled.
+	supernetLevel int
+	// supernets maps a group to the index of its supernet.
+	supernets map[string]int
+	// supernetGroups maps the index of a reserved supernet to its group.
+	supernetGroups map[int]string
+	// candidateGroup is the group the current NextGroupCandidate call looks
+	// for a candidate for.
+	candidateGroup string
+	// quarantine maps the index of a released CIDR to its release time.
+	quarantine map[int]time.Time
 }
 
 // ClusterCIDR is an internal representation of the ClusterCIDR API object.
@@ -73,6 +107,62 @@ type ClusterCIDR struct {
 	AssociatedNodes map[string]bool
 	// Terminating is used to identify whether ClusterCIDR has been marked for termination.
 	Terminating bool
+	// TopologyKey is the node label used to group node CIDRs into supernets,
+	// empty if aggregation is disabled.
+	TopologyKey string
+	// StickyGracePeriod is the time the CIDRs of a deleted node stay reserved
+	// for a node with the same name, 0 if the reservation is disabled.
+	StickyGracePeriod time.Duration
+	// StickyReservations maps a deleted node name to its reserved CIDRs.
+	StickyReservations map[string]*StickyReservation
+	// NodeIndex maps a node to the index of its CIDRs, nil if the CIDRs are
+	// picked by the Strategy of the cidrSets.
+	NodeIndex *NodeIndexTemplate
+	// CorrelatedIndices is true if the IPv4 and IPv6 CIDRs of a node are
+	// allocated at the same index.
+	CorrelatedIndices bool
+	// IPv6Primary is true if the IPv6 CIDR comes first in the PodCIDRs of
+	// dual-stack nodes.
+	IPv6Primary bool
+	// SingleStackFallback is true if dual-stack nodes may be allocated a
+	// single ip family when the other one is exhausted.
+	SingleStackFallback bool
+	// MaxNodeHostBits is the number of host bits of the largest block
+	// allocated to a node, 0 if every node is allocated a single CIDR.
+	MaxNodeHostBits int
+	// Draining is true if the ClusterCIDR does not allocate CIDRs to new
+	// nodes while its nodes are migrated to other ClusterCIDRs.
+	Draining bool
+	// AllocationPaused is true if the ClusterCIDR does not allocate CIDRs to
+	// new nodes.
+	AllocationPaused bool
+	// ObservedGeneration is the latest generation of the ClusterCIDR API
+	// object whose immutable fields match the tracked ClusterCIDR.
+	ObservedGeneration int64
+	// SpecHash is the hash of the immutable fields of the spec the tracked
+	// ClusterCIDR was created from.
+	SpecHash string
+	// PinnedReservations maps a node name to the CIDRs pinned to the node.
+	// The CIDRs stay occupied for the lifetime of the ClusterCIDR.
+	PinnedReservations map[string]*PinnedReservation
+}
+
+// PinnedReservation holds the CIDRs pinned to a node.
+type PinnedReservation struct {
+	// CIDRs are the pinned CIDRs of the node.
+	CIDRs []*net.IPNet
+	// Taken is true if a pinned CIDR is held by another node or overlaps a
+	// CIDR allocated from another ClusterCIDR.
+	Taken bool
+}
+
+// StickyReservation holds the CIDRs of a deleted node for a node with the
+// same name. The CIDRs stay occupied until the reservation expires.
+type StickyReservation struct {
+	// CIDRs are the CIDRs of the deleted node.
+	CIDRs []*net.IPNet
+	// ExpirationTime is the time the CIDRs are released.
+	ExpirationTime time.Time
 }
 
 const (
@@ -144,8 +234,15 @@ func NewMultiCIDRSet(cidrConfig *net.IPNet, perNodeHostBits int) (*MultiCIDRSet,
 		NodeMaskSize:     subNetMaskSize,
 		Label:            cidrConfig.String(),
 		AllocatedCIDRMap: make(map[string]bool, 0),
+		Strategy:         RoundRobin,
+		Clock:            clock.RealClock{},
+		handedOut:        make(map[int]bool),
+		quarantine:       make(map[int]time.Time),
 	}
+	multiCIDRSet.initUsedBlocks(subNetMaskSize - clusterMaskSize)
 	cidrSetMaxCidrs.WithLabelValues(multiCIDRSet.Label).Set(float64(maxCIDRs))
+	cidrSetQuarantined.WithLabelValues(multiCIDRSet.Label).Set(0)
+	multiCIDRSet.updateFragmentationMetrics()
 
 	return multiCIDRSet, nil
 }
@@ -196,8 +293,19 @@ func (s *MultiCIDRSet) indexToCIDRBlock(index int) (*net.IPNet, error) {
 }
 
 // NextCandidate returns the next candidate and the last evaluated index
-// for the current cidrSet. Returns nil if the candidate is already allocated.
+// for the current cidrSet. The candidate is picked by the Strategy of the set.
+// A candidate is not returned again until the set is changed by Occupy or
+// Release, so callers may reject a candidate and ask for the next one.
+// If aggregation is enabled, the candidate is outside of all the supernets.
 func (s *MultiCIDRSet) NextCandidate() (*net.IPNet, int, error) {
+	return s.NextGroupCandidate("")
+}
+
+// NextGroupCandidate returns the next candidate for a node of the given group
+// and the last evaluated index. The candidate belongs to the supernet of the
+// group, the supernet is reserved if the group does not have one yet.
+// An empty group returns a candidate outside of all the supernets.
+func (s *MultiCIDRSet) NextGroupCandidate(group string) (*net.IPNet, int, error) {
 	s.Lock()
 	defer s.Unlock()
 
@@ -207,23 +315,30 @@ func (s *MultiCIDRSet) NextCandidate() (*net.IPNet, int, error) {
 		}
 	}
 
-	candidate := s.nextCandidate
-	for i := 0; i < s.MaxCIDRs; i++ {
-		nextCandidateCIDR, err := s.indexToCIDRBlock(candidate)
-		if err != nil {
-			return nil, i, err
+	s.expireQuarantine()
+
+	if group != "" {
+		if _, err := s.reserveSupernet(group); err != nil {
+			return nil, 0, err
 		}
-		// Check if the nextCandidate is not already allocated.
-		if _, ok := s.AllocatedCIDRMap[nextCandidateCIDR.String()]; !ok {
-			s.nextCandidate = (candidate + 1) % s.MaxCIDRs
-			return nextCandidateCIDR, i, nil
+	}
+	s.candidateGroup = group
+
+	index, evaluated, ok := s.Strategy.next(s)
+	if !ok {
+		// Every free CIDR has been rejected, start over on the next request.
+		s.handedOut = make(map[int]bool)
+		return nil, evaluated, &CIDRRangeNoCIDRsRemainingErr{
+			CIDR: s.Label,
 		}
-		candidate = (candidate + 1) % s.MaxCIDRs
 	}
 
-	return nil, s.MaxCIDRs, &CIDRRangeNoCIDRsRemainingErr{
-		CIDR: s.Label,
+	candidate, err := s.indexToCIDRBlock(index)
+	if err != nil {
+		return nil, evaluated, err
 	}
+	s.handedOut[index] = true
+	return candidate, evaluated, nil
 }
 
 // getBeginningAndEndIndices returns the indices for the given CIDR, returned
@@ -271,8 +386,19 @@ func (s *MultiCIDRSet) getBeginningAndEndIndices(cidr *net.IPNet) (int, int, err
 	return begin, end, nil
 }
 
-// Release releases the given CIDR range.
+// Release releases the given CIDR range. The released CIDRs are quarantined
+// if the set has a quarantine duration.
 func (s *MultiCIDRSet) Release(cidr *net.IPNet) error {
+	return s.release(cidr, s.QuarantineDuration > 0)
+}
+
+// Rollback releases the given CIDR range without quarantine. It is used for
+// CIDRs that were occupied but never handed to a node.
+func (s *MultiCIDRSet) Rollback(cidr *net.IPNet) error {
+	return s.release(cidr, false)
+}
+
+func (s *MultiCIDRSet) release(cidr *net.IPNet, quarantine bool) error {
 	begin, end, err := s.getBeginningAndEndIndices(cidr)
 	if err != nil {
 		return err
@@ -290,11 +416,21 @@ func (s *MultiCIDRSet) Release(cidr *net.IPNet) error {
 		if _, ok := s.AllocatedCIDRMap[currCIDR.String()]; ok {
 			delete(s.AllocatedCIDRMap, currCIDR.String())
 			s.allocatedCIDRs--
+			s.markUsed(i, -1)
+			s.releaseEmptySupernet(i)
 			cidrSetReleases.WithLabelValues(s.Label).Inc()
+			if quarantine {
+				s.quarantine[i] = s.Clock.Now()
+			}
+			// The released CIDR is a candidate again, the other CIDRs
+			// handed out are still rejected.
+			delete(s.handedOut, i)
 		}
 	}
+	cidrSetQuarantined.WithLabelValues(s.Label).Set(float64(len(s.quarantine)))
 
 	cidrSetUsage.WithLabelValues(s.Label).Set(float64(s.allocatedCIDRs) / float64(s.MaxCIDRs))
+	s.updateFragmentationMetrics()
 
 	return nil
 }
@@ -320,9 +456,14 @@ func (s *MultiCIDRSet) Occupy(cidr *net.IPNet) (err error) {
 			s.AllocatedCIDRMap[currCIDR.String()] = true
 			cidrSetAllocations.WithLabelValues(s.Label).Inc()
 			s.allocatedCIDRs++
+			s.markUsed(i, 1)
 		}
+		delete(s.quarantine, i)
 	}
+	s.handedOut = make(map[int]bool)
+	cidrSetQuarantined.WithLabelValues(s.Label).Set(float64(len(s.quarantine)))
 	cidrSetUsage.WithLabelValues(s.Label).Set(float64(s.allocatedCIDRs) / float64(s.MaxCIDRs))
+	s.updateFragmentationMetrics()
 
 	return nil
 }
@@ -349,11 +490,198 @@ func (s *MultiCIDRSet) getIndexForIP(ip net.IP) (int, error) {
 	return 0, fmt.Errorf("invalid IP: %v", ip)
 }
 
+// Index returns the index of the given CIDR in the set.
+func (s *MultiCIDRSet) Index(cidr *net.IPNet) (int, error) {
+	if !s.ClusterCIDR.Contains(cidr.IP) {
+		return 0, fmt.Errorf("cidr %v is out the range of cluster cidr %v", cidr, s.ClusterCIDR)
+	}
+	return s.getIndexForIP(cidr.IP.Mask(s.nodeMask))
+}
+
+// IsFree returns true if the CIDR with the given index is neither allocated
+// nor quarantined.
+func (s *MultiCIDRSet) IsFree(index int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if index < 0 || index >= s.MaxCIDRs || s.usedBlocks[0][index] != 0 {
+		return false
+	}
+	releaseTime, quarantined := s.quarantine[index]
+	return !quarantined || s.quarantineExpired(releaseTime)
+}
+
 // UpdateEvaluatedCount increments the evaluated count.
 func (s *MultiCIDRSet) UpdateEvaluatedCount(evaluated int) {
 	cidrSetAllocationTriesPerRequest.WithLabelValues(s.Label).Observe(float64(evaluated))
 }
 
+// initUsedBlocks allocates the per level counters for a set of 2^levels CIDRs.
+func (s *MultiCIDRSet) initUsedBlocks(levels int) {
+	s.usedBlocks = make([]map[int]int32, levels+1)
+	s.freeGroups = make([]int, levels+1)
+	for k := range s.usedBlocks {
+		s.usedBlocks[k] = make(map[int]int32)
+		s.freeGroups[k] = s.MaxCIDRs >> k
+	}
+}
+
+// markUsed adds delta to the counters of every group containing the CIDR
+// with the given index.
+func (s *MultiCIDRSet) markUsed(index int, delta int32) {
+	for k := range s.usedBlocks {
+		g := index >> k
+		before := s.usedBlocks[k][g]
+		after := before + delta
+		switch {
+		case before == 0 && after != 0:
+			s.freeGroups[k]--
+		case before != 0 && after == 0:
+			s.freeGroups[k]++
+		}
+		if after == 0 {
+			delete(s.usedBlocks[k], g)
+		} else {
+			s.usedBlocks[k][g] = after
+		}
+	}
+}
+
+// isCandidate returns true if the CIDR with the given index is free, is not
+// quarantined, has not been handed out since the set was last changed and
+// belongs to the supernet of the group a candidate is looked for.
+func (s *MultiCIDRSet) isCandidate(index int) bool {
+	if s.usedBlocks[0][index] != 0 || s.handedOut[index] {
+		return false
+	}
+	if _, quarantined := s.quarantine[index]; quarantined {
+		return false
+	}
+	return s.inCandidateGroup(index)
+}
+
+// LargestFreeBlock returns the number of CIDRs in the largest aligned group of
+// CIDRs without any allocation. It is the largest supernet that could still
+// be carved out of the set.
+func (s *MultiCIDRSet) LargestFreeBlock() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.largestFreeBlock()
+}
+
+func (s *MultiCIDRSet) largestFreeBlock() int {
+	for k := len(s.freeGroups) - 1; k >= 0; k-- {
+		if s.freeGroups[k] > 0 {
+			return 1 << k
+		}
+	}
+	return 0
+}
+
+// Free returns the number of CIDRs of the set that are not allocated.
+func (s *MultiCIDRSet) Free() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.MaxCIDRs - s.allocatedCIDRs
+}
+
+// AllocatedCIDRs returns the allocated CIDRs of the set ordered by address.
+// The first offset allocated CIDRs are skipped and at most limit CIDRs are
+// returned, a negative limit returns all remaining CIDRs.
+func (s *MultiCIDRSet) AllocatedCIDRs(offset, limit int) ([]*net.IPNet, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	indices := make([]int, 0, len(s.usedBlocks[0]))
+	for index := range s.usedBlocks[0] {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	var cidrs []*net.IPNet
+	for _, index := range indices {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if limit >= 0 && len(cidrs) == limit {
+			break
+		}
+		cidr, err := s.indexToCIDRBlock(index)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// FreeBlocks returns the largest aligned blocks of CIDRs without any
+// allocation ordered by descending size and by address. A free block is not
+// part of a larger free block. At most limit blocks are returned, a negative
+// limit returns all blocks.
+func (s *MultiCIDRSet) FreeBlocks(limit int) ([]*net.IPNet, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var blocks []*net.IPNet
+	for k := len(s.usedBlocks) - 1; k >= 0; k-- {
+		if s.freeGroups[k] == 0 {
+			continue
+		}
+		for g := 0; g < s.MaxCIDRs>>k; g++ {
+			if limit >= 0 && len(blocks) == limit {
+				return blocks, nil
+			}
+			if s.usedBlocks[k][g] != 0 || (k+1 < len(s.usedBlocks) && s.usedBlocks[k+1][g>>1] == 0) {
+				continue
+			}
+			first, err := s.indexToCIDRBlock(g << k)
+			if err != nil {
+				return nil, err
+			}
+			_, bits := first.Mask.Size()
+			mask := net.CIDRMask(s.NodeMaskSize-k, bits)
+			blocks = append(blocks, &net.IPNet{IP: first.IP.Mask(mask), Mask: mask})
+		}
+	}
+	return blocks, nil
+}
+
+// NextCandidateIndex returns the index of the CIDR the RoundRobin strategy
+// checks first for the next candidate.
+func (s *MultiCIDRSet) NextCandidateIndex() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.nextCandidate
+}
+
+// Fragmentation returns the fragmentation of the free space of the set, from
+// 0 when all free CIDRs form a single aligned block to close to 1 when no two
+// free CIDRs can be merged into a larger aligned block.
+func (s *MultiCIDRSet) Fragmentation() float64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.fragmentation()
+}
+
+func (s *MultiCIDRSet) fragmentation() float64 {
+	free := s.MaxCIDRs - s.allocatedCIDRs
+	if free == 0 {
+		return 0
+	}
+	return 1 - float64(s.largestFreeBlock())/float64(free)
+}
+
+func (s *MultiCIDRSet) updateFragmentationMetrics() {
+	cidrSetLargestFreeBlock.WithLabelValues(s.Label).Set(float64(s.largestFreeBlock()))
+	cidrSetFragmentation.WithLabelValues(s.Label).Set(s.fragmentation())
+}
+
 // getMaxCIDRs returns the max number of CIDRs that can be obtained by subdividing a mask of size `clusterMaskSize`
 // into subnets with mask of size `subNetMaskSize`.
 func getMaxCIDRs(subNetMaskSize, clusterMaskSize int) int {
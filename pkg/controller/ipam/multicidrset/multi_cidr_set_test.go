@@ -447,6 +447,111 @@ func TestDoubleOccupyRelease(t *testing.T) {
 	}
 }
 
+func TestAllocatedCIDRs(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.42.0.0/16")
+	a, err := NewMultiCIDRSet(clusterCIDR, 8)
+	if err != nil {
+		t.Fatalf("Error allocating CIDRSet")
+	}
+	for _, cidrStr := range []string{"10.42.9.0/24", "10.42.5.0/24", "10.42.200.0/24"} {
+		_, cidr, _ := utilnet.ParseCIDRSloppy(cidrStr)
+		if err := a.Occupy(cidr); err != nil {
+			t.Fatalf("unexpected error occupying %s: %v", cidrStr, err)
+		}
+	}
+
+	testCases := []struct {
+		offset   int
+		limit    int
+		expected []string
+	}{
+		{offset: 0, limit: -1, expected: []string{"10.42.5.0/24", "10.42.9.0/24", "10.42.200.0/24"}},
+		{offset: 0, limit: 2, expected: []string{"10.42.5.0/24", "10.42.9.0/24"}},
+		{offset: 2, limit: 2, expected: []string{"10.42.200.0/24"}},
+		{offset: 3, limit: 2, expected: nil},
+	}
+	for _, tc := range testCases {
+		cidrs, err := a.AllocatedCIDRs(tc.offset, tc.limit)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var got []string
+		for _, cidr := range cidrs {
+			got = append(got, cidr.String())
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("AllocatedCIDRs(%d, %d): expected %v, got %v", tc.offset, tc.limit, tc.expected, got)
+		}
+	}
+}
+
+func TestFreeBlocks(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.42.0.0/22")
+	a, err := NewMultiCIDRSet(clusterCIDR, 8)
+	if err != nil {
+		t.Fatalf("Error allocating CIDRSet")
+	}
+	_, cidr, _ := utilnet.ParseCIDRSloppy("10.42.1.0/24")
+	if err := a.Occupy(cidr); err != nil {
+		t.Fatalf("unexpected error occupying %s: %v", cidr, err)
+	}
+
+	testCases := []struct {
+		limit    int
+		expected []string
+	}{
+		{limit: -1, expected: []string{"10.42.2.0/23", "10.42.0.0/24"}},
+		{limit: 10, expected: []string{"10.42.2.0/23", "10.42.0.0/24"}},
+		{limit: 1, expected: []string{"10.42.2.0/23"}},
+		{limit: 0, expected: nil},
+	}
+	for _, tc := range testCases {
+		blocks, err := a.FreeBlocks(tc.limit)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var got []string
+		for _, block := range blocks {
+			got = append(got, block.String())
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("FreeBlocks(%d): expected %v, got %v", tc.limit, tc.expected, got)
+		}
+	}
+}
+
+func TestUsedBlocksSparse(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/8")
+	a, err := NewMultiCIDRSet(clusterCIDR, 0)
+	if err != nil {
+		t.Fatalf("Error allocating CIDRSet")
+	}
+	_, cidr, _ := utilnet.ParseCIDRSloppy("10.1.2.3/32")
+	if err := a.Occupy(cidr); err != nil {
+		t.Fatalf("unexpected error occupying %s: %v", cidr, err)
+	}
+	for k, groups := range a.usedBlocks {
+		if len(groups) != 1 {
+			t.Errorf("level %d: expected 1 used group, got %d", k, len(groups))
+		}
+	}
+	if got := a.LargestFreeBlock(); got != 1<<23 {
+		t.Errorf("expected largest free block %d, got %d", 1<<23, got)
+	}
+
+	if err := a.Release(cidr); err != nil {
+		t.Fatalf("unexpected error releasing %s: %v", cidr, err)
+	}
+	for k, groups := range a.usedBlocks {
+		if len(groups) != 0 {
+			t.Errorf("level %d: expected no used group, got %d", k, len(groups))
+		}
+	}
+	if got := a.LargestFreeBlock(); got != 1<<24 {
+		t.Errorf("expected largest free block %d, got %d", 1<<24, got)
+	}
+}
+
 func TestGetBitforCIDR(t *testing.T) {
 	cases := []struct {
 		clusterCIDRStr  string
@@ -909,6 +1014,9 @@ func clearMetrics(labels map[string]string) {
 	cidrSetUsage.Delete(labels)
 	cidrSetAllocationTriesPerRequest.Delete(labels)
 	cidrSetMaxCidrs.Delete(labels)
+	cidrSetLargestFreeBlock.Delete(labels)
+	cidrSetFragmentation.Delete(labels)
+	cidrSetQuarantined.Delete(labels)
 }
 
 type testMetrics struct {
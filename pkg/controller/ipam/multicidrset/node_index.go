@@ -0,0 +1,106 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+)
+
+// CIDRIndexOutOfRangeErr is an error type used to denote that a CIDR index is
+// outside of the CIDR range.
+type CIDRIndexOutOfRangeErr struct {
+	// CIDR represents the CIDR the index is out of.
+	CIDR string
+	// Index is the requested index.
+	Index int
+	// MaxCIDRs is the number of CIDRs in the range.
+	MaxCIDRs int
+}
+
+func (err *CIDRIndexOutOfRangeErr) Error() string {
+	return fmt.Sprintf("CIDR index %d is out of the range %s with %d CIDRs", err.Index, err.CIDR, err.MaxCIDRs)
+}
+
+// NodeIndexTemplate maps a node to the index of its CIDR.
+type NodeIndexTemplate struct {
+	// NameRegex extracts the index from the node name with its first capture
+	// group.
+	NameRegex *regexp.Regexp
+	// Label is the node label holding the index.
+	Label string
+}
+
+// NewNodeIndexTemplate returns a NodeIndexTemplate that reads the index from
+// the node name with nameRegex, or from the node label if nameRegex is empty.
+func NewNodeIndexTemplate(nameRegex, label string) (*NodeIndexTemplate, error) {
+	if nameRegex == "" {
+		if label == "" {
+			return nil, errors.New("one of node name regex and label must be specified")
+		}
+		return &NodeIndexTemplate{Label: label}, nil
+	}
+
+	re, err := regexp.Compile(nameRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node name regex %q: %w", nameRegex, err)
+	}
+	if re.NumSubexp() == 0 {
+		return nil, fmt.Errorf("node name regex %q must have a capture group", nameRegex)
+	}
+	return &NodeIndexTemplate{NameRegex: re}, nil
+}
+
+// Index returns the index of the CIDR of the node with the given name and
+// labels.
+func (t *NodeIndexTemplate) Index(nodeName string, nodeLabels map[string]string) (int, error) {
+	var value string
+	if t.NameRegex != nil {
+		match := t.NameRegex.FindStringSubmatch(nodeName)
+		if match == nil {
+			return 0, fmt.Errorf("node name %q does not match %q", nodeName, t.NameRegex)
+		}
+		value = match[1]
+	} else {
+		var ok bool
+		if value, ok = nodeLabels[t.Label]; !ok {
+			return 0, fmt.Errorf("node %q does not have the label %q", nodeName, t.Label)
+		}
+	}
+
+	index, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index %q of node %q: %w", value, nodeName, err)
+	}
+	return index, nil
+}
+
+// CIDRBlock returns the CIDR with the given index. It returns a
+// CIDRIndexOutOfRangeErr if the index is outside of the set.
+func (s *MultiCIDRSet) CIDRBlock(index int) (*net.IPNet, error) {
+	if index < 0 || index >= s.MaxCIDRs {
+		return nil, &CIDRIndexOutOfRangeErr{
+			CIDR:     s.Label,
+			Index:    index,
+			MaxCIDRs: s.MaxCIDRs,
+		}
+	}
+	return s.indexToCIDRBlock(index)
+}
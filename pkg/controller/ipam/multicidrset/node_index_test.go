@@ -0,0 +1,123 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"errors"
+	"testing"
+
+	utilnet "k8s.io/utils/net"
+)
+
+func TestNodeIndexTemplate(t *testing.T) {
+	cases := []struct {
+		description string
+		nameRegex   string
+		label       string
+		nodeName    string
+		nodeLabels  map[string]string
+		expected    int
+		wantErr     bool
+	}{
+		{
+			description: "index from node name",
+			nameRegex:   `^rack\d+-node(\d+)$`,
+			nodeName:    "rack3-node17",
+			expected:    17,
+		},
+		{
+			description: "node name does not match",
+			nameRegex:   `^rack\d+-node(\d+)$`,
+			nodeName:    "worker-1",
+			wantErr:     true,
+		},
+		{
+			description: "index from label",
+			label:       "node-index",
+			nodeName:    "worker",
+			nodeLabels:  map[string]string{"node-index": "5"},
+			expected:    5,
+		},
+		{
+			description: "missing label",
+			label:       "node-index",
+			nodeName:    "worker",
+			wantErr:     true,
+		},
+		{
+			description: "label is not a number",
+			label:       "node-index",
+			nodeName:    "worker",
+			nodeLabels:  map[string]string{"node-index": "five"},
+			wantErr:     true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			template, err := NewNodeIndexTemplate(tc.nameRegex, tc.label)
+			if err != nil {
+				t.Fatalf("unexpected error creating template: %v", err)
+			}
+			index, err := template.Index(tc.nodeName, tc.nodeLabels)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got index %d", index)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if index != tc.expected {
+				t.Errorf("unexpected index %d, expected %d", index, tc.expected)
+			}
+		})
+	}
+
+	if _, err := NewNodeIndexTemplate(`node\d+`, ""); err == nil {
+		t.Errorf("expected error for a regex without a capture group")
+	}
+}
+
+func TestCIDRBlock(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/24")
+	set, err := NewMultiCIDRSet(clusterCIDR, 4)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+
+	block, err := set.CIDRBlock(15)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if block.String() != "10.0.0.240/28" {
+		t.Errorf("unexpected block %v", block)
+	}
+
+	for _, index := range []int{-1, 16} {
+		_, err := set.CIDRBlock(index)
+		var outOfRangeErr *CIDRIndexOutOfRangeErr
+		if !errors.As(err, &outOfRangeErr) {
+			t.Errorf("expected CIDRIndexOutOfRangeErr for index %d, got %v", index, err)
+		}
+	}
+
+	set.Strategy = NodeIndex
+	if _, _, err := set.NextCandidate(); err == nil {
+		t.Errorf("expected NodeIndex strategy to never return a candidate")
+	}
+}
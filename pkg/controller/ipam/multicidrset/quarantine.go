@@ -0,0 +1,108 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// QuarantinedCIDR is a released CIDR that is not allocated until its
+// quarantine expires.
+type QuarantinedCIDR struct {
+	// CIDR is the released CIDR.
+	CIDR *net.IPNet
+	// ReleaseTime is the time the CIDR was released.
+	ReleaseTime time.Time
+}
+
+// Quarantined returns the CIDRs in quarantine ordered by their position in
+// the set.
+func (s *MultiCIDRSet) Quarantined() []QuarantinedCIDR {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expireQuarantine()
+
+	indices := make([]int, 0, len(s.quarantine))
+	for i := range s.quarantine {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+
+	quarantined := make([]QuarantinedCIDR, 0, len(indices))
+	for _, i := range indices {
+		cidr, err := s.indexToCIDRBlock(i)
+		if err != nil {
+			continue
+		}
+		quarantined = append(quarantined, QuarantinedCIDR{CIDR: cidr, ReleaseTime: s.quarantine[i]})
+	}
+	return quarantined
+}
+
+// Quarantine puts the CIDR, released at the given time, in quarantine. It is
+// used to restore the quarantine, e.g. after a restart. Allocated CIDRs and
+// CIDRs whose quarantine has already expired are ignored.
+func (s *MultiCIDRSet) Quarantine(cidr *net.IPNet, releaseTime time.Time) error {
+	begin, end, err := s.getBeginningAndEndIndices(cidr)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if s.quarantineExpired(releaseTime) {
+		return nil
+	}
+	for i := begin; i <= end; i++ {
+		if s.usedBlocks[0][i] == 0 {
+			s.quarantine[i] = releaseTime
+		}
+	}
+	s.handedOut = make(map[int]bool)
+	cidrSetQuarantined.WithLabelValues(s.Label).Set(float64(len(s.quarantine)))
+	return nil
+}
+
+// IsQuarantined returns true if the CIDR with the given index is in
+// quarantine.
+func (s *MultiCIDRSet) IsQuarantined(index int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	releaseTime, quarantined := s.quarantine[index]
+	return quarantined && !s.quarantineExpired(releaseTime)
+}
+
+// expireQuarantine removes the CIDRs whose quarantine has expired.
+func (s *MultiCIDRSet) expireQuarantine() {
+	if len(s.quarantine) == 0 {
+		return
+	}
+	for i, releaseTime := range s.quarantine {
+		if s.quarantineExpired(releaseTime) {
+			delete(s.quarantine, i)
+		}
+	}
+	cidrSetQuarantined.WithLabelValues(s.Label).Set(float64(len(s.quarantine)))
+}
+
+func (s *MultiCIDRSet) quarantineExpired(releaseTime time.Time) bool {
+	return s.Clock.Since(releaseTime) >= s.QuarantineDuration
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/component-base/metrics/testutil"
+	testingclock "k8s.io/utils/clock/testing"
+	utilnet "k8s.io/utils/net"
+)
+
+func TestQuarantine(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/29")
+	set, err := NewMultiCIDRSet(clusterCIDR, 1)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	set.Clock = fakeClock
+	set.QuarantineDuration = time.Minute
+	set.Strategy = Sequential
+	labels := map[string]string{"clusterCIDR": "10.0.0.0/29"}
+	defer clearMetrics(labels)
+
+	_, released, _ := utilnet.ParseCIDRSloppy("10.0.0.0/31")
+	if err := set.Occupy(released); err != nil {
+		t.Fatalf("unexpected error occupying %v: %v", released, err)
+	}
+	if err := set.Release(released); err != nil {
+		t.Fatalf("unexpected error releasing %v: %v", released, err)
+	}
+	expectQuarantined(t, labels, 1)
+
+	candidate, _, err := set.NextCandidate()
+	if err != nil {
+		t.Fatalf("unexpected error getting candidate: %v", err)
+	}
+	if candidate.String() != "10.0.0.2/31" {
+		t.Errorf("expected the quarantined CIDR to be skipped, got %v", candidate)
+	}
+
+	quarantined := set.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].CIDR.String() != released.String() || !quarantined[0].ReleaseTime.Equal(fakeClock.Now()) {
+		t.Errorf("unexpected quarantine: %+v", quarantined)
+	}
+
+	fakeClock.SetTime(fakeClock.Now().Add(time.Minute))
+	// Releasing the free CIDR again does not quarantine it.
+	if err := set.Release(released); err != nil {
+		t.Fatalf("unexpected error releasing %v: %v", released, err)
+	}
+	candidate, _, err = set.NextCandidate()
+	if err != nil {
+		t.Fatalf("unexpected error getting candidate: %v", err)
+	}
+	if candidate.String() != released.String() {
+		t.Errorf("expected the CIDR to be available after the quarantine, got %v", candidate)
+	}
+	expectQuarantined(t, labels, 0)
+}
+
+func TestRollback(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/29")
+	set, err := NewMultiCIDRSet(clusterCIDR, 1)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+	set.Clock = testingclock.NewFakePassiveClock(time.Now())
+	set.QuarantineDuration = time.Minute
+	set.Strategy = BestFit
+	labels := map[string]string{"clusterCIDR": "10.0.0.0/29"}
+	defer clearMetrics(labels)
+
+	occupied, _, err := set.NextCandidate()
+	if err != nil {
+		t.Fatalf("unexpected error getting candidate: %v", err)
+	}
+	if err := set.Occupy(occupied); err != nil {
+		t.Fatalf("unexpected error occupying %v: %v", occupied, err)
+	}
+	rejected, _, err := set.NextCandidate()
+	if err != nil {
+		t.Fatalf("unexpected error getting candidate: %v", err)
+	}
+
+	// A rolled back CIDR is not quarantined and the rejected candidate is
+	// not handed out again.
+	if err := set.Rollback(occupied); err != nil {
+		t.Fatalf("unexpected error rolling back %v: %v", occupied, err)
+	}
+	expectQuarantined(t, labels, 0)
+	for i := 0; i < 2; i++ {
+		candidate, _, err := set.NextCandidate()
+		if err != nil {
+			t.Fatalf("unexpected error getting candidate: %v", err)
+		}
+		if candidate.String() == rejected.String() {
+			t.Errorf("expected the rejected candidate %v not to be handed out again", rejected)
+		}
+		if i == 0 && candidate.String() != occupied.String() {
+			t.Errorf("expected the rolled back CIDR %v, got %v", occupied, candidate)
+		}
+	}
+}
+
+func TestQuarantineExhausted(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/30")
+	set, err := NewMultiCIDRSet(clusterCIDR, 1)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+	set.QuarantineDuration = time.Hour
+	defer clearMetrics(map[string]string{"clusterCIDR": "10.0.0.0/30"})
+
+	for _, cidr := range []string{"10.0.0.0/31", "10.0.0.2/31"} {
+		_, released, _ := utilnet.ParseCIDRSloppy(cidr)
+		if err := set.Occupy(released); err != nil {
+			t.Fatalf("unexpected error occupying %v: %v", released, err)
+		}
+		if err := set.Release(released); err != nil {
+			t.Fatalf("unexpected error releasing %v: %v", released, err)
+		}
+	}
+	if _, _, err := set.NextCandidate(); err == nil {
+		t.Errorf("expected an error when all free CIDRs are quarantined")
+	}
+
+	// Occupying a quarantined CIDR removes it from the quarantine.
+	_, occupied, _ := utilnet.ParseCIDRSloppy("10.0.0.0/31")
+	if err := set.Occupy(occupied); err != nil {
+		t.Fatalf("unexpected error occupying %v: %v", occupied, err)
+	}
+	if quarantined := set.Quarantined(); len(quarantined) != 1 || quarantined[0].CIDR.String() != "10.0.0.2/31" {
+		t.Errorf("unexpected quarantine: %+v", quarantined)
+	}
+}
+
+func TestRestoreQuarantine(t *testing.T) {
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/29")
+	set, err := NewMultiCIDRSet(clusterCIDR, 1)
+	if err != nil {
+		t.Fatalf("unexpected error creating set: %v", err)
+	}
+	fakeClock := testingclock.NewFakePassiveClock(time.Now())
+	set.Clock = fakeClock
+	set.QuarantineDuration = time.Minute
+	defer clearMetrics(map[string]string{"clusterCIDR": "10.0.0.0/29"})
+
+	_, recent, _ := utilnet.ParseCIDRSloppy("10.0.0.0/31")
+	_, expired, _ := utilnet.ParseCIDRSloppy("10.0.0.2/31")
+	_, allocated, _ := utilnet.ParseCIDRSloppy("10.0.0.4/31")
+	if err := set.Occupy(allocated); err != nil {
+		t.Fatalf("unexpected error occupying %v: %v", allocated, err)
+	}
+	for cidr, releaseTime := range map[string]time.Time{
+		recent.String():    fakeClock.Now().Add(-time.Second),
+		expired.String():   fakeClock.Now().Add(-time.Hour),
+		allocated.String(): fakeClock.Now(),
+	} {
+		_, c, _ := utilnet.ParseCIDRSloppy(cidr)
+		if err := set.Quarantine(c, releaseTime); err != nil {
+			t.Fatalf("unexpected error quarantining %v: %v", c, err)
+		}
+	}
+
+	if quarantined := set.Quarantined(); len(quarantined) != 1 || quarantined[0].CIDR.String() != recent.String() {
+		t.Errorf("unexpected quarantine: %+v", quarantined)
+	}
+}
+
+func expectQuarantined(t *testing.T, labels map[string]string, expected float64) {
+	t.Helper()
+	quarantined, err := testutil.GetGaugeMetricValue(cidrSetQuarantined.With(labels))
+	if err != nil {
+		t.Fatalf("failed to get %s value, err: %v", cidrSetQuarantined.Name, err)
+	}
+	if quarantined != expected {
+		t.Errorf("unexpected quarantined CIDRs: %v, expected %v", quarantined, expected)
+	}
+}
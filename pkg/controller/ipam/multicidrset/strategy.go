@@ -0,0 +1,175 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// RoundRobinStrategyName is the name of the RoundRobin strategy.
+	RoundRobinStrategyName = "RoundRobin"
+	// SequentialStrategyName is the name of the Sequential strategy.
+	SequentialStrategyName = "Sequential"
+	// RandomStrategyName is the name of the Random strategy.
+	RandomStrategyName = "Random"
+	// BestFitStrategyName is the name of the BestFit strategy.
+	BestFitStrategyName = "BestFit"
+	// NodeIndexStrategyName is the name of the NodeIndex strategy.
+	NodeIndexStrategyName = "NodeIndex"
+)
+
+var (
+	// RoundRobin walks forward from the last allocated CIDR.
+	RoundRobin Strategy = roundRobin{}
+	// Sequential returns the free CIDR with the lowest address.
+	Sequential Strategy = sequential{}
+	// Random returns a free CIDR at a random position.
+	Random Strategy = random{}
+	// BestFit packs the CIDRs into the most used aligned supernet.
+	BestFit Strategy = bestFit{}
+	// NodeIndex never returns a candidate, the CIDR of a node is picked by
+	// its index, see NodeIndexTemplate.
+	NodeIndex Strategy = nodeIndex{}
+)
+
+// Strategy decides which free CIDR of a MultiCIDRSet is handed out next.
+type Strategy interface {
+	// Name returns the name of the strategy.
+	Name() string
+	// next returns the index of the next candidate and the number of CIDRs
+	// evaluated to find it, ok is false if there is no candidate left.
+	// It is called with the MultiCIDRSet locked.
+	next(s *MultiCIDRSet) (index, evaluated int, ok bool)
+}
+
+// NewStrategy returns the Strategy with the given name. An empty name
+// returns the RoundRobin strategy.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", RoundRobinStrategyName:
+		return RoundRobin, nil
+	case SequentialStrategyName:
+		return Sequential, nil
+	case RandomStrategyName:
+		return Random, nil
+	case BestFitStrategyName:
+		return BestFit, nil
+	case NodeIndexStrategyName:
+		return NodeIndex, nil
+	default:
+		return nil, fmt.Errorf("unknown allocation strategy %q", name)
+	}
+}
+
+type roundRobin struct{}
+
+func (roundRobin) Name() string { return RoundRobinStrategyName }
+
+func (roundRobin) next(s *MultiCIDRSet) (int, int, bool) {
+	candidate := s.nextCandidate
+	for i := 0; i < s.MaxCIDRs; i++ {
+		if s.isCandidate(candidate) {
+			s.nextCandidate = (candidate + 1) % s.MaxCIDRs
+			return candidate, i, true
+		}
+		candidate = (candidate + 1) % s.MaxCIDRs
+	}
+	return 0, s.MaxCIDRs, false
+}
+
+type sequential struct{}
+
+func (sequential) Name() string { return SequentialStrategyName }
+
+func (sequential) next(s *MultiCIDRSet) (int, int, bool) {
+	for i := 0; i < s.MaxCIDRs; i++ {
+		if s.isCandidate(i) {
+			return i, i, true
+		}
+	}
+	return 0, s.MaxCIDRs, false
+}
+
+type random struct{}
+
+func (random) Name() string { return RandomStrategyName }
+
+func (random) next(s *MultiCIDRSet) (int, int, bool) {
+	candidate := rand.Intn(s.MaxCIDRs)
+	for i := 0; i < s.MaxCIDRs; i++ {
+		if s.isCandidate(candidate) {
+			return candidate, i, true
+		}
+		candidate = (candidate + 1) % s.MaxCIDRs
+	}
+	return 0, s.MaxCIDRs, false
+}
+
+type bestFit struct{}
+
+func (bestFit) Name() string { return BestFitStrategyName }
+
+// next looks for the smallest partially used aligned supernet, preferring the
+// most used one, and returns its free CIDR with the lowest address. Keeping
+// the allocations packed leaves the largest possible aligned blocks free.
+func (bestFit) next(s *MultiCIDRSet) (int, int, bool) {
+	evaluated := 0
+	for k := 1; k < len(s.usedBlocks); k++ {
+		size := int32(1) << k
+		var groups []int
+		for g, used := range s.usedBlocks[k] {
+			if used < size {
+				groups = append(groups, g)
+			}
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if s.usedBlocks[k][groups[i]] != s.usedBlocks[k][groups[j]] {
+				return s.usedBlocks[k][groups[i]] > s.usedBlocks[k][groups[j]]
+			}
+			return groups[i] < groups[j]
+		})
+		for _, g := range groups {
+			for index := g << k; index < (g+1)<<k; index++ {
+				evaluated++
+				if s.isCandidate(index) {
+					return index, evaluated, true
+				}
+			}
+		}
+	}
+
+	// No partially used supernet has a candidate, the set is either empty or
+	// all the free CIDRs have already been handed out.
+	for index := 0; index < s.MaxCIDRs; index++ {
+		evaluated++
+		if s.isCandidate(index) {
+			return index, evaluated, true
+		}
+	}
+	return 0, evaluated, false
+}
+
+type nodeIndex struct{}
+
+func (nodeIndex) Name() string { return NodeIndexStrategyName }
+
+func (nodeIndex) next(*MultiCIDRSet) (int, int, bool) {
+	return 0, 0, false
+}
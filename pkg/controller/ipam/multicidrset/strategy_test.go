@@ -0,0 +1,218 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicidrset
+
+import (
+	"testing"
+
+	"k8s.io/component-base/metrics/testutil"
+	utilnet "k8s.io/utils/net"
+)
+
+func TestNewStrategy(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected Strategy
+		wantErr  bool
+	}{
+		{name: "", expected: RoundRobin},
+		{name: RoundRobinStrategyName, expected: RoundRobin},
+		{name: SequentialStrategyName, expected: Sequential},
+		{name: RandomStrategyName, expected: Random},
+		{name: BestFitStrategyName, expected: BestFit},
+		{name: NodeIndexStrategyName, expected: NodeIndex},
+		{name: "FirstFit", wantErr: true},
+	}
+	for _, tc := range cases {
+		strategy, err := NewStrategy(tc.name)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("expected error for strategy %q", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for strategy %q: %v", tc.name, err)
+		}
+		if strategy != tc.expected {
+			t.Errorf("unexpected strategy for %q: %v, expected %v", tc.name, strategy.Name(), tc.expected.Name())
+		}
+	}
+}
+
+func TestStrategyNextCandidate(t *testing.T) {
+	cases := []struct {
+		description string
+		strategy    Strategy
+		// allocated is the number of CIDRs allocated before the test.
+		allocated int
+		// occupied CIDRs before the test.
+		occupied []string
+		// released CIDRs before the test.
+		released []string
+		expected []string
+	}{
+		{
+			description: "round robin continues after the last allocated CIDR",
+			strategy:    RoundRobin,
+			allocated:   3,
+			released:    []string{"10.0.0.0/30"},
+			expected:    []string{"10.0.0.12/30", "10.0.0.16/30"},
+		},
+		{
+			description: "sequential returns the lowest free CIDR",
+			strategy:    Sequential,
+			allocated:   3,
+			released:    []string{"10.0.0.4/30"},
+			expected:    []string{"10.0.0.4/30", "10.0.0.12/30"},
+		},
+		{
+			description: "best fit fills the smallest partially used supernet first",
+			strategy:    BestFit,
+			occupied:    []string{"10.0.0.0/30", "10.0.0.16/30", "10.0.0.20/30", "10.0.0.24/30"},
+			expected:    []string{"10.0.0.4/30", "10.0.0.28/30", "10.0.0.8/30"},
+		},
+		{
+			description: "best fit starts with the first CIDR of an empty set",
+			strategy:    BestFit,
+			expected:    []string{"10.0.0.0/30", "10.0.0.4/30"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/27")
+			s, err := NewMultiCIDRSet(clusterCIDR, 2)
+			if err != nil {
+				t.Fatalf("unexpected error creating MultiCIDRSet: %v", err)
+			}
+			s.Strategy = tc.strategy
+
+			for i := 0; i < tc.allocated; i++ {
+				if _, err := allocateNext(s); err != nil {
+					t.Fatalf("unexpected error allocating: %v", err)
+				}
+			}
+			for _, cidr := range tc.occupied {
+				_, c, _ := utilnet.ParseCIDRSloppy(cidr)
+				if err := s.Occupy(c); err != nil {
+					t.Fatalf("unexpected error occupying %s: %v", cidr, err)
+				}
+			}
+			for _, cidr := range tc.released {
+				_, c, _ := utilnet.ParseCIDRSloppy(cidr)
+				if err := s.Release(c); err != nil {
+					t.Fatalf("unexpected error releasing %s: %v", cidr, err)
+				}
+			}
+
+			for _, expected := range tc.expected {
+				p, err := allocateNext(s)
+				if err != nil {
+					t.Fatalf("unexpected error allocating: %v", err)
+				}
+				if p.String() != expected {
+					t.Fatalf("unexpected allocated cidr: %v, expecting %v", p, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestNextCandidateRejected(t *testing.T) {
+	for _, strategy := range []Strategy{RoundRobin, Sequential, Random, BestFit} {
+		t.Run(strategy.Name(), func(t *testing.T) {
+			_, clusterCIDR, _ := utilnet.ParseCIDRSloppy("10.0.0.0/28")
+			s, err := NewMultiCIDRSet(clusterCIDR, 2)
+			if err != nil {
+				t.Fatalf("unexpected error creating MultiCIDRSet: %v", err)
+			}
+			s.Strategy = strategy
+
+			// Reject every candidate, each free CIDR must be returned once.
+			seen := map[string]bool{}
+			for i := 0; i < s.MaxCIDRs; i++ {
+				candidate, _, err := s.NextCandidate()
+				if err != nil {
+					t.Fatalf("unexpected error getting candidate %d: %v", i, err)
+				}
+				if seen[candidate.String()] {
+					t.Fatalf("candidate %v returned twice", candidate)
+				}
+				seen[candidate.String()] = true
+			}
+			if _, _, err := s.NextCandidate(); err == nil {
+				t.Fatalf("expected error once all candidates are rejected")
+			}
+			// The next request starts over.
+			if _, err := allocateNext(s); err != nil {
+				t.Fatalf("unexpected error allocating after rejecting all candidates: %v", err)
+			}
+		})
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	cidr := "10.1.0.0/28"
+	_, clusterCIDR, _ := utilnet.ParseCIDRSloppy(cidr)
+	clearMetrics(map[string]string{"clusterCIDR": cidr})
+
+	s, err := NewMultiCIDRSet(clusterCIDR, 2)
+	if err != nil {
+		t.Fatalf("unexpected error creating MultiCIDRSet: %v", err)
+	}
+	expectFragmentation(t, s, 4, 0)
+
+	// Occupying the second CIDR leaves the upper half as the largest block,
+	// the first CIDR cannot be merged with it.
+	_, c, _ := utilnet.ParseCIDRSloppy("10.1.0.4/30")
+	s.Occupy(c)
+	expectFragmentation(t, s, 2, 1-float64(2)/3)
+
+	_, c, _ = utilnet.ParseCIDRSloppy("10.1.0.8/30")
+	s.Occupy(c)
+	expectFragmentation(t, s, 1, 0.5)
+
+	s.Release(clusterCIDR)
+	expectFragmentation(t, s, 4, 0)
+
+	s.Occupy(clusterCIDR)
+	expectFragmentation(t, s, 0, 0)
+}
+
+func expectFragmentation(t *testing.T, s *MultiCIDRSet, largest int, fragmentation float64) {
+	t.Helper()
+	if got := s.LargestFreeBlock(); got != largest {
+		t.Errorf("unexpected largest free block: %d, expected %d", got, largest)
+	}
+	if got := s.Fragmentation(); got != fragmentation {
+		t.Errorf("unexpected fragmentation: %v, expected %v", got, fragmentation)
+	}
+	gotLargest, err := testutil.GetGaugeMetricValue(cidrSetLargestFreeBlock.WithLabelValues(s.Label))
+	if err != nil {
+		t.Errorf("failed to get %s value, err: %v", cidrSetLargestFreeBlock.Name, err)
+	}
+	if gotLargest != float64(largest) {
+		t.Errorf("unexpected largest free block metric: %v, expected %d", gotLargest, largest)
+	}
+	gotFragmentation, err := testutil.GetGaugeMetricValue(cidrSetFragmentation.WithLabelValues(s.Label))
+	if err != nil {
+		t.Errorf("failed to get %s value, err: %v", cidrSetFragmentation.Name, err)
+	}
+	if gotFragmentation != fragmentation {
+		t.Errorf("unexpected fragmentation metric: %v, expected %v", gotFragmentation, fragmentation)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package offline builds a CIDR allocator from lists of ClusterCIDRs and nodes
+// without a connection to an API server.
+//
+// The allocator is the one run by the controller, backed by fake clientsets
+// and informers. The dependency on the client-go fakes is deliberate: the
+// allocations computed offline go through the same bootstrap, ordering and
+// patching code as in the cluster, instead of a copy of the reservation logic
+// that could drift from it.
+//
+// Separating the reservation core of the allocator from client-go behind a
+// narrow interface is out of scope: the core still reads nodes through the
+// node lister and publishes PodCIDRs through the clientset, which is why this
+// package needs the fakes.
+package offline
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	v1 "github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	clustercidrfake "github.com/mneverov/cluster-cidr-controller/pkg/client/clientset/versioned/fake"
+	clustercidrinformers "github.com/mneverov/cluster-cidr-controller/pkg/client/informers/externalversions"
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
+)
+
+// NewAllocator returns a CIDR allocator backed by fake clientsets holding the
+// ClusterCIDRs and nodes. The PodCIDRs of the nodes are occupied, the
+// allocator is not run: it answers queries about the state of the
+// ClusterCIDRs and allocates CIDRs of nodes passed to AllocateOrOccupyCIDR.
+// The informers stop when the context is done.
+func NewAllocator(ctx context.Context, clusterCIDRs []v1.ClusterCIDR, nodes []corev1.Node, params ipam.CIDRAllocatorParams) (ipam.CIDRAllocator, error) {
+	allocator, _, err := newAllocator(ctx, clusterCIDRs, nodes, params)
+	return allocator, err
+}
+
+// newAllocator returns the allocator and the fake clientset holding the nodes
+// patched by the allocator.
+func newAllocator(ctx context.Context, clusterCIDRs []v1.ClusterCIDR, nodes []corev1.Node, params ipam.CIDRAllocatorParams) (ipam.CIDRAllocator, *fake.Clientset, error) {
+	clusterCIDRObjects := make([]runtime.Object, 0, len(clusterCIDRs))
+	for i := range clusterCIDRs {
+		clusterCIDR := clusterCIDRs[i].DeepCopy()
+		// The fake clientset rejects updates of objects without a resource
+		// version, the allocator adds its finalizer during bootstrap.
+		if clusterCIDR.ResourceVersion == "" {
+			clusterCIDR.ResourceVersion = "1"
+		}
+		clusterCIDRObjects = append(clusterCIDRObjects, clusterCIDR)
+	}
+	nodeObjects := make([]runtime.Object, 0, len(nodes))
+	for i := range nodes {
+		nodeObjects = append(nodeObjects, nodes[i].DeepCopy())
+	}
+
+	client := fake.NewSimpleClientset(nodeObjects...)
+	clusterCIDRClient := clustercidrfake.NewSimpleClientset(clusterCIDRObjects...)
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	clusterCIDRInformerFactory := clustercidrinformers.NewSharedInformerFactory(clusterCIDRClient, 0)
+	nodeInformer := informerFactory.Core().V1().Nodes()
+	clusterCIDRInformer := clusterCIDRInformerFactory.Networking().V1().ClusterCIDRs()
+
+	allocator, err := ipam.NewMultiCIDRRangeAllocator(
+		ctx,
+		client,
+		clusterCIDRClient.NetworkingV1().ClusterCIDRs(),
+		nodeInformer,
+		clusterCIDRInformer,
+		params,
+		&corev1.NodeList{Items: nodes},
+		nil,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	informerFactory.Start(ctx.Done())
+	clusterCIDRInformerFactory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), nodeInformer.Informer().HasSynced, clusterCIDRInformer.Informer().HasSynced) {
+		return nil, nil, fmt.Errorf("unable to sync the caches: %w", ctx.Err())
+	}
+	return allocator, client, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package offline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/ktesting"
+
+	v1 "github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
+)
+
+func TestNewAllocator(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	clusterCIDRs := []v1.ClusterCIDR{{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool"},
+		Spec:       v1.ClusterCIDRSpec{PerNodeHostBits: 8, IPv4: "10.40.0.0/16"},
+	}}
+	nodes := []corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "node-0",
+				Annotations: map[string]string{v1.AnnotationAdditionalPodCIDRs: `["10.40.1.0/24"]`},
+			},
+			Spec: corev1.NodeSpec{PodCIDRs: []string{"10.40.0.0/24"}},
+		},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+	}
+
+	allocator, err := NewAllocator(ctx, clusterCIDRs, nodes, ipam.CIDRAllocatorParams{})
+	require.NoError(t, err)
+
+	result, err := allocator.Whois("10.40.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, ipam.WhoisAllocated, result.Status)
+	assert.Equal(t, "node-0", result.Node)
+
+	// The additional pod CIDRs published on the nodes are occupied.
+	result, err = allocator.Whois("10.40.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, ipam.WhoisAllocated, result.Status)
+	assert.Equal(t, "node-0", result.Node)
+
+	explanation, err := allocator.Explain("node-1", nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, explanation.ClusterCIDRs)
+	assert.Equal(t, "pool", explanation.ClusterCIDRs[0].Name)
+	assert.Equal(t, 1, explanation.ClusterCIDRs[0].Rank)
+
+	blocks, err := allocator.FreeBlocks("pool", 1)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "10.40.128.0/17", blocks[0].String())
+
+	// PodCIDRs outside of the ClusterCIDRs can not be occupied.
+	nodes[1].Spec.PodCIDRs = []string{"10.41.0.0/24"}
+	_, err = NewAllocator(ctx, clusterCIDRs, nodes, ipam.CIDRAllocatorParams{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package offline
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	v1 "github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
+)
+
+// SimulationResult is the outcome of the allocation of PodCIDRs to a list of
+// nodes.
+type SimulationResult struct {
+	// Nodes are the PodCIDRs of the nodes in the order of the node list.
+	Nodes []NodeAllocation `json:"nodes"`
+	// ExhaustionPoints are the first nodes of each set of labels that were
+	// not allocated PodCIDRs.
+	ExhaustionPoints []ExhaustionPoint `json:"exhaustionPoints"`
+	// State is the state of the ClusterCIDRs once all nodes are processed.
+	State *ipam.AllocatorState `json:"state"`
+}
+
+// NodeAllocation holds the PodCIDRs of a node and the ClusterCIDR they belong
+// to.
+type NodeAllocation struct {
+	Node        string   `json:"node"`
+	PodCIDRs    []string `json:"podCIDRs,omitempty"`
+	ClusterCIDR string   `json:"clusterCIDR,omitempty"`
+	// Existing is true if the node had PodCIDRs in the node list.
+	Existing bool `json:"existing,omitempty"`
+	// Error is the reason the node was not allocated PodCIDRs.
+	Error string `json:"error,omitempty"`
+}
+
+// ExhaustionPoint is the first node of a set of labels that was not allocated
+// PodCIDRs.
+type ExhaustionPoint struct {
+	Labels string `json:"labels"`
+	Node   string `json:"node"`
+	// Allocated is the number of nodes with the labels allocated PodCIDRs
+	// before the node.
+	Allocated int    `json:"allocated"`
+	Error     string `json:"error"`
+}
+
+// Simulate allocates PodCIDRs to the nodes of the list without PodCIDRs, in
+// the order of the list, once the PodCIDRs of the other nodes are occupied.
+// The allocator runs against in-memory ClusterCIDRs and nodes.
+func Simulate(ctx context.Context, clusterCIDRs []v1.ClusterCIDR, nodes []corev1.Node, params ipam.CIDRAllocatorParams) (*SimulationResult, error) {
+	allocator, client, err := newAllocator(ctx, clusterCIDRs, nodes, params)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := klog.FromContext(ctx)
+	result := &SimulationResult{Nodes: make([]NodeAllocation, 0, len(nodes)), ExhaustionPoints: []ExhaustionPoint{}}
+	allocated := make(map[string]int)
+	exhausted := make(map[string]bool)
+	for i := range nodes {
+		node := &nodes[i]
+		nodeLabels := labels.Set(node.Labels).String()
+		nodeAllocation := NodeAllocation{Node: node.Name, Existing: len(node.Spec.PodCIDRs) > 0}
+		if !nodeAllocation.Existing {
+			if err := allocator.AllocateOrOccupyCIDR(logger, node.DeepCopy()); err != nil {
+				nodeAllocation.Error = err.Error()
+			}
+			if node, err = client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{}); err != nil {
+				return nil, err
+			}
+		}
+
+		nodeAllocation.PodCIDRs = node.Spec.PodCIDRs
+		if len(node.Spec.PodCIDRs) > 0 {
+			allocated[nodeLabels]++
+			owner, err := allocator.Whois(node.Spec.PodCIDRs[0])
+			if err != nil {
+				return nil, err
+			}
+			nodeAllocation.ClusterCIDR = owner.ClusterCIDR
+		} else if nodeAllocation.Error != "" && !exhausted[nodeLabels] {
+			exhausted[nodeLabels] = true
+			result.ExhaustionPoints = append(result.ExhaustionPoints, ExhaustionPoint{
+				Labels:    nodeLabels,
+				Node:      node.Name,
+				Allocated: allocated[nodeLabels],
+				Error:     nodeAllocation.Error,
+			})
+		}
+		result.Nodes = append(result.Nodes, nodeAllocation)
+	}
+
+	// The allocated CIDRs are listed per node, the state only holds the
+	// utilisation of the ClusterCIDRs.
+	if result.State, err = allocator.State(0, 0); err != nil {
+		return nil, err
+	}
+	result.State.Continue = ""
+	return result, nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package offline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/ktesting"
+
+	v1 "github.com/mneverov/cluster-cidr-controller/pkg/apis/clustercidr/v1"
+	"github.com/mneverov/cluster-cidr-controller/pkg/controller/ipam"
+)
+
+func TestSimulate(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	clusterCIDRs := []v1.ClusterCIDR{{
+		ObjectMeta: metav1.ObjectMeta{Name: "zone-a"},
+		Spec: v1.ClusterCIDRSpec{
+			PerNodeHostBits: 8,
+			IPv4:            "10.50.0.0/22",
+			NodeSelector: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}},
+			}}},
+		},
+	}}
+	nodes := []corev1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: "existing", Labels: map[string]string{"zone": "a"}},
+		Spec:       corev1.NodeSpec{PodCIDRs: []string{"10.50.2.0/24"}},
+	}}
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node-%d", i), Labels: map[string]string{"zone": "a"}}})
+	}
+	nodes = append(nodes, corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "unmatched", Labels: map[string]string{"zone": "b"}}})
+
+	result, err := Simulate(ctx, clusterCIDRs, nodes, ipam.CIDRAllocatorParams{})
+	require.NoError(t, err)
+	require.Len(t, result.Nodes, len(nodes))
+	assert.Equal(t, NodeAllocation{Node: "existing", PodCIDRs: []string{"10.50.2.0/24"}, ClusterCIDR: "zone-a", Existing: true}, result.Nodes[0])
+	for i, nodeAllocation := range result.Nodes[1:4] {
+		assert.Len(t, nodeAllocation.PodCIDRs, 1, "node-%d", i)
+		assert.Equal(t, "zone-a", nodeAllocation.ClusterCIDR, "node-%d", i)
+		assert.Empty(t, nodeAllocation.Error, "node-%d", i)
+	}
+	for _, nodeAllocation := range result.Nodes[4:] {
+		assert.Empty(t, nodeAllocation.PodCIDRs, nodeAllocation.Node)
+		assert.NotEmpty(t, nodeAllocation.Error, nodeAllocation.Node)
+	}
+
+	require.Len(t, result.ExhaustionPoints, 2)
+	assert.Equal(t, "zone=a", result.ExhaustionPoints[0].Labels)
+	assert.Equal(t, "node-3", result.ExhaustionPoints[0].Node)
+	assert.Equal(t, 4, result.ExhaustionPoints[0].Allocated)
+	assert.Equal(t, "zone=b", result.ExhaustionPoints[1].Labels)
+	assert.Equal(t, 0, result.ExhaustionPoints[1].Allocated)
+
+	require.Len(t, result.State.NodeSelectors, 1)
+	require.Len(t, result.State.NodeSelectors[0].ClusterCIDRs, 1)
+	assert.Equal(t, 4, result.State.NodeSelectors[0].ClusterCIDRs[0].IPv4.Allocated)
+	assert.Equal(t, 0, result.State.NodeSelectors[0].ClusterCIDRs[0].IPv4.Free)
+}
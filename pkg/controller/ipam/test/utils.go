@@ -303,7 +303,7 @@ func (m *FakeNodeHandler) Watch(_ context.Context, _ metav1.ListOptions) (watch.
 }
 
 // Patch patches a Node in the fake store.
-func (m *FakeNodeHandler) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, _ metav1.PatchOptions, _ ...string) (*v1.Node, error) {
+func (m *FakeNodeHandler) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, _ metav1.PatchOptions, subresources ...string) (*v1.Node, error) {
 	m.lock.Lock()
 	defer func() {
 		m.RequestCount++
@@ -370,6 +370,12 @@ func (m *FakeNodeHandler) Patch(ctx context.Context, name string, pt types.Patch
 		return nil, nil
 	}
 
+	// Status patches are recorded like status updates.
+	if len(subresources) > 0 && subresources[0] == "status" {
+		m.UpdatedNodeStatuses = append(m.UpdatedNodeStatuses, &updatedNode)
+		return &updatedNode, nil
+	}
+
 	if updatedNodeIndex < 0 {
 		m.UpdatedNodes = append(m.UpdatedNodes, &updatedNode)
 	} else {
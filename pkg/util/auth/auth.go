@@ -0,0 +1,101 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package auth authenticates and authorizes requests to the debug endpoints
+// of the controller with the Kubernetes API server.
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// WithDelegatedAuth returns a handler that serves only requests with a bearer
+// token that is authenticated by a TokenReview and whose user is allowed to
+// get the non-resource URL of the request, e.g. by a ClusterRole with the rule
+// `nonResourceURLs: ["/debug/*"], verbs: ["get"]`.
+func WithDelegatedAuth(c kubernetes.Interface, logger klog.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := bearerToken(req)
+		if !ok {
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		tokenReview, err := c.AuthenticationV1().TokenReviews().Create(req.Context(), &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			logger.Error(err, "Unable to authenticate debug request", "path", req.URL.Path)
+			http.Error(w, "unable to authenticate request", http.StatusInternalServerError)
+			return
+		}
+		if !tokenReview.Status.Authenticated {
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		user := tokenReview.Status.User
+		extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+		for key, value := range user.Extra {
+			extra[key] = authorizationv1.ExtraValue(value)
+		}
+		accessReview, err := c.AuthorizationV1().SubjectAccessReviews().Create(req.Context(), &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   user.Username,
+				UID:    user.UID,
+				Groups: user.Groups,
+				Extra:  extra,
+				NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+					Path: req.URL.Path,
+					Verb: strings.ToLower(req.Method),
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			logger.Error(err, "Unable to authorize debug request", "path", req.URL.Path, "user", user.Username)
+			http.Error(w, "unable to authorize request", http.StatusInternalServerError)
+			return
+		}
+		if !accessReview.Status.Allowed {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// bearerToken returns the bearer token of the Authorization header of the
+// request.
+func bearerToken(req *http.Request) (string, bool) {
+	const prefix = "bearer "
+	header := req.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+	return token, token != ""
+}
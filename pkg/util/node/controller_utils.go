@@ -40,3 +40,29 @@ func RecordNodeStatusChange(logger klog.Logger, recorder record.EventRecorder, n
 	//  and event is recorded or neither should happen, see issue #6055.
 	recorder.Eventf(ref, v1.EventTypeNormal, newStatus, "Node %s status is now: %s", node.Name, newStatus)
 }
+
+// RecordNodeEvent records a normal event with the given reason and message for a node.
+func RecordNodeEvent(logger klog.Logger, recorder record.EventRecorder, node *v1.Node, reason, message string) {
+	ref := &v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       node.Name,
+		UID:        node.UID,
+		Namespace:  "",
+	}
+	logger.V(2).Info("Recording event message for node", "reason", reason, "node", node.Name, "message", message)
+	recorder.Event(ref, v1.EventTypeNormal, reason, message)
+}
+
+// RecordNodeWarning records a warning event with the given reason and message for a node.
+func RecordNodeWarning(logger klog.Logger, recorder record.EventRecorder, node *v1.Node, reason, message string) {
+	ref := &v1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       node.Name,
+		UID:        node.UID,
+		Namespace:  "",
+	}
+	logger.V(2).Info("Recording warning event message for node", "reason", reason, "node", node.Name, "message", message)
+	recorder.Event(ref, v1.EventTypeWarning, reason, message)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+type nodeForCIDRAndTaintsMergePatch struct {
+	Metadata nodeMetadataForMergePatch     `json:"metadata"`
+	Spec     nodeSpecForCIDRAndTaintsPatch `json:"spec"`
+}
+
+type nodeMetadataForMergePatch struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type nodeSpecForCIDRAndTaintsPatch struct {
+	PodCIDR  string     `json:"podCIDR"`
+	PodCIDRs []string   `json:"podCIDRs"`
+	Taints   []v1.Taint `json:"taints"`
+}
+
+// PatchNodeCIDRsAndTaints patches node.CIDR=cidrs[0], node.CIDRs and
+// node.Taints to the given values in a single request. The patch is
+// conditional on the resource version of the node, as the taints are
+// replaced as a whole.
+func PatchNodeCIDRsAndTaints(c clientset.Interface, node *v1.Node, cidrs []string, taints []v1.Taint) error {
+	if taints == nil {
+		taints = []v1.Taint{}
+	}
+	patch := nodeForCIDRAndTaintsMergePatch{
+		Metadata: nodeMetadataForMergePatch{ResourceVersion: node.ResourceVersion},
+		Spec: nodeSpecForCIDRAndTaintsPatch{
+			PodCIDR:  cidrs[0],
+			PodCIDRs: cidrs,
+			Taints:   taints,
+		},
+	}
+
+	patchBytes, err := json.Marshal(&patch)
+	if err != nil {
+		return fmt.Errorf("failed to json.Marshal CIDR and taints: %w", err)
+	}
+	if _, err := c.CoreV1().Nodes().Patch(context.TODO(), node.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch node CIDR and taints: %w", err)
+	}
+	return nil
+}
+
+// SetNodeCondition updates the condition of the node through the status
+// subresource. Other conditions are left untouched.
+func SetNodeCondition(c clientset.Interface, node types.NodeName, condition v1.NodeCondition) error {
+	condition.LastHeartbeatTime = metav1.NewTime(time.Now())
+	raw, err := json.Marshal(&[]v1.NodeCondition{condition})
+	if err != nil {
+		return err
+	}
+	patch := []byte(fmt.Sprintf(`{"status":{"conditions":%s}}`, raw))
+	_, err = c.CoreV1().Nodes().PatchStatus(context.TODO(), string(node), patch)
+	return err
+}
+
+type nodeForSchedulingMergePatch struct {
+	Metadata nodeMetadataForMergePatch  `json:"metadata"`
+	Spec     nodeSpecForSchedulingPatch `json:"spec"`
+}
+
+type nodeSpecForSchedulingPatch struct {
+	Unschedulable bool       `json:"unschedulable"`
+	Taints        []v1.Taint `json:"taints"`
+}
+
+// PatchNodeScheduling patches node.Unschedulable and node.Taints to the given
+// values. The patch is conditional on the resource version of the node, as
+// the taints are replaced as a whole.
+func PatchNodeScheduling(c clientset.Interface, node *v1.Node, unschedulable bool, taints []v1.Taint) error {
+	if taints == nil {
+		taints = []v1.Taint{}
+	}
+	patch := nodeForSchedulingMergePatch{
+		Metadata: nodeMetadataForMergePatch{ResourceVersion: node.ResourceVersion},
+		Spec: nodeSpecForSchedulingPatch{
+			Unschedulable: unschedulable,
+			Taints:        taints,
+		},
+	}
+
+	patchBytes, err := json.Marshal(&patch)
+	if err != nil {
+		return fmt.Errorf("failed to json.Marshal unschedulable and taints: %w", err)
+	}
+	if _, err := c.CoreV1().Nodes().Patch(context.TODO(), node.Name, types.StrategicMergePatchType, patchBytes, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to patch node unschedulable and taints: %w", err)
+	}
+	return nil
+}